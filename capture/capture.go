@@ -0,0 +1,64 @@
+// Package capture implements reading and writing of SEMS traffic capture
+// files.
+//
+// A capture file is newline-delimited JSON (NDJSON). Each line is a single
+// JSON object describing one frame seen on the wire:
+//
+//	{"time":"2023-11-26T22:04:33.123456789+08:00","connID":"3Ff8...","direction":"outbound","raw":"504f535447570000...","cleartext":"0408000817..."}
+//
+// The fields are:
+//
+//   - time: RFC 3339 timestamp with nanoseconds at which the frame was read.
+//   - connID: identifier of the device connection the frame was seen on.
+//   - direction: "outbound" (device to SEMS) or "inbound" (SEMS to device).
+//   - raw: lowercase hex encoding of the complete frame as read from the
+//     wire, including header and CRC.
+//   - cleartext: lowercase hex encoding of the decrypted frame body. This
+//     field is omitted if the frame could not be decrypted, or is not
+//     encrypted (e.g. keepalives).
+//
+// Files are only ever appended to. When a Writer rotates a file, the current
+// file is renamed with a UTC timestamp suffix and a new file is started at
+// the original path.
+package capture
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const (
+	// DirectionOutbound indicates a frame sent by the device to SEMS.
+	DirectionOutbound = "outbound"
+	// DirectionInbound indicates a frame sent by SEMS to the device.
+	DirectionInbound = "inbound"
+)
+
+// Entry is a single frame in a capture file.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	ConnID    string    `json:"connID"`
+	Direction string    `json:"direction"`
+	Raw       HexBytes  `json:"raw"`
+	Cleartext HexBytes  `json:"cleartext,omitempty"`
+}
+
+// HexBytes is a byte slice which is represented in JSON as a lowercase hex
+// string.
+type HexBytes []byte
+
+// MarshalText implements encoding.TextMarshaler.
+func (b HexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (b *HexBytes) UnmarshalText(text []byte) error {
+	data, err := hex.DecodeString(string(text))
+	if err != nil {
+		return fmt.Errorf("couldn't decode hex: %v", err)
+	}
+	*b = data
+	return nil
+}
@@ -0,0 +1,97 @@
+package capture
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestWriteRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.ndjson")
+	w, err := NewWriter(path, 0, 0)
+	assert.NoError(t, err)
+	entries := []Entry{
+		{
+			Time:      time.Date(2023, time.November, 26, 22, 4, 33, 0, time.UTC),
+			ConnID:    "conn0",
+			Direction: DirectionOutbound,
+			Raw:       HexBytes{0x50, 0x4f, 0x53, 0x54, 0x47, 0x57},
+			Cleartext: HexBytes{0x00, 0xff},
+		},
+		{
+			Time:      time.Date(2023, time.November, 26, 22, 4, 34, 0, time.UTC),
+			ConnID:    "conn0",
+			Direction: DirectionInbound,
+			Raw:       HexBytes{0x01, 0x02},
+		},
+	}
+	for i := range entries {
+		assert.NoError(t, w.Write(&entries[i]))
+	}
+	assert.NoError(t, w.Close())
+	// check the on-disk format
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t,
+		`{"time":"2023-11-26T22:04:33Z","connID":"conn0","direction":"outbound","raw":"504f53544757","cleartext":"00ff"}`+"\n"+
+			`{"time":"2023-11-26T22:04:34Z","connID":"conn0","direction":"inbound","raw":"0102"}`+"\n",
+		string(data))
+	// read back
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	r := NewReader(f)
+	for i := range entries {
+		e, err := r.Next()
+		assert.NoError(t, err)
+		assert.True(t, entries[i].Time.Equal(e.Time))
+		assert.Equal(t, entries[i].ConnID, e.ConnID)
+		assert.Equal(t, entries[i].Direction, e.Direction)
+		assert.Equal(t, entries[i].Raw, e.Raw)
+		assert.Equal(t, entries[i].Cleartext, e.Cleartext)
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestRotate(t *testing.T) {
+	var testCases = map[string]struct {
+		maxSize     int64
+		maxAge      time.Duration
+		step        time.Duration
+		expectFiles int
+	}{
+		"no rotation":  {expectFiles: 1},
+		"rotate size":  {maxSize: 250, expectFiles: 2},
+		"rotate age":   {maxAge: time.Hour, step: 40 * time.Minute, expectFiles: 3},
+		"no age limit": {step: 40 * time.Minute, expectFiles: 1},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			dir := tt.TempDir()
+			path := filepath.Join(dir, "capture.ndjson")
+			w, err := NewWriter(path, tc.maxSize, tc.maxAge)
+			assert.NoError(tt, err, name)
+			now := time.Date(2023, time.November, 26, 22, 4, 33, 0, time.UTC)
+			w.now = func() time.Time { return now }
+			w.opened = now
+			for range 4 {
+				now = now.Add(tc.step + time.Second)
+				assert.NoError(tt, w.Write(&Entry{
+					Time:      now,
+					ConnID:    "conn0",
+					Direction: DirectionOutbound,
+					Raw:       make(HexBytes, 16),
+				}), name)
+			}
+			assert.NoError(tt, w.Close(), name)
+			files, err := os.ReadDir(dir)
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expectFiles, len(files), name)
+		})
+	}
+}
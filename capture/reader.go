@@ -0,0 +1,30 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Reader reads entries from a capture file.
+type Reader struct {
+	dec *json.Decoder
+}
+
+// NewReader constructs a Reader which reads entries from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{dec: json.NewDecoder(r)}
+}
+
+// Next returns the next entry in the capture file. It returns io.EOF when
+// there are no more entries.
+func (r *Reader) Next() (*Entry, error) {
+	var e Entry
+	if err := r.dec.Decode(&e); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("couldn't decode entry: %v", err)
+	}
+	return &e, nil
+}
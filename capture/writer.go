@@ -0,0 +1,114 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// suffix format of rotated capture files
+	rotateTimeFormat = "20060102T150405.000000000Z"
+)
+
+// Writer appends entries to a capture file, rotating the file by size or
+// age. It is safe for concurrent use.
+type Writer struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	now     func() time.Time
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// NewWriter opens the capture file at path for appending, creating it if it
+// doesn't exist. The file is rotated before a write which would make it
+// larger than maxSize bytes, or once it has been open for longer than
+// maxAge. A zero maxSize or maxAge disables the respective rotation.
+func NewWriter(path string, maxSize int64, maxAge time.Duration) (*Writer, error) {
+	w := Writer{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		now:     time.Now,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// open the capture file for appending.
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't open capture file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("couldn't stat capture file: %v", err)
+	}
+	w.file = f
+	w.size = info.Size()
+	w.opened = w.now()
+	return nil
+}
+
+// rotate the capture file by renaming it with a timestamp suffix, and opening
+// a new file at the original path.
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("couldn't close capture file: %v", err)
+	}
+	rotated := w.path + "." + w.now().UTC().Format(rotateTimeFormat)
+	if err := os.Rename(w.path, rotated); err != nil {
+		return fmt.Errorf("couldn't rename capture file: %v", err)
+	}
+	return w.open()
+}
+
+// Write appends the given entry to the capture file.
+func (w *Writer) Write(e *Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal entry: %v", err)
+	}
+	line = append(line, '\n')
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return fmt.Errorf("capture file closed")
+	}
+	if w.size > 0 &&
+		((w.maxSize > 0 && w.size+int64(len(line)) > w.maxSize) ||
+			(w.maxAge > 0 && w.now().Sub(w.opened) >= w.maxAge)) {
+		if err = w.rotate(); err != nil {
+			return fmt.Errorf("couldn't rotate capture file: %v", err)
+		}
+	}
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("couldn't write entry: %v", err)
+	}
+	return nil
+}
+
+// Close the capture file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// DecodeCmd represents the `decode` command.
+type DecodeCmd struct {
+	Frame          []string `kong:"arg,help='Hex encoded frame, as logged in the frame field of unknown packets. Whitespace is ignored'"`
+	DeviceRegistry string   `kong:"env='DEVICE_REGISTRY',type='path',help='YAML or JSON file of additional device IDs, merged with the built-in devices'"`
+	PacketLayouts  string   `kong:"env='PACKET_LAYOUTS',type='path',help='YAML file of additional packet layouts, merged with the built-in layouts'"`
+}
+
+// Run the decode command.
+func (cmd *DecodeCmd) Run(log *slog.Logger) error {
+	input := strings.Join(strings.Fields(strings.Join(cmd.Frame, "")), "")
+	frame, err := hex.DecodeString(strings.TrimPrefix(input, "0x"))
+	if err != nil {
+		return fmt.Errorf("couldn't decode hex: %v", err)
+	}
+	registry, err := loadRegistry(cmd.PacketLayouts, cmd.DeviceRegistry)
+	if err != nil {
+		return err
+	}
+	annotated, err := registry.Annotate(frame)
+	if err != nil {
+		return fmt.Errorf("couldn't decode frame: %v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(annotated)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/smlx/goodwe/influx"
+)
+
+// InfluxDBFlags are the flags configuring the optional InfluxDB writer.
+type InfluxDBFlags struct {
+	URL                string        `kong:"name='url',env='URL',help='InfluxDB base URL (e.g. http://localhost:8086). If set, readings are written to InfluxDB'"`
+	Database           string        `kong:"env='DATABASE',help='InfluxDB database (v1 API)'"`
+	RetentionPolicy    string        `kong:"env='RETENTION_POLICY',help='InfluxDB retention policy (v1 API)'"`
+	Username           string        `kong:"env='USERNAME',help='InfluxDB username (v1 API)'"`
+	Password           string        `kong:"env='PASSWORD',help='InfluxDB password (v1 API)'"`
+	Org                string        `kong:"env='ORG',help='InfluxDB organization (v2 API)'"`
+	Bucket             string        `kong:"env='BUCKET',help='InfluxDB bucket (v2 API)'"`
+	Token              string        `kong:"env='TOKEN',help='InfluxDB API token (v2 API)'"`
+	BatchSize          int           `kong:"env='BATCH_SIZE',default='500',help='Maximum number of points per InfluxDB write'"`
+	FlushInterval      time.Duration `kong:"env='FLUSH_INTERVAL',default='10s',help='Interval between InfluxDB writes'"`
+	MaxBuffer          int           `kong:"env='MAX_BUFFER',default='100000',help='Maximum number of points buffered while InfluxDB is unavailable'"`
+	CAFile             string        `kong:"name='ca-file',env='CA_FILE',type='existingfile',help='PEM CA certificates used to verify InfluxDB, instead of the system roots'"`
+	InsecureSkipVerify bool          `kong:"env='INSECURE_SKIP_VERIFY',help='Skip verification of the InfluxDB certificate'"`
+}
+
+// Validate the InfluxDB flags.
+func (f *InfluxDBFlags) Validate() error {
+	if f.URL == "" {
+		return nil
+	}
+	if (f.Database == "") == (f.Bucket == "") {
+		return fmt.Errorf(
+			"exactly one of --influxdb-database or --influxdb-bucket must be set")
+	}
+	if f.Bucket != "" && f.Org == "" {
+		return fmt.Errorf("--influxdb-org must be set with --influxdb-bucket")
+	}
+	return nil
+}
+
+// newWriter returns an InfluxDB writer, or nil if no URL is configured.
+func (f *InfluxDBFlags) newWriter(log *slog.Logger) (*influx.Writer, error) {
+	if f.URL == "" {
+		return nil, nil
+	}
+	tlsConfig, err := loadTLSConfig(f.CAFile, "", "", f.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	opts := []influx.Option{
+		influx.WithBatchSize(f.BatchSize),
+		influx.WithFlushInterval(f.FlushInterval),
+		influx.WithMaxBuffer(f.MaxBuffer),
+		influx.WithTLS(tlsConfig),
+	}
+	if f.Bucket != "" {
+		opts = append(opts, influx.WithBucket(f.Org, f.Bucket, f.Token))
+	} else {
+		opts = append(opts, influx.WithDatabase(f.Database, f.RetentionPolicy))
+		if f.Username != "" {
+			opts = append(opts, influx.WithBasicAuth(f.Username, f.Password))
+		}
+	}
+	writer, err := influx.NewWriter(log, f.URL, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't configure InfluxDB writer: %v", err)
+	}
+	return writer, nil
+}
@@ -12,6 +12,8 @@ import (
 type CLI struct {
 	Debug   bool       `kong:"env='DEBUG',help='Enable debug logging'"`
 	Serve   ServeCmd   `kong:"cmd,default,help='Start the MITM server'"`
+	Replay  ReplayCmd  `kong:"cmd,help='Replay captured traffic through the packet handlers'"`
+	Decode  DecodeCmd  `kong:"cmd,help='Decode a single hex encoded frame and print it as JSON'"`
 	Version VersionCmd `kong:"cmd,help='Print version information'"`
 }
 
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/smlx/goodwe/mqtt"
+)
+
+// MQTTFlags are the flags configuring the optional MQTT publisher.
+type MQTTFlags struct {
+	Broker             string `kong:"env='BROKER',help='MQTT broker URL (e.g. tcp://localhost:1883 or ssl://localhost:8883). If set, readings are published to MQTT'"`
+	Username           string `kong:"env='USERNAME',help='MQTT username'"`
+	Password           string `kong:"env='PASSWORD',help='MQTT password'"`
+	ClientID           string `kong:"env='CLIENT_ID',default='sems_mitm_exporter',help='MQTT client ID'"`
+	TopicPrefix        string `kong:"env='TOPIC_PREFIX',default='goodwe',help='Prefix of MQTT state topics'"`
+	DiscoveryPrefix    string `kong:"env='DISCOVERY_PREFIX',default='homeassistant',help='Home Assistant MQTT discovery prefix. Empty disables discovery'"`
+	QoS                byte   `kong:"name='qos',env='QOS',default='0',help='QoS of MQTT state messages'"`
+	Retain             bool   `kong:"env='RETAIN',help='Set the retain flag on MQTT state messages'"`
+	CAFile             string `kong:"name='ca-file',env='CA_FILE',type='existingfile',help='PEM CA certificates used to verify the MQTT broker, instead of the system roots'"`
+	CertFile           string `kong:"env='CERT_FILE',type='existingfile',help='PEM client certificate for MQTT TLS client authentication'"`
+	KeyFile            string `kong:"env='KEY_FILE',type='existingfile',help='PEM client key for MQTT TLS client authentication'"`
+	InsecureSkipVerify bool   `kong:"env='INSECURE_SKIP_VERIFY',help='Skip verification of the MQTT broker certificate'"`
+}
+
+// Validate the MQTT flags.
+func (f *MQTTFlags) Validate() error {
+	if f.QoS > 2 {
+		return fmt.Errorf("--mqtt-qos: must be 0, 1 or 2")
+	}
+	if (f.CertFile == "") != (f.KeyFile == "") {
+		return fmt.Errorf("--mqtt-cert-file and --mqtt-key-file must be set together")
+	}
+	return nil
+}
+
+// newPublisher returns an MQTT publisher, or nil if no broker is configured.
+func (f *MQTTFlags) newPublisher(log *slog.Logger) (*mqtt.Publisher, error) {
+	if f.Broker == "" {
+		return nil, nil
+	}
+	tlsConfig, err := loadTLSConfig(f.CAFile, f.CertFile, f.KeyFile,
+		f.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	opts := []mqtt.Option{
+		mqtt.WithClientID(f.ClientID),
+		mqtt.WithTopicPrefix(f.TopicPrefix),
+		mqtt.WithDiscoveryPrefix(f.DiscoveryPrefix),
+		mqtt.WithQoS(f.QoS),
+		mqtt.WithRetain(f.Retain),
+		mqtt.WithTLS(tlsConfig),
+	}
+	if f.Username != "" {
+		opts = append(opts, mqtt.WithAuth(f.Username, f.Password))
+	}
+	publisher, err := mqtt.NewPublisher(log, f.Broker, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't configure MQTT publisher: %v", err)
+	}
+	return publisher, nil
+}
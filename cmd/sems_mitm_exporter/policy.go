@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/smlx/goodwe/mitm"
+)
+
+// PolicyFlags are the flags configuring which packets are forwarded.
+type PolicyFlags struct {
+	InboundAllow    []mitm.PacketType `kong:"env='INBOUND_ALLOW',help='Inbound packet types to forward even if not understood (e.g. 0x0304)'"`
+	InboundDeny     []mitm.PacketType `kong:"env='INBOUND_DENY',help='Inbound packet types to block'"`
+	InboundDefault  string            `kong:"env='INBOUND_DEFAULT',enum='allow,deny',default='deny',help='Action on inbound packets which are not understood or listed'"`
+	OutboundAllow   []mitm.PacketType `kong:"env='OUTBOUND_ALLOW',help='Outbound packet types to forward even if not understood'"`
+	OutboundDeny    []mitm.PacketType `kong:"env='OUTBOUND_DENY',help='Outbound packet types to block'"`
+	OutboundDefault string            `kong:"env='OUTBOUND_DEFAULT',enum='allow,deny',default='allow',help='Action on outbound packets which are not understood or listed'"`
+	Learn           bool              `kong:"env='LEARN',help='Log packets which would be blocked, but forward them anyway'"`
+}
+
+// policies returns the inbound and outbound policies.
+func (f *PolicyFlags) policies() (mitm.Policy, mitm.Policy) {
+	return mitm.Policy{
+		Allow:   f.InboundAllow,
+		Deny:    f.InboundDeny,
+		Default: mitm.PolicyAction(f.InboundDefault),
+		Learn:   f.Learn,
+	}, mitm.Policy{
+		Allow:   f.OutboundAllow,
+		Deny:    f.OutboundDeny,
+		Default: mitm.PolicyAction(f.OutboundDefault),
+		Learn:   f.Learn,
+	}
+}
+
+// Validate the policy flags.
+func (f *PolicyFlags) Validate() error {
+	inbound, outbound := f.policies()
+	if err := inbound.Validate(); err != nil {
+		return fmt.Errorf("inbound policy: %v", err)
+	}
+	if err := outbound.Validate(); err != nil {
+		return fmt.Errorf("outbound policy: %v", err)
+	}
+	return nil
+}
+
+// options returns the mitm.Server options applying the policies.
+func (f *PolicyFlags) options() []mitm.Option {
+	inbound, outbound := f.policies()
+	return []mitm.Option{
+		mitm.WithInboundPolicy(inbound),
+		mitm.WithOutboundPolicy(outbound),
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/smlx/goodwe/remotewrite"
+)
+
+// RemoteWriteFlags are the flags configuring the optional Prometheus remote
+// write client.
+type RemoteWriteFlags struct {
+	URL                string            `kong:"name='url',env='URL',help='Prometheus remote write URL (e.g. http://localhost:9090/api/v1/write). If set, readings are pushed with their device timestamps'"`
+	Username           string            `kong:"env='USERNAME',help='Remote write basic auth username'"`
+	Password           string            `kong:"env='PASSWORD',help='Remote write basic auth password'"`
+	BearerToken        string            `kong:"env='BEARER_TOKEN',help='Remote write bearer token'"`
+	Labels             map[string]string `kong:"name='label',env='LABELS',help='Labels added to every remote write sample (e.g. job=goodwe;instance=home)'"`
+	BatchSize          int               `kong:"env='BATCH_SIZE',default='500',help='Maximum number of samples per remote write'"`
+	FlushInterval      time.Duration     `kong:"env='FLUSH_INTERVAL',default='10s',help='Interval between remote writes'"`
+	MaxBuffer          int               `kong:"env='MAX_BUFFER',default='100000',help='Maximum number of samples buffered while the remote write endpoint is unavailable'"`
+	CAFile             string            `kong:"name='ca-file',env='CA_FILE',type='existingfile',help='PEM CA certificates used to verify the remote write endpoint, instead of the system roots'"`
+	CertFile           string            `kong:"env='CERT_FILE',type='existingfile',help='PEM client certificate for remote write TLS client authentication'"`
+	KeyFile            string            `kong:"env='KEY_FILE',type='existingfile',help='PEM client key for remote write TLS client authentication'"`
+	InsecureSkipVerify bool              `kong:"env='INSECURE_SKIP_VERIFY',help='Skip verification of the remote write endpoint certificate'"`
+}
+
+// Validate the remote write flags.
+func (f *RemoteWriteFlags) Validate() error {
+	if f.Username != "" && f.BearerToken != "" {
+		return fmt.Errorf(
+			"--remote-write-username and --remote-write-bearer-token are exclusive")
+	}
+	if (f.CertFile == "") != (f.KeyFile == "") {
+		return fmt.Errorf(
+			"--remote-write-cert-file and --remote-write-key-file must be set together")
+	}
+	return nil
+}
+
+// newWriter returns a remote write client, or nil if no URL is configured.
+func (f *RemoteWriteFlags) newWriter(
+	log *slog.Logger,
+) (*remotewrite.Writer, error) {
+	if f.URL == "" {
+		return nil, nil
+	}
+	tlsConfig, err := loadTLSConfig(f.CAFile, f.CertFile, f.KeyFile,
+		f.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	opts := []remotewrite.Option{
+		remotewrite.WithLabels(f.Labels),
+		remotewrite.WithBatchSize(f.BatchSize),
+		remotewrite.WithFlushInterval(f.FlushInterval),
+		remotewrite.WithMaxBuffer(f.MaxBuffer),
+		remotewrite.WithTLS(tlsConfig),
+	}
+	switch {
+	case f.BearerToken != "":
+		opts = append(opts, remotewrite.WithBearerToken(f.BearerToken))
+	case f.Username != "":
+		opts = append(opts, remotewrite.WithBasicAuth(f.Username, f.Password))
+	}
+	writer, err := remotewrite.NewWriter(log, f.URL, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't configure remote write client: %v", err)
+	}
+	return writer, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/smlx/goodwe/capture"
+	"github.com/smlx/goodwe/mitm"
+	"github.com/smlx/goodwe/web"
+	"golang.org/x/sync/errgroup"
+)
+
+// ReplayCmd represents the `replay` command.
+type ReplayCmd struct {
+	File           string        `kong:"arg,type='existingfile',help='Capture file (NDJSON) or hex dump with one frame per line'"`
+	Print          bool          `kong:"help='Print decoded packets as JSON and exit instead of serving metrics'"`
+	Speed          float64       `kong:"default='0',help='Replay pacing: 0 replays as fast as possible, 1 in real time, N at N times real time. Only applies to capture files'"`
+	MetricsAddr    string        `kong:"env='METRICS_ADDR',default=':14028',help='Address to serve Prometheus metrics on'"`
+	WebConfigFile  string        `kong:"env='WEB_CONFIG_FILE',type='existingfile',help='Prometheus exporter-toolkit web configuration file, enabling TLS and basic authentication for the metrics server'"`
+	MetricStyle    string        `kong:"env='METRIC_STYLE',enum='legacy,si,both',default='legacy',help='Device metric names and units: legacy (scaled integers), si (base units, with counters for totals) or both'"`
+	StaleTimeout   time.Duration `kong:"env='STALE_TIMEOUT',default='0',help='Expire the metrics of devices which are silent for this long (0 disables)'"`
+	StaleAction    string        `kong:"env='STALE_ACTION',enum='delete,zero',default='delete',help='Action on the metrics of silent devices: delete (remove all gauges except totals) or zero (zero power and current gauges)'"`
+	DeviceRegistry string        `kong:"env='DEVICE_REGISTRY',type='path',help='YAML or JSON file of additional device IDs, merged with the built-in devices'"`
+	PacketLayouts  string        `kong:"env='PACKET_LAYOUTS',type='path',help='YAML file of additional packet layouts, merged with the built-in layouts'"`
+}
+
+// Validate the replay command flags.
+func (cmd *ReplayCmd) Validate() error {
+	if cmd.Speed < 0 {
+		return fmt.Errorf("--speed: must not be negative")
+	}
+	if err := mitm.ValidateAddr(cmd.MetricsAddr, true); err != nil {
+		return fmt.Errorf("--metrics-addr: %v", err)
+	}
+	if cmd.WebConfigFile != "" {
+		if _, err := web.LoadConfig(cmd.WebConfigFile); err != nil {
+			return fmt.Errorf("--web-config-file: %v", err)
+		}
+	}
+	return nil
+}
+
+// frameReader is implemented by sources of frames to replay.
+type frameReader interface {
+	// Next returns the next frame, or io.EOF if there are no more frames.
+	Next() (*capture.Entry, error)
+}
+
+// hexReader reads frames from a hex dump with one frame per line. Blank
+// lines and lines starting with # are ignored.
+type hexReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// Next implements the frameReader interface.
+func (r *hexReader) Next() (*capture.Entry, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := strings.TrimSpace(r.scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := hex.DecodeString(strings.Join(strings.Fields(line), ""))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode line %d: %v", r.line, err)
+		}
+		return &capture.Entry{
+			Direction: mitm.FrameDirection(raw),
+			Raw:       raw,
+		}, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// newFrameReader returns a frameReader for the given input, detecting whether
+// it is a capture file or a hex dump from the first non-space character.
+func newFrameReader(r io.Reader) (frameReader, error) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.ContainsRune(" \t\r\n", rune(b)) {
+			continue
+		}
+		if err = br.UnreadByte(); err != nil {
+			return nil, err
+		}
+		if b == '{' {
+			return capture.NewReader(br), nil
+		}
+		break
+	}
+	scanner := bufio.NewScanner(br)
+	// frames may be longer than the default token size when hex encoded
+	scanner.Buffer(nil, 1024*1024)
+	return &hexReader{scanner: scanner}, nil
+}
+
+// replayResult is the output of the replay command in print mode.
+type replayResult struct {
+	Time   *time.Time `json:"time,omitempty"`
+	ConnID string     `json:"connID,omitempty"`
+	*mitm.Decoded
+	Raw   capture.HexBytes `json:"raw,omitempty"`
+	Error string           `json:"error,omitempty"`
+}
+
+// printFrames decodes all frames using the given registry and prints them to
+// w.
+func printFrames(
+	frames frameReader,
+	registry *mitm.Registry,
+	w io.Writer,
+) error {
+	enc := json.NewEncoder(w)
+	for {
+		entry, err := frames.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't read frame: %v", err)
+		}
+		if mitm.FrameDirection(entry.Raw) == "" {
+			continue // keepalive or garbage
+		}
+		result := replayResult{ConnID: entry.ConnID}
+		if !entry.Time.IsZero() {
+			result.Time = &entry.Time
+		}
+		result.Decoded, err = registry.Decode(entry.Raw)
+		if err != nil {
+			result.Raw = entry.Raw
+			result.Error = err.Error()
+		}
+		if err = enc.Encode(&result); err != nil {
+			return fmt.Errorf("couldn't encode result: %v", err)
+		}
+	}
+}
+
+// replayFrames pushes all frames through packet handlers which publish to the
+// given observer, pacing them according to their timestamps and the given
+// speed.
+func replayFrames(
+	ctx context.Context,
+	log *slog.Logger,
+	frames frameReader,
+	speed float64,
+	registry *mitm.Registry,
+	observer mitm.Observer,
+) error {
+	handlers := map[string]mitm.PacketHandler{
+		capture.DirectionOutbound: mitm.NewOutboundPacketHandler(false, registry,
+			observer),
+		capture.DirectionInbound: mitm.NewInboundPacketHandler(registry, observer),
+	}
+	var last time.Time
+	var count int
+	for {
+		entry, err := frames.Next()
+		if err == io.EOF {
+			log.Info("replay complete", slog.Int("frames", count))
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't read frame: %v", err)
+		}
+		ph, ok := handlers[mitm.FrameDirection(entry.Raw)]
+		if !ok {
+			continue // keepalive or garbage
+		}
+		// pace the replay
+		if speed > 0 && !last.IsZero() && entry.Time.After(last) {
+			delay := time.Duration(float64(entry.Time.Sub(last)) / speed)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
+			}
+		}
+		if !entry.Time.IsZero() {
+			last = entry.Time
+		}
+		frameLog := log.With(slog.String("connID", entry.ConnID))
+		if _, err = ph.HandlePacket(ctx, frameLog, entry.Raw); err != nil {
+			frameLog.Warn("couldn't handle packet",
+				slog.Any("packet", entry.Raw),
+				slog.Any("error", err))
+		}
+		count++
+	}
+}
+
+// Run the replay command.
+func (cmd *ReplayCmd) Run(log *slog.Logger) error {
+	f, err := os.Open(cmd.File)
+	if err != nil {
+		return fmt.Errorf("couldn't open input file: %v", err)
+	}
+	defer f.Close()
+	frames, err := newFrameReader(f)
+	if err != nil {
+		return fmt.Errorf("couldn't read input file: %v", err)
+	}
+	registry, err := loadRegistry(cmd.PacketLayouts, cmd.DeviceRegistry)
+	if err != nil {
+		return err
+	}
+	if cmd.Print {
+		return printFrames(frames, registry, os.Stdout)
+	}
+	observer, err := mitm.NewPrometheusObserver(mitm.MetricStyle(cmd.MetricStyle),
+		cmd.StaleTimeout, mitm.StaleAction(cmd.StaleAction))
+	if err != nil {
+		return err
+	}
+	inventory := mitm.NewInventory()
+	// handle signals
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		syscall.SIGTERM,
+		syscall.SIGINT)
+	defer stop()
+	// set up multithreading
+	eg, ctx := errgroup.WithContext(ctx)
+	// start metrics server
+	if err = serveMetrics(ctx, log, eg, cmd.MetricsAddr, cmd.WebConfigFile,
+		inventory); err != nil {
+		return err
+	}
+	// start stale metrics expiry
+	eg.Go(func() error {
+		return observer.Run(ctx)
+	})
+	// replay frames, then keep serving metrics until interrupted
+	eg.Go(func() error {
+		return replayFrames(ctx, log, frames, cmd.Speed, registry,
+			mitm.Observers{observer, inventory})
+	})
+	return eg.Wait()
+}
@@ -4,41 +4,117 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"os/signal"
 	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/smlx/goodwe/capture"
 	"github.com/smlx/goodwe/mitm"
+	"github.com/smlx/goodwe/queue"
+	"github.com/smlx/goodwe/web"
 	"golang.org/x/sync/errgroup"
 )
 
 const (
-	metricsPort            = ":14028"
 	metricsReadTimeout     = 2 * time.Second
 	metricsShutdownTimeout = 2 * time.Second
 )
 
 // ServeCmd represents the `serve` command.
 type ServeCmd struct {
-	Batsignal       bool `kong:"env='BATSIGNAL',help='Enable Batsignal mode (draws the bat-insignia on the SEMS portal graph)'"`
-	SEMSPassthrough bool `kong:"env='SEMS_PASSTHROUGH',default='true',help='Enable passthrough to SEMS Portal'"`
+	Batsignal       bool             `kong:"env='BATSIGNAL',help='Enable Batsignal mode (draws the bat-insignia on the SEMS portal graph)'"`
+	SEMSPassthrough bool             `kong:"env='SEMS_PASSTHROUGH',default='true',help='Enable passthrough to SEMS Portal. If disabled, the SEMS Portal is emulated'"`
+	ListenAddr      string           `kong:"env='LISTEN_ADDR',default=':20001',help='Address to listen on for device connections'"`
+	UpstreamHost    string           `kong:"env='UPSTREAM_HOST',default='tcp.goodwe-power.com:20001',help='Address of the SEMS Portal to forward traffic to'"`
+	UpstreamTTL     time.Duration    `kong:"name='upstream-resolve-ttl',env='UPSTREAM_RESOLVE_TTL',default='1m',help='Cache the resolved addresses of the SEMS Portal for this long (0 resolves for every connection)'"`
+	UpstreamDNS     string           `kong:"name='upstream-dns-server',env='UPSTREAM_DNS_SERVER',help='DNS server used to resolve the SEMS Portal instead of the system resolver (e.g. 1.1.1.1:53)'"`
+	UpstreamIPs     []netip.Addr     `kong:"name='upstream-ips',env='UPSTREAM_IPS',help='Static IP addresses of the SEMS Portal, which is then not resolved'"`
+	Mirrors         []string         `kong:"name='mirror',env='MIRROR_ADDRS',help='Additional addresses which receive a copy of the traffic sent by devices. Their replies are discarded'"`
+	MetricsAddr     string           `kong:"env='METRICS_ADDR',default=':14028',help='Address to serve Prometheus metrics on'"`
+	WebConfigFile   string           `kong:"env='WEB_CONFIG_FILE',type='existingfile',help='Prometheus exporter-toolkit web configuration file, enabling TLS and basic authentication for the metrics server'"`
+	MetricStyle     string           `kong:"env='METRIC_STYLE',enum='legacy,si,both',default='legacy',help='Device metric names and units: legacy (scaled integers), si (base units, with counters for totals) or both'"`
+	StaleTimeout    time.Duration    `kong:"env='STALE_TIMEOUT',default='0',help='Expire the metrics of devices which are silent for this long (0 disables)'"`
+	StaleAction     string           `kong:"env='STALE_ACTION',enum='delete,zero',default='delete',help='Action on the metrics of silent devices: delete (remove all gauges except totals) or zero (zero power and current gauges)'"`
+	CaptureFile     string           `kong:"env='CAPTURE_FILE',type='path',help='Record all intercepted traffic to this file (NDJSON)'"`
+	CaptureMaxSize  int64            `kong:"env='CAPTURE_MAX_SIZE',default='104857600',help='Rotate the capture file before it exceeds this size in bytes (0 disables)'"`
+	CaptureMaxAge   time.Duration    `kong:"env='CAPTURE_MAX_AGE',default='24h',help='Rotate the capture file after this duration (0 disables)'"`
+	QueueDir        string           `kong:"env='QUEUE_DIR',type='path',help='Directory of a disk-backed queue. If set, devices are answered locally while the SEMS Portal is unreachable, and their packets are forwarded once it is reachable again'"`
+	QueueMaxSize    int64            `kong:"env='QUEUE_MAX_SIZE',default='104857600',help='Drop packets instead of queueing them once the queue reaches this size in bytes (0 disables)'"`
+	DeviceRegistry  string           `kong:"env='DEVICE_REGISTRY',type='path',help='YAML or JSON file of additional device IDs, merged with the built-in devices'"`
+	PacketLayouts   string           `kong:"env='PACKET_LAYOUTS',type='path',help='YAML file of additional packet layouts, merged with the built-in layouts'"`
+	Policy          PolicyFlags      `kong:"embed,prefix='policy-',envprefix='POLICY_',group='Packet policy'"`
+	MQTT            MQTTFlags        `kong:"embed,prefix='mqtt-',envprefix='MQTT_',group='MQTT'"`
+	InfluxDB        InfluxDBFlags    `kong:"embed,prefix='influxdb-',envprefix='INFLUXDB_',group='InfluxDB'"`
+	RemoteWrite     RemoteWriteFlags `kong:"embed,prefix='remote-write-',envprefix='REMOTE_WRITE_',group='Prometheus remote write'"`
 }
 
-func serveMetrics(ctx context.Context, eg *errgroup.Group) {
+// Validate the serve command flags.
+func (cmd *ServeCmd) Validate() error {
+	if err := mitm.ValidateAddr(cmd.ListenAddr, true); err != nil {
+		return fmt.Errorf("--listen-addr: %v", err)
+	}
+	if err := mitm.ValidateAddr(cmd.UpstreamHost, false); err != nil {
+		return fmt.Errorf("--upstream-host: %v", err)
+	}
+	if cmd.UpstreamDNS != "" && len(cmd.UpstreamIPs) > 0 {
+		return fmt.Errorf("--upstream-dns-server and --upstream-ips are mutually exclusive")
+	}
+	for _, addr := range cmd.Mirrors {
+		if err := mitm.ValidateAddr(addr, false); err != nil {
+			return fmt.Errorf("--mirror: %v", err)
+		}
+	}
+	if err := mitm.ValidateAddr(cmd.MetricsAddr, true); err != nil {
+		return fmt.Errorf("--metrics-addr: %v", err)
+	}
+	if cmd.WebConfigFile != "" {
+		if _, err := web.LoadConfig(cmd.WebConfigFile); err != nil {
+			return fmt.Errorf("--web-config-file: %v", err)
+		}
+	}
+	if err := cmd.Policy.Validate(); err != nil {
+		return err
+	}
+	if err := cmd.MQTT.Validate(); err != nil {
+		return err
+	}
+	if err := cmd.InfluxDB.Validate(); err != nil {
+		return err
+	}
+	return cmd.RemoteWrite.Validate()
+}
+
+func serveMetrics(
+	ctx context.Context,
+	log *slog.Logger,
+	eg *errgroup.Group,
+	metricsAddr,
+	webConfigFile string,
+	inventory *mitm.Inventory,
+) error {
 	// configure metrics server
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/api/devices", inventory)
 	metricsSrv := http.Server{
-		Addr:         metricsPort,
 		ReadTimeout:  metricsReadTimeout,
 		WriteTimeout: metricsReadTimeout,
 		Handler:      mux,
 	}
+	// bind before returning so that errors are reported immediately
+	listener, err := net.Listen("tcp", metricsAddr)
+	if err != nil {
+		return fmt.Errorf(`couldn't listen for metrics on "%s": %v`,
+			metricsAddr, err)
+	}
 	// start metrics server
 	eg.Go(func() error {
-		if err := metricsSrv.ListenAndServe(); err != http.ErrServerClosed {
+		err := web.Serve(listener, &metricsSrv, webConfigFile, log)
+		if err != http.ErrServerClosed {
 			return err
 		}
 		return nil
@@ -51,6 +127,22 @@ func serveMetrics(ctx context.Context, eg *errgroup.Group) {
 		defer cancel()
 		return metricsSrv.Shutdown(timeoutCtx)
 	})
+	return nil
+}
+
+// loadRegistry loads the packet layouts in the given file, if any, and
+// returns the device registry in the given file, or the built-in devices if
+// registryPath is empty.
+func loadRegistry(layoutsPath, registryPath string) (*mitm.Registry, error) {
+	if layoutsPath != "" {
+		if err := mitm.LoadPacketLayouts(layoutsPath); err != nil {
+			return nil, err
+		}
+	}
+	if registryPath == "" {
+		return mitm.NewRegistry()
+	}
+	return mitm.LoadRegistry(registryPath)
 }
 
 // Run the serve command.
@@ -63,16 +155,96 @@ func (cmd *ServeCmd) Run(log *slog.Logger) error {
 	defer stop()
 	// set up multithreading
 	eg, ctx := errgroup.WithContext(ctx)
-	// start metrics server
-	serveMetrics(ctx, eg)
-	// start mitm server
-	if cmd.SEMSPassthrough {
+	// configure mitm server
+	registry, err := loadRegistry(cmd.PacketLayouts, cmd.DeviceRegistry)
+	if err != nil {
+		return err
+	}
+	observer, err := mitm.NewPrometheusObserver(mitm.MetricStyle(cmd.MetricStyle),
+		cmd.StaleTimeout, mitm.StaleAction(cmd.StaleAction))
+	if err != nil {
+		return err
+	}
+	inventory := mitm.NewInventory()
+	opts := []mitm.Option{
+		mitm.WithListenAddr(cmd.ListenAddr),
+		mitm.WithUpstreamHost(cmd.UpstreamHost),
+		mitm.WithResolveTTL(cmd.UpstreamTTL),
+		mitm.WithRegistry(registry),
+		mitm.WithObserver(observer),
+		mitm.WithObserver(inventory),
+	}
+	if cmd.UpstreamDNS != "" {
+		opts = append(opts, mitm.WithUpstreamDNSServer(cmd.UpstreamDNS))
+	}
+	if len(cmd.UpstreamIPs) > 0 {
+		opts = append(opts, mitm.WithUpstreamIPs(cmd.UpstreamIPs))
+	}
+	for _, addr := range cmd.Mirrors {
+		opts = append(opts, mitm.WithMirror(addr))
+	}
+	opts = append(opts, cmd.Policy.options()...)
+	if cmd.CaptureFile != "" {
+		captureWriter, err := capture.NewWriter(cmd.CaptureFile,
+			cmd.CaptureMaxSize, cmd.CaptureMaxAge)
+		if err != nil {
+			return fmt.Errorf("couldn't open capture file: %v", err)
+		}
+		defer captureWriter.Close()
+		opts = append(opts, mitm.WithCapture(captureWriter))
+	}
+	if cmd.QueueDir != "" {
+		q, err := queue.Open(cmd.QueueDir, cmd.QueueMaxSize)
+		if err != nil {
+			return fmt.Errorf("couldn't open queue: %v", err)
+		}
+		defer q.Close()
+		opts = append(opts, mitm.WithQueue(q))
+	}
+	publisher, err := cmd.MQTT.newPublisher(log)
+	if err != nil {
+		return err
+	}
+	if publisher != nil {
+		defer publisher.Close()
+		opts = append(opts, mitm.WithObserver(publisher))
+	}
+	writer, err := cmd.InfluxDB.newWriter(log)
+	if err != nil {
+		return err
+	}
+	if writer != nil {
+		opts = append(opts, mitm.WithObserver(writer))
 		eg.Go(func() error {
-			return mitm.NewServer(cmd.Batsignal).Serve(ctx, log)
+			return writer.Run(ctx)
 		})
-	} else {
-		// TODO SEMS Emulator: semsem.NewServer().Serve(ctx,log)
-		return fmt.Errorf("SEMS Emulator not yet implemented")
 	}
+	remoteWriter, err := cmd.RemoteWrite.newWriter(log)
+	if err != nil {
+		return err
+	}
+	if remoteWriter != nil {
+		opts = append(opts, mitm.WithObserver(remoteWriter))
+		eg.Go(func() error {
+			return remoteWriter.Run(ctx)
+		})
+	}
+	mitmSrv, err := mitm.NewServer(cmd.Batsignal, cmd.SEMSPassthrough, opts...)
+	if err != nil {
+		return fmt.Errorf("couldn't configure MITM server: %v", err)
+	}
+	// start metrics server
+	if err = serveMetrics(ctx, log, eg, cmd.MetricsAddr, cmd.WebConfigFile,
+		inventory); err != nil {
+		return err
+	}
+	// start stale metrics expiry
+	eg.Go(func() error {
+		return observer.Run(ctx)
+	})
+	// start mitm server
+	eg.Go(func() error {
+		return mitmSrv.Serve(ctx, log)
+	})
 	return eg.Wait()
 }
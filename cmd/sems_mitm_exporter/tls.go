@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// loadTLSConfig returns a client TLS configuration. If caFile is set, it
+// replaces the system roots. If certFile and keyFile are set, they are used
+// for client certificate authentication.
+func loadTLSConfig(
+	caFile,
+	certFile,
+	keyFile string,
+	insecureSkipVerify bool,
+) (*tls.Config, error) {
+	c := tls.Config{
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read CA file: %v", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("couldn't parse CA file %s", caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load client certificate: %v", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return &c, nil
+}
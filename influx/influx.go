@@ -0,0 +1,279 @@
+// Package influx implements a mitm.Observer which writes decoded device
+// readings to InfluxDB using the line protocol over HTTP. Both the v1
+// (/write) and v2 (/api/v2/write) APIs are supported.
+//
+// Each reading is a point in the measurement named after the device type, e.g.
+// meter or inverter, with a field for each metric of the packet layout. It is
+// tagged with the device, model and serial, and timestamped with the time
+// reported by the device rather than the time it was received. For example:
+//
+//	meter,device=meter,model=HomeKit\ 1000\ Smart\ Meter,serial=01234567 power_generation_watts=2601i,... 1695000567
+//
+// This means that cached readings, which a device resends after it was unable
+// to send them at the time they were taken, are written at the right time.
+//
+// Points are written in batches. If a write fails they are buffered and
+// retried with exponential backoff, so a temporary InfluxDB outage doesn't
+// lose data.
+package influx
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/smlx/goodwe/internal/batch"
+	"github.com/smlx/goodwe/mitm"
+)
+
+const (
+	// DefaultBatchSize is the default maximum number of points per write.
+	DefaultBatchSize = batch.DefaultBatchSize
+	// DefaultFlushInterval is the default interval between writes.
+	DefaultFlushInterval = batch.DefaultFlushInterval
+	// DefaultMaxBuffer is the default maximum number of buffered points.
+	DefaultMaxBuffer = batch.DefaultMaxBuffer
+	// timeout for a single write request
+	writeTimeout = 10 * time.Second
+)
+
+var (
+	pointsWrittenTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "influxdb_points_written_total",
+		Help: "Count of points written to InfluxDB.",
+	})
+	pointsDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "influxdb_points_dropped_total",
+		Help: "Count of points dropped due to a full buffer or a rejected write.",
+	})
+	writeErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "influxdb_write_errors_total",
+		Help: "Count of failed InfluxDB writes.",
+	})
+)
+
+// Writer is a mitm.Observer which writes meter and inverter readings to
+// InfluxDB. Points are buffered by Observe and written by Run.
+type Writer struct {
+	serverURL *url.URL
+	client    *http.Client
+	// batchOpts configure the buffer.
+	batchOpts []batch.Option
+	buffer    *batch.Buffer
+	// v1
+	database        string
+	retentionPolicy string
+	username        string
+	password        string
+	// v2
+	org    string
+	bucket string
+	token  string
+}
+
+// NewWriter constructs a Writer for the InfluxDB server at the given base
+// URL (e.g. http://localhost:8086). Exactly one of WithDatabase (v1 API) or
+// WithBucket (v2 API) must be given.
+func NewWriter(
+	log *slog.Logger,
+	serverURL string,
+	opts ...Option,
+) (*Writer, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse InfluxDB URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid InfluxDB URL scheme %q", u.Scheme)
+	}
+	w := Writer{
+		serverURL: u,
+		client:    &http.Client{Timeout: writeTimeout},
+	}
+	for _, opt := range opts {
+		if err := opt(&w); err != nil {
+			return nil, err
+		}
+	}
+	if (w.database == "") == (w.bucket == "") {
+		return nil, fmt.Errorf("exactly one of database (v1) or bucket (v2) " +
+			"must be set")
+	}
+	w.buffer, err = batch.NewBuffer(log, "InfluxDB", "points", w.write,
+		batch.Counters{
+			Written: pointsWrittenTotal,
+			Dropped: pointsDroppedTotal,
+			Errors:  writeErrorsTotal,
+		}, w.batchOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// Option is a Writer configuration option.
+type Option func(*Writer) error
+
+// batchOption configures the buffer with opt.
+func batchOption(opt batch.Option) Option {
+	return func(w *Writer) error {
+		w.batchOpts = append(w.batchOpts, opt)
+		return nil
+	}
+}
+
+// WithDatabase selects the v1 API, writing to the given database and
+// retention policy. An empty retention policy uses the database default.
+func WithDatabase(database, retentionPolicy string) Option {
+	return func(w *Writer) error {
+		if database == "" {
+			return fmt.Errorf("empty database")
+		}
+		w.database = database
+		w.retentionPolicy = retentionPolicy
+		return nil
+	}
+}
+
+// WithBasicAuth sets the username and password used with the v1 API.
+func WithBasicAuth(username, password string) Option {
+	return func(w *Writer) error {
+		w.username = username
+		w.password = password
+		return nil
+	}
+}
+
+// WithBucket selects the v2 API, writing to the given organization and
+// bucket, and authenticating with the given API token.
+func WithBucket(org, bucket, token string) Option {
+	return func(w *Writer) error {
+		if org == "" || bucket == "" {
+			return fmt.Errorf("empty org or bucket")
+		}
+		w.org = org
+		w.bucket = bucket
+		w.token = token
+		return nil
+	}
+}
+
+// WithBatchSize sets the maximum number of points per write. A write is
+// triggered early once this many points are buffered. The default is
+// DefaultBatchSize.
+func WithBatchSize(n int) Option {
+	return batchOption(batch.WithBatchSize(n))
+}
+
+// WithFlushInterval sets the interval between writes. The default is
+// DefaultFlushInterval.
+func WithFlushInterval(d time.Duration) Option {
+	return batchOption(batch.WithFlushInterval(d))
+}
+
+// WithMaxBuffer sets the maximum number of points buffered while InfluxDB is
+// unavailable. Once full, the oldest points are dropped. The default is
+// DefaultMaxBuffer.
+func WithMaxBuffer(n int) Option {
+	return batchOption(batch.WithMaxBuffer(n))
+}
+
+// WithTLS sets the TLS configuration used for https:// URLs.
+func WithTLS(c *tls.Config) Option {
+	return func(w *Writer) error {
+		w.client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: c,
+		}
+		return nil
+	}
+}
+
+// Observe implements the mitm.Observer interface.
+func (w *Writer) Observe(_ context.Context, e mitm.Event) {
+	switch e := e.(type) {
+	case mitm.MetricsEvent:
+		w.buffer.Add("", appendLine(nil, e.Device.Type, tags(e.Source),
+			e.Reading, e.Timestamp))
+	}
+}
+
+// tags returns the InfluxDB tags identifying the source.
+func tags(s mitm.Source) map[string]string {
+	return map[string]string{
+		"device": s.Device.Type,
+		"model":  s.Device.Model,
+		"serial": s.Serial,
+	}
+}
+
+// Run writes buffered points until ctx is cancelled, and then makes a final
+// attempt to write any remaining points. It always returns nil.
+func (w *Writer) Run(ctx context.Context) error {
+	return w.buffer.Run(ctx)
+}
+
+// writeURL returns the URL of the write endpoint.
+func (w *Writer) writeURL() string {
+	u := *w.serverURL
+	q := url.Values{}
+	if w.bucket != "" {
+		u.Path = u.JoinPath("api/v2/write").Path
+		q.Set("org", w.org)
+		q.Set("bucket", w.bucket)
+	} else {
+		u.Path = u.JoinPath("write").Path
+		q.Set("db", w.database)
+		if w.retentionPolicy != "" {
+			q.Set("rp", w.retentionPolicy)
+		}
+	}
+	q.Set("precision", "s")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// write a batch of lines. If the write fails, retry indicates whether it may
+// succeed later.
+func (w *Writer) write(ctx context.Context, batch [][]byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.writeURL(),
+		bytes.NewReader(bytes.Join(batch, nil)))
+	if err != nil {
+		return false, fmt.Errorf("couldn't construct request: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	switch {
+	case w.token != "":
+		req.Header.Set("Authorization", "Token "+w.token)
+	case w.username != "":
+		req.SetBasicAuth(w.username, w.password)
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("couldn't send request: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, res.Body)
+		return false, nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	err = fmt.Errorf("bad response status %s: %s", res.Status,
+		bytes.TrimSpace(body))
+	// client errors other than rate limiting and auth problems won't go away
+	// by retrying
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusUnauthorized,
+		http.StatusForbidden, http.StatusRequestTimeout:
+		return true, err
+	}
+	return res.StatusCode >= 500, err
+}
@@ -0,0 +1,300 @@
+package influx
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/smlx/goodwe/internal/batch"
+	"github.com/smlx/goodwe/internal/eventtest"
+	"github.com/smlx/goodwe/mitm"
+)
+
+// request is a write request received by the test server.
+type request struct {
+	path          string
+	query         string
+	authorization string
+	body          string
+}
+
+// server is a fake InfluxDB which records write requests. It responds to
+// each request with the next status in statuses, then with 204.
+type server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []request
+}
+
+// newServer starts a fake InfluxDB.
+func newServer(t *testing.T, statuses ...int) *server {
+	t.Helper()
+	s := server{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.requests = append(s.requests, request{
+				path:          r.URL.Path,
+				query:         r.URL.RawQuery,
+				authorization: r.Header.Get("Authorization"),
+				body:          string(body),
+			})
+			status := http.StatusNoContent
+			if len(s.statuses) > 0 {
+				status, s.statuses = s.statuses[0], s.statuses[1:]
+			}
+			w.WriteHeader(status)
+		}))
+	t.Cleanup(s.Close)
+	return &s
+}
+
+// Requests returns the recorded requests.
+func (s *server) Requests() []request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]request(nil), s.requests...)
+}
+
+// meterLine returns the line protocol for
+// eventtest.MeterEvent(powerExport, _) at the given unix time.
+func meterLine(powerExport, unix string) string {
+	return `meter,device=meter,model=HomeKit\ 1000\ Smart\ Meter,` +
+		`serial=01234567 energy_export_decawatt_hours_total=123456i,` +
+		`energy_export_watt_hours_total=1234560,` +
+		`energy_generation_decawatt_hours_total=234567i,` +
+		`energy_generation_watt_hours_total=2345670,` +
+		`energy_import_decawatt_hours_total=34567i,` +
+		`energy_import_watt_hours_total=345670,` +
+		`power_export_watts=` + powerExport + `i,` +
+		`power_generation_watts=2601i ` + unix + "\n"
+}
+
+func TestWriter(t *testing.T) {
+	t0 := time.Date(2023, time.September, 18, 1, 9, 27, 0, time.UTC)
+	var testCases = map[string]struct {
+		statuses     []int
+		opts         []Option
+		events       int
+		expectPath   string
+		expectQuery  string
+		expectAuth   string
+		expectBodies []string
+	}{
+		"v1": {
+			opts: []Option{
+				WithDatabase("solar", "autogen"),
+				WithBasicAuth("goodwe", "secret"),
+			},
+			events:       2,
+			expectPath:   "/write",
+			expectQuery:  "db=solar&precision=s&rp=autogen",
+			expectAuth:   "Basic Z29vZHdlOnNlY3JldA==",
+			expectBodies: []string{meterLine("0", "1694999367") + meterLine("1", "1694999368")},
+		},
+		"v2": {
+			opts: []Option{
+				WithBucket("home", "solar", "s3cr3t"),
+			},
+			events:       2,
+			expectPath:   "/api/v2/write",
+			expectQuery:  "bucket=solar&org=home&precision=s",
+			expectAuth:   "Token s3cr3t",
+			expectBodies: []string{meterLine("0", "1694999367") + meterLine("1", "1694999368")},
+		},
+		"batches": {
+			opts: []Option{
+				WithDatabase("solar", ""),
+				WithBatchSize(2),
+			},
+			events:      3,
+			expectPath:  "/write",
+			expectQuery: "db=solar&precision=s",
+			expectBodies: []string{
+				meterLine("0", "1694999367") + meterLine("1", "1694999368"),
+				meterLine("2", "1694999369"),
+			},
+		},
+		"retry": {
+			statuses: []int{
+				http.StatusServiceUnavailable,
+				http.StatusTooManyRequests,
+			},
+			opts: []Option{
+				WithDatabase("solar", ""),
+			},
+			events:      2,
+			expectPath:  "/write",
+			expectQuery: "db=solar&precision=s",
+			expectBodies: []string{
+				meterLine("0", "1694999367") + meterLine("1", "1694999368"),
+				meterLine("0", "1694999367") + meterLine("1", "1694999368"),
+				meterLine("0", "1694999367") + meterLine("1", "1694999368"),
+			},
+		},
+		"rejected": {
+			statuses: []int{http.StatusBadRequest},
+			opts: []Option{
+				WithDatabase("solar", ""),
+				WithBatchSize(1),
+			},
+			events:      2,
+			expectPath:  "/write",
+			expectQuery: "db=solar&precision=s",
+			expectBodies: []string{
+				meterLine("0", "1694999367"),
+				meterLine("1", "1694999368"),
+			},
+		},
+	}
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			s := newServer(tt, tc.statuses...)
+			w, err := NewWriter(log, s.URL, append(tc.opts,
+				WithFlushInterval(50*time.Millisecond),
+				batchOption(batch.WithMinBackoff(10*time.Millisecond)))...)
+			assert.NoError(tt, err, name)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error)
+			go func() {
+				done <- w.Run(ctx)
+			}()
+			for i := range tc.events {
+				w.Observe(ctx, eventtest.MeterEvent(int32(i), t0.Add(time.Duration(i)*time.Second)))
+			}
+			eventtest.Eventually(tt, func() bool {
+				return len(s.Requests()) >= len(tc.expectBodies)
+			}, "expected requests")
+			cancel()
+			assert.NoError(tt, <-done, name)
+			requests := s.Requests()
+			var bodies []string
+			for _, r := range requests {
+				assert.Equal(tt, tc.expectPath, r.path, name)
+				assert.Equal(tt, tc.expectQuery, r.query, name)
+				assert.Equal(tt, tc.expectAuth, r.authorization, name)
+				bodies = append(bodies, r.body)
+			}
+			assert.Equal(tt, tc.expectBodies, bodies, name)
+			assert.Equal(tt, 0, w.buffer.Len(), name)
+		})
+	}
+}
+
+func TestWriterBufferOverflow(t *testing.T) {
+	t0 := time.Date(2023, time.September, 18, 1, 9, 27, 0, time.UTC)
+	s := newServer(t, http.StatusServiceUnavailable)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	w, err := NewWriter(log, s.URL, WithDatabase("solar", ""), WithMaxBuffer(2),
+		WithBatchSize(2))
+	assert.NoError(t, err)
+	ctx := context.Background()
+	w.Observe(ctx, eventtest.MeterEvent(0, t0))
+	w.Observe(ctx, eventtest.MeterEvent(1, t0.Add(time.Second)))
+	// the first write fails, so the points stay buffered
+	assert.Error(t, w.buffer.Flush(ctx))
+	assert.Equal(t, 2, w.buffer.Len())
+	// the oldest point is dropped
+	w.Observe(ctx, eventtest.MeterEvent(2, t0.Add(2*time.Second)))
+	assert.NoError(t, w.buffer.Flush(ctx))
+	assert.Equal(t, 0, w.buffer.Len())
+	var bodies []string
+	for _, r := range s.Requests() {
+		bodies = append(bodies, r.body)
+	}
+	assert.Equal(t, []string{
+		meterLine("0", "1694999367") + meterLine("1", "1694999368"),
+		meterLine("1", "1694999368") + meterLine("2", "1694999369"),
+	}, bodies)
+}
+
+func TestNewWriter(t *testing.T) {
+	var testCases = map[string]struct {
+		url         string
+		opts        []Option
+		expectError bool
+	}{
+		"v1":       {url: "http://localhost:8086", opts: []Option{WithDatabase("db", "")}},
+		"v2":       {url: "https://localhost:8086", opts: []Option{WithBucket("org", "bucket", "")}},
+		"neither":  {url: "http://localhost:8086", expectError: true},
+		"both":     {url: "http://localhost:8086", opts: []Option{WithDatabase("db", ""), WithBucket("org", "bucket", "")}, expectError: true},
+		"scheme":   {url: "localhost:8086", opts: []Option{WithDatabase("db", "")}, expectError: true},
+		"batch":    {url: "http://localhost:8086", opts: []Option{WithDatabase("db", ""), WithBatchSize(10), WithMaxBuffer(5)}, expectError: true},
+		"zero org": {url: "http://localhost:8086", opts: []Option{WithBucket("", "bucket", "")}, expectError: true},
+	}
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			_, err := NewWriter(log, tc.url, tc.opts...)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+		})
+	}
+}
+
+func TestAppendLine(t *testing.T) {
+	var testCases = map[string]struct {
+		tags   map[string]string
+		expect string
+	}{
+		"escaping": {
+			tags: map[string]string{
+				"model":  "a,b=c d",
+				"serial": "0123",
+			},
+			expect: `inverter,model=a\,b\=c\ d,serial=0123 `,
+		},
+		"nul padding": {
+			tags: map[string]string{
+				"serial": "0123\x00\x00\x00\x00",
+			},
+			expect: `inverter,serial=0123 `,
+		},
+		"empty tag": {
+			tags: map[string]string{
+				"model":  "",
+				"serial": "0123",
+			},
+			expect: `inverter,serial=0123 `,
+		},
+	}
+	reading := mitm.Reading{
+		Layout: mitm.PacketLayouts()[mitm.LayoutDNSG3][0],
+		Values: map[string]int64{
+			"VoltageOutputACDecivolts": 2403,
+			"PowerOutputWatts":         2000,
+			"RSSIPercent":              0,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			line := string(appendLine(nil, "inverter", tc.tags, reading,
+				time.Unix(1694999367, 0)))
+			assert.True(tt, strings.HasPrefix(line, tc.expect), line)
+			assert.True(tt, strings.HasSuffix(line,
+				" output_voltage_ac_decivolts=2403i,output_voltage_ac_volts=240.3,"+
+					"power_output_watts=2000i,rssi_percent=0i 1694999367\n"), line)
+		})
+	}
+	// a point without fields is invalid, so nothing is appended
+	assert.Equal(t, "buf", string(appendLine([]byte("buf"), "inverter",
+		map[string]string{"serial": "0123"},
+		mitm.Reading{Layout: reading.Layout}, time.Unix(1694999367, 0))))
+}
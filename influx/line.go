@@ -0,0 +1,86 @@
+package influx
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smlx/goodwe/mitm"
+)
+
+var (
+	// measurementEscaper escapes measurement names.
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	// keyEscaper escapes tag keys, tag values and field keys.
+	keyEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+)
+
+// appendLine appends a single point in line protocol to buf, with the fields
+// of reading, and returns the extended buffer. Each layout field with a metric
+// is written as an integer field of the raw value, and each field with an SI
+// metric as a float field of the scaled value. Field keys are the metric names
+// without the measurement prefix, e.g. power_export_watts in the meter
+// measurement. Tags with empty values and fields missing from the reading are
+// omitted. If no fields are present nothing is appended. The timestamp has
+// second precision.
+func appendLine(
+	buf []byte,
+	measurement string,
+	tags map[string]string,
+	reading mitm.Reading,
+	timestamp time.Time,
+) []byte {
+	if reading.Layout == nil {
+		return buf
+	}
+	start := len(buf)
+	buf = append(buf, measurementEscaper.Replace(measurement)...)
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	// tags should be sorted by key for best performance
+	slices.Sort(keys)
+	for _, k := range keys {
+		v := strings.TrimRight(tags[k], "\x00")
+		if v == "" {
+			continue
+		}
+		buf = append(buf, ',')
+		buf = append(buf, keyEscaper.Replace(k)...)
+		buf = append(buf, '=')
+		buf = append(buf, keyEscaper.Replace(v)...)
+	}
+	n := 0
+	appendKey := func(metric string) {
+		if n == 0 {
+			buf = append(buf, ' ')
+		} else {
+			buf = append(buf, ',')
+		}
+		n++
+		key := strings.TrimPrefix(metric, measurement+"_")
+		buf = append(buf, keyEscaper.Replace(key)...)
+		buf = append(buf, '=')
+	}
+	for _, f := range reading.Layout.Fields {
+		v, ok := reading.Values[f.Name]
+		if !ok || f.Metric == "" {
+			continue
+		}
+		appendKey(f.Metric)
+		buf = strconv.AppendInt(buf, v, 10)
+		buf = append(buf, 'i')
+		if f.SIMetric != "" {
+			appendKey(f.SIMetric)
+			buf = strconv.AppendFloat(buf, f.Scaled(v), 'f', -1, 64)
+		}
+	}
+	if n == 0 {
+		return buf[:start]
+	}
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, timestamp.Unix(), 10)
+	return append(buf, '\n')
+}
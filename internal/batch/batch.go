@@ -0,0 +1,291 @@
+// Package batch implements the buffering, batching and retrying of writes
+// shared by the mitm.Observer implementations which write readings to a time
+// series database.
+package batch
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultBatchSize is the default maximum number of items per write.
+	DefaultBatchSize = 500
+	// DefaultFlushInterval is the default interval between writes.
+	DefaultFlushInterval = 10 * time.Second
+	// DefaultMaxBuffer is the default maximum number of buffered items.
+	DefaultMaxBuffer = 100000
+	// timeout for the final write on shutdown
+	shutdownTimeout = 5 * time.Second
+	// retry backoff bounds
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// WriteFunc encodes and writes a batch of items. If the write fails, retry
+// indicates whether it may succeed later.
+type WriteFunc func(ctx context.Context, batch [][]byte) (retry bool, err error)
+
+// Counters count the items handled by a Buffer.
+type Counters struct {
+	// Written counts items which were written.
+	Written prometheus.Counter
+	// Dropped counts items dropped due to a full buffer or a rejected write.
+	Dropped prometheus.Counter
+	// Errors counts failed writes.
+	Errors prometheus.Counter
+}
+
+// item is a buffered item.
+type item struct {
+	// group of the item. Only items of the same group are written in a batch.
+	group string
+	data  []byte
+}
+
+// Buffer holds encoded items, oldest first, and writes them in batches.
+// Items are added by Add and written by Run.
+type Buffer struct {
+	log *slog.Logger
+	// target and items name the write destination and the items in log
+	// messages, e.g. InfluxDB and points.
+	target        string
+	items         string
+	write         WriteFunc
+	counters      Counters
+	batchSize     int
+	flushInterval time.Duration
+	maxBuffer     int
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+
+	mu  sync.Mutex
+	buf []item
+	// full is signalled when a batch is ready to be written.
+	full chan struct{}
+}
+
+// Option is a Buffer configuration option.
+type Option func(*Buffer) error
+
+// NewBuffer constructs a Buffer which writes items to target with write.
+func NewBuffer(
+	log *slog.Logger,
+	target string,
+	items string,
+	write WriteFunc,
+	counters Counters,
+	opts ...Option,
+) (*Buffer, error) {
+	b := Buffer{
+		log:           log,
+		target:        target,
+		items:         items,
+		write:         write,
+		counters:      counters,
+		batchSize:     DefaultBatchSize,
+		flushInterval: DefaultFlushInterval,
+		maxBuffer:     DefaultMaxBuffer,
+		minBackoff:    minBackoff,
+		maxBackoff:    maxBackoff,
+		full:          make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		if err := opt(&b); err != nil {
+			return nil, err
+		}
+	}
+	if b.batchSize > b.maxBuffer {
+		return nil, fmt.Errorf("batch size %d exceeds max buffer %d",
+			b.batchSize, b.maxBuffer)
+	}
+	return &b, nil
+}
+
+// WithBatchSize sets the maximum number of items per write. A write is
+// triggered early once this many items are buffered. The default is
+// DefaultBatchSize.
+func WithBatchSize(n int) Option {
+	return func(b *Buffer) error {
+		if n < 1 {
+			return fmt.Errorf("invalid batch size %d", n)
+		}
+		b.batchSize = n
+		return nil
+	}
+}
+
+// WithFlushInterval sets the interval between writes. The default is
+// DefaultFlushInterval.
+func WithFlushInterval(d time.Duration) Option {
+	return func(b *Buffer) error {
+		if d <= 0 {
+			return fmt.Errorf("invalid flush interval %v", d)
+		}
+		b.flushInterval = d
+		return nil
+	}
+}
+
+// WithMaxBuffer sets the maximum number of items buffered while the target
+// is unavailable. Once full, the oldest items are dropped. The default is
+// DefaultMaxBuffer.
+func WithMaxBuffer(n int) Option {
+	return func(b *Buffer) error {
+		if n < 1 {
+			return fmt.Errorf("invalid max buffer %d", n)
+		}
+		b.maxBuffer = n
+		return nil
+	}
+}
+
+// WithMinBackoff sets the initial delay before retrying a failed write. It
+// doubles with each failure, up to five minutes. The default is one second.
+func WithMinBackoff(d time.Duration) Option {
+	return func(b *Buffer) error {
+		if d <= 0 {
+			return fmt.Errorf("invalid min backoff %v", d)
+		}
+		b.minBackoff = d
+		return nil
+	}
+}
+
+// Add items of the given group to the buffer, dropping the oldest items if it
+// is full. Items are only written in a batch with other items of the same
+// group, so that if the target rejects a batch, items of other groups are not
+// dropped with it. Empty items are ignored.
+func (b *Buffer) Add(group string, items ...[]byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, data := range items {
+		if len(data) > 0 {
+			b.buf = append(b.buf, item{group: group, data: data})
+		}
+	}
+	if dropped := len(b.buf) - b.maxBuffer; dropped > 0 {
+		b.buf = b.buf[dropped:]
+		b.counters.Dropped.Add(float64(dropped))
+	}
+	if len(b.buf) >= b.batchSize {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run writes buffered items until ctx is cancelled, and then makes a final
+// attempt to write any remaining items. It always returns nil.
+func (b *Buffer) Run(ctx context.Context) error {
+	var backoff time.Duration
+	timer := time.NewTimer(b.flushInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel :=
+				context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := b.Flush(flushCtx); err != nil {
+				b.log.Warn(fmt.Sprintf("couldn't write buffered %s to %s on shutdown",
+					b.items, b.target),
+					slog.Int(b.items, b.Len()),
+					slog.Any("error", err))
+			}
+			return nil
+		case <-b.full:
+			if backoff > 0 {
+				// wait for the backoff timer
+				continue
+			}
+		case <-timer.C:
+		}
+		// don't abort an in-flight write on shutdown, since it would be resent
+		if err := b.Flush(context.WithoutCancel(ctx)); err != nil {
+			backoff = min(max(2*backoff, b.minBackoff), b.maxBackoff)
+			b.log.Warn("couldn't write to "+b.target,
+				slog.Int(b.items, b.Len()),
+				slog.Duration("retry", backoff),
+				slog.Any("error", err))
+			timer.Reset(backoff)
+			continue
+		}
+		backoff = 0
+		timer.Reset(b.flushInterval)
+	}
+}
+
+// Len returns the number of buffered items.
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.buf)
+}
+
+// next removes the next batch from the buffer: up to batchSize of the oldest
+// items of the group of the oldest item.
+func (b *Buffer) next() []item {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.buf) == 0 {
+		return nil
+	}
+	var batch, rest []item
+	for _, it := range b.buf {
+		if it.group == b.buf[0].group && len(batch) < b.batchSize {
+			batch = append(batch, it)
+		} else {
+			rest = append(rest, it)
+		}
+	}
+	b.buf = rest
+	return batch
+}
+
+// Flush writes all buffered items in batches. If a write fails with a
+// retryable error, the batch is returned to the buffer and the error is
+// returned.
+func (b *Buffer) Flush(ctx context.Context) error {
+	for {
+		batch := b.next()
+		n := len(batch)
+		if n == 0 {
+			return nil
+		}
+		data := make([][]byte, n)
+		for i, it := range batch {
+			data[i] = it.data
+		}
+		retry, err := b.write(ctx, data)
+		if err == nil {
+			b.counters.Written.Add(float64(n))
+			continue
+		}
+		b.counters.Errors.Inc()
+		if !retry {
+			// the batch will never be accepted, so drop it
+			b.counters.Dropped.Add(float64(n))
+			b.log.Error(fmt.Sprintf("%s rejected %s", b.target, b.items),
+				slog.Int(b.items, n),
+				slog.Any("error", err))
+			continue
+		}
+		// return the batch to the front of the buffer, dropping the oldest
+		// items if necessary
+		b.mu.Lock()
+		b.buf = append(batch, b.buf...)
+		if dropped := len(b.buf) - b.maxBuffer; dropped > 0 {
+			b.buf = b.buf[dropped:]
+			b.counters.Dropped.Add(float64(dropped))
+		}
+		b.mu.Unlock()
+		return err
+	}
+}
@@ -0,0 +1,50 @@
+// Package eventtest contains helpers for testing mitm.Observer
+// implementations.
+package eventtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smlx/goodwe/mitm"
+)
+
+// MeterEvent returns a meter metrics event with the given power export
+// value, reported by the device at the given time. The reading uses the
+// built-in HomeKit 1000 packet layout.
+func MeterEvent(powerExport int32, timestamp time.Time) mitm.MetricsEvent {
+	return mitm.MetricsEvent{
+		Source: mitm.Source{
+			Device: mitm.Device{
+				Type:   "meter",
+				Model:  "HomeKit 1000 Smart Meter",
+				Layout: mitm.LayoutHomeKit1000,
+			},
+			Serial: "01234567",
+		},
+		PacketType: mitm.PacketType{0x03, 0x04},
+		Timestamp:  timestamp,
+		Reading: mitm.Reading{
+			Layout: mitm.PacketLayouts()[mitm.LayoutHomeKit1000][0],
+			Values: map[string]int64{
+				"EnergyExportDecawattHoursTotal":     123456,
+				"EnergyGenerationDecawattHoursTotal": 234567,
+				"EnergyImportDecawattHoursTotal":     34567,
+				"PowerExportWatts":                   int64(powerExport),
+				"PowerGenerationWatts":               2601,
+			},
+		},
+	}
+}
+
+// Eventually polls cond until it returns true or the test times out.
+func Eventually(t testing.TB, cond func() bool, msg string) {
+	t.Helper()
+	for range 200 {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(msg)
+}
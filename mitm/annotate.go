@@ -0,0 +1,224 @@
+package mitm
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/smlx/goodwe/capture"
+)
+
+// Field is a single annotated field of a decoded frame.
+type Field struct {
+	// Name of the field. Fields of embedded structs are flattened.
+	Name string `json:"name"`
+	// Offset of the field in bytes.
+	Offset int `json:"offset"`
+	// Size of the field in bytes.
+	Size  int    `json:"size"`
+	Type  string `json:"type"`
+	Value any    `json:"value"`
+}
+
+// Annotated is a decoded frame with the offset of each field.
+type Annotated struct {
+	Direction  string     `json:"direction"`
+	PacketType PacketType `json:"packetType"`
+	// Packet is the name of the packet type, or empty if the packet type is
+	// not recognised.
+	Packet string `json:"packet,omitempty"`
+	// Layout is the name of the packet layout of a metrics packet.
+	Layout string `json:"layout,omitempty"`
+	// Frame contains the unencrypted fields. Offsets are relative to the start
+	// of the frame.
+	Frame []Field `json:"frame"`
+	// Cleartext contains the decrypted fields. Offsets are relative to the
+	// start of the cleartext.
+	Cleartext []Field `json:"cleartext,omitempty"`
+	// Hexdump of the cleartext. Only set if the packet type, or the layout of
+	// a metrics packet, is not recognised.
+	Hexdump []string `json:"hexdump,omitempty"`
+}
+
+// Annotate decodes the given frame and annotates each field with its offset.
+// Metrics packets are decoded with the packet layouts of the built-in devices.
+func Annotate(frame []byte) (*Annotated, error) {
+	r, err := NewRegistry()
+	if err != nil {
+		return nil, err
+	}
+	return r.Annotate(frame)
+}
+
+// Annotate decodes the given frame and annotates each field with its offset.
+// Metrics packets are decoded with the packet layout of the device in the
+// registry.
+func (r *Registry) Annotate(frame []byte) (*Annotated, error) {
+	decoded, err := r.Decode(frame)
+	if err != nil {
+		return nil, err
+	}
+	var header any
+	var crcByteOrder binary.ByteOrder
+	if decoded.Direction == capture.DirectionOutbound {
+		header = &OutboundHeader{}
+		crcByteOrder = outboundCRCByteOrder
+	} else {
+		header = &InboundHeader{}
+		crcByteOrder = inboundCRCByteOrder
+	}
+	headerSize := binary.Size(header)
+	err = header.(encoding.BinaryUnmarshaler).UnmarshalBinary(frame[:headerSize])
+	if err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal header: %v", err)
+	}
+	a := Annotated{
+		Direction:  decoded.Direction,
+		PacketType: decoded.PacketType,
+		Frame:      fields(reflect.ValueOf(header).Elem(), "", 0),
+	}
+	switch packet := decoded.Packet.(type) {
+	case nil:
+		a.Hexdump = hexdump(decoded.Cleartext)
+	case *MetricsPacket:
+		a.Packet = reflect.TypeOf(*packet).Name()
+		a.Layout = packet.Layout
+		a.Frame = append(a.Frame,
+			fields(reflect.ValueOf(packet.OutboundEnvelopeTS), "", headerSize)...)
+		if packet.layout == nil {
+			a.Hexdump = hexdump(decoded.Cleartext)
+		} else {
+			a.Cleartext = layoutFields(packet.layout, packet.Values,
+				decoded.Cleartext)
+		}
+	default:
+		// The first field of each packet struct is the unencrypted envelope,
+		// and the remaining fields are the encrypted body.
+		v := reflect.ValueOf(packet).Elem()
+		a.Packet = v.Type().Name()
+		env := v.Field(0)
+		a.Frame = append(a.Frame, fields(env, "", headerSize)...)
+		offset := 0
+		for i := 1; i < v.NumField(); i++ {
+			body := v.Field(i)
+			a.Cleartext = append(a.Cleartext, fields(body, "", offset)...)
+			offset += binary.Size(reflect.Zero(body.Type()).Interface())
+		}
+	}
+	crcOffset := len(frame) - 2
+	a.Frame = append(a.Frame, Field{
+		Name:   "CRC",
+		Offset: crcOffset,
+		Size:   2,
+		Type:   "uint16",
+		Value:  crcByteOrder.Uint16(frame[crcOffset:]),
+	})
+	return &a, nil
+}
+
+// hexdump returns the lines of a hex dump of data.
+func hexdump(data []byte) []string {
+	return strings.Split(strings.TrimSuffix(hex.Dump(data), "\n"), "\n")
+}
+
+// layoutFields returns the annotated fields of the cleartext, which was
+// decoded with the given layout. Bytes which aren't described by the layout
+// are annotated as unknown byte arrays.
+func layoutFields(
+	l *PacketLayout,
+	values map[string]int64,
+	cleartext []byte,
+) []Field {
+	var fs []Field
+	offset := 0
+	// unknown annotates the bytes from offset to end.
+	unknown := func(end int) {
+		if end <= offset {
+			return
+		}
+		fs = append(fs, Field{
+			Name:   fmt.Sprintf("Unknown0x%02x", offset),
+			Offset: offset,
+			Size:   end - offset,
+			Type:   fmt.Sprintf("[%d]uint8", end-offset),
+			Value:  hex.EncodeToString(cleartext[offset:end]),
+		})
+	}
+	lfs := slices.SortedFunc(slices.Values(l.Fields),
+		func(a, b LayoutField) int { return a.Offset - b.Offset })
+	for _, f := range lfs {
+		unknown(f.Offset)
+		fs = append(fs, Field{
+			Name:   f.Name,
+			Offset: f.Offset,
+			Size:   f.size,
+			Type:   f.Type,
+			Value:  values[f.Name],
+		})
+		offset = f.Offset + f.size
+	}
+	unknown(len(cleartext))
+	return fs
+}
+
+// fields returns the annotated leaf fields of v, which is laid out starting
+// at the given offset. Embedded structs are flattened.
+func fields(v reflect.Value, prefix string, offset int) []Field {
+	var fs []Field
+	t := v.Type()
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		fv := v.Field(i)
+		size := binary.Size(reflect.Zero(sf.Type).Interface())
+		switch {
+		case sf.Type.Kind() == reflect.Struct && sf.Anonymous:
+			fs = append(fs, fields(fv, prefix, offset)...)
+		case sf.Type.Kind() == reflect.Struct:
+			fs = append(fs, fields(fv, prefix+sf.Name+".", offset)...)
+		default:
+			fs = append(fs, Field{
+				Name:   prefix + sf.Name,
+				Offset: offset,
+				Size:   size,
+				Type:   sf.Type.String(),
+				Value:  fieldValue(fv),
+			})
+		}
+		offset += size
+	}
+	return fs
+}
+
+// fieldValue returns a JSON friendly representation of the given value.
+// Byte arrays are hex encoded, except for PacketType and Timestamp which have
+// their own text representation. The value may have been obtained via an
+// unexported embedded struct, so Interface() can't be used here.
+func fieldValue(v reflect.Value) any {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return v.Uint()
+	case reflect.Array:
+		data := make([]byte, v.Len())
+		for i := range data {
+			data[i] = byte(v.Index(i).Uint())
+		}
+		switch v.Type() {
+		case reflect.TypeOf(PacketType{}):
+			return PacketType(data).String()
+		case reflect.TypeOf(Timestamp{}):
+			text, _ := Timestamp(data).MarshalText()
+			return string(text)
+		default:
+			return hex.EncodeToString(data)
+		}
+	default:
+		return v.String()
+	}
+}
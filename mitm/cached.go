@@ -0,0 +1,42 @@
+package mitm
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Cached readings are sent by a device in *Metrics1 packets after it was
+// unable to send them at the time they were taken. Prometheus has no way to
+// record a sample in the past, so cached readings are not written to the live
+// gauges. Only their count and age are recorded.
+var (
+	meterCachedPacketsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meter_cached_packets_total",
+		Help: "Count of outbound metrics packets carrying cached readings.",
+	}, labelNames)
+	meterCacheLagSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "meter_cache_lag_seconds",
+		Help: "Age of the reading in the last cached metrics packet.",
+	}, labelNames)
+	inverterCachedPacketsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "inverter_cached_packets_total",
+		Help: "Count of outbound metrics packets carrying cached readings.",
+	}, labelNames)
+	inverterCacheLagSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "inverter_cache_lag_seconds",
+		Help: "Age of the reading in the last cached metrics packet.",
+	}, labelNames)
+)
+
+// observeCached records a cached reading taken by the device at timestamp.
+func (o *PrometheusObserver) observeCached(
+	packetsTotal *prometheus.CounterVec,
+	lagSeconds *prometheus.GaugeVec,
+	labels prometheus.Labels,
+	timestamp time.Time,
+) {
+	packetsTotal.With(labels).Inc()
+	lagSeconds.With(labels).Set(o.now().Sub(timestamp).Seconds())
+}
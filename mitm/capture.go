@@ -0,0 +1,86 @@
+package mitm
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/smlx/goodwe/capture"
+)
+
+// connIDKey is the context key of the connection ID.
+type connIDKey struct{}
+
+// withConnID returns a copy of ctx carrying the given connection ID.
+func withConnID(ctx context.Context, connID string) context.Context {
+	return context.WithValue(ctx, connIDKey{}, connID)
+}
+
+// ConnID returns the ID of the device connection a packet was received on,
+// or an empty string if ctx doesn't carry a connection ID.
+func ConnID(ctx context.Context) string {
+	connID, _ := ctx.Value(connIDKey{}).(string)
+	return connID
+}
+
+// direction returns the direction of the traffic with the given prefix.
+func direction(packetPrefix []byte) string {
+	if slices.Equal(packetPrefix, outboundPrefix) {
+		return capture.DirectionOutbound
+	}
+	return capture.DirectionInbound
+}
+
+// decryptFrame returns the decrypted body of a full frame with the given
+// prefix. The envelope type is inferred from the ciphertext length, since
+// different packet types use envelopes of different sizes.
+func decryptFrame(data, packetPrefix []byte) ([]byte, error) {
+	// prefix + length + packet type
+	headerSize := len(packetPrefix) + 4 + 2
+	if len(data) < headerSize+2 {
+		return nil, fmt.Errorf("frame too short: %d", len(data))
+	}
+	body := data[headerSize : len(data)-2]
+	// offset of the IV within each envelope type
+	envelopes := map[int]int{
+		binary.Size(OutboundEnvelope{}): 16,
+	}
+	if slices.Equal(packetPrefix, outboundPrefix) {
+		envelopes[binary.Size(OutboundEnvelopeTS{})] = 18
+	}
+	for envSize, ivOffset := range envelopes {
+		ciphertextLen := len(body) - envSize
+		if ciphertextLen <= 0 || ciphertextLen%16 != 0 {
+			continue
+		}
+		return decryptCiphertext(body[ivOffset:ivOffset+16], body[envSize:])
+	}
+	return nil, fmt.Errorf("unknown envelope for body size %d", len(body))
+}
+
+// recordFrame writes the given frame to the capture file, if the server has
+// one configured.
+func (s *Server) recordFrame(
+	ctx context.Context,
+	log *slog.Logger,
+	data []byte,
+	packetPrefix []byte,
+) {
+	if s.capture == nil || len(data) == 0 {
+		return
+	}
+	entry := capture.Entry{
+		Time:      timeNow(),
+		ConnID:    ConnID(ctx),
+		Direction: direction(packetPrefix),
+		Raw:       data,
+	}
+	if cleartext, err := decryptFrame(data, packetPrefix); err == nil {
+		entry.Cleartext = cleartext
+	}
+	if err := s.capture.Write(&entry); err != nil {
+		log.Warn("couldn't record frame", slog.Any("error", err))
+	}
+}
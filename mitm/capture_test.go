@@ -0,0 +1,136 @@
+package mitm
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/smlx/goodwe/capture"
+)
+
+func TestDecryptFrame(t *testing.T) {
+	var testCases = map[string]struct {
+		input        []byte
+		packetPrefix []byte
+		expect       []byte
+		expectError  bool
+	}{
+		"outbound time sync response ack": {
+			input: []byte{
+				0x50, 0x4f, 0x53, 0x54, 0x47, 0x57, 0x00, 0x00, 0x00, 0x31, 0x03, 0x10, 0x39, 0x31, 0x30, 0x30,
+				0x30, 0x48, 0x4b, 0x55, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x17, 0x0b, 0x05, 0x0e,
+				0x0c, 0x38, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xcb, 0xef, 0x10, 0xd3,
+				0x6c, 0x1e, 0xa8, 0x34, 0x83, 0x2b, 0x7b, 0x7d, 0x9a, 0x1b, 0x22, 0x16, 0x03, 0xb6,
+			},
+			packetPrefix: outboundPrefix,
+			expect:       timeSyncRespAckData,
+		},
+		"outbound meter metrics": {
+			input: []byte{
+				0x50, 0x4f, 0x53, 0x54, 0x47, 0x57, 0x00, 0x00, 0x00, 0x99, 0x03, 0x04, 0x00, 0x00, 0x39, 0x31,
+				0x30, 0x30, 0x30, 0x48, 0x4b, 0x55, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x17, 0x09,
+				0x12, 0x09, 0x09, 0x1b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x17, 0x09,
+				0x12, 0x09, 0x09, 0x1b, 0xde, 0xde, 0x93, 0x57, 0xfe, 0x05, 0x28, 0x76, 0x42, 0xac, 0x63, 0xcf,
+				0xdd, 0x7a, 0xae, 0x6d, 0xca, 0x77, 0x85, 0xca, 0x23, 0x99, 0x4c, 0x72, 0x7d, 0x33, 0x59, 0x81,
+				0x3b, 0xc8, 0xf2, 0x37, 0x22, 0x69, 0x71, 0x9d, 0xc8, 0x46, 0x62, 0xa2, 0xc0, 0xef, 0xe7, 0x44,
+				0xb3, 0x58, 0x2a, 0x2f, 0xbd, 0x2f, 0x68, 0x4c, 0xe0, 0x98, 0x0b, 0x24, 0xbf, 0x04, 0xc4, 0x4f,
+				0xa8, 0x01, 0x81, 0x8c, 0xf6, 0x5f, 0x05, 0x52, 0x73, 0x86, 0x32, 0xaa, 0x16, 0xd2, 0x9f, 0xfe,
+				0x0e, 0x52, 0xb3, 0xcc, 0x9f, 0x0a, 0xaf, 0xef, 0x6d, 0x28, 0xce, 0xad, 0x52, 0xe7, 0x9f, 0x7f,
+				0x9b, 0xe3, 0x3c, 0xa0, 0x1b, 0x22, 0xc9, 0x59, 0x33, 0x04, 0xf2, 0x39, 0x8d, 0xd1, 0x20, 0xfc,
+				0x88, 0xaa, 0x1d, 0x99, 0x4b, 0xcd,
+			},
+			packetPrefix: outboundPrefix,
+			// first 16 bytes of the cleartext
+			expect: []byte{
+				0x04, 0x08, 0x00, 0x08, 0x17, 0x00, 0x00, 0x00, 0x00, 0x69, 0xc6, 0x00, 0x00, 0x00, 0x00, 0xe2,
+			},
+		},
+		"inbound metrics ack": {
+			input: []byte{
+				0x47, 0x57, 0x00, 0x00, 0x00, 0x31, 0x03, 0x04, 0x39, 0x31, 0x30, 0x30, 0x30, 0x48, 0x4b, 0x55,
+				0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x08, 0x34, 0x0d, 0x03, 0x0b, 0x17, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0a, 0xc9, 0x51, 0x6e, 0x47, 0x9e, 0xfa, 0xed,
+				0x13, 0x7e, 0x48, 0xde, 0x86, 0xad, 0x9d, 0x42, 0xcc, 0xcb,
+			},
+			packetPrefix: inboundPrefix,
+			expect:       metricsAckData,
+		},
+		"keepalive": {
+			input:        keepAlive,
+			packetPrefix: inboundPrefix,
+			expectError:  true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			cleartext, err := decryptFrame(tc.input, tc.packetPrefix)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expect, cleartext[:len(tc.expect)], name)
+		})
+	}
+}
+
+func TestRecordFrame(t *testing.T) {
+	input := []byte{
+		0x47, 0x57, 0x00, 0x00, 0x00, 0x31, 0x03, 0x04, 0x39, 0x31, 0x30, 0x30, 0x30, 0x48, 0x4b, 0x55,
+		0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x08, 0x34, 0x0d, 0x03, 0x0b, 0x17, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0a, 0xc9, 0x51, 0x6e, 0x47, 0x9e, 0xfa, 0xed,
+		0x13, 0x7e, 0x48, 0xde, 0x86, 0xad, 0x9d, 0x42, 0xcc, 0xcb,
+		0x01, 0x02,
+	}
+	path := filepath.Join(t.TempDir(), "capture.ndjson")
+	w, err := capture.NewWriter(path, 0, 0)
+	assert.NoError(t, err)
+	mitmSrv, err := NewServer(false, true, WithCapture(w))
+	assert.NoError(t, err)
+	log := slog.New(slog.NewJSONHandler(os.Stderr,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	// mock conns
+	upstreamRead, upstreamWrite := net.Pipe()
+	clientRead, clientWrite := net.Pipe()
+	ctx, cancel := context.WithTimeout(
+		withConnID(context.Background(), "conn0"), 2*readTimeout)
+	defer cancel()
+	go func() {
+		_, _ = upstreamWrite.Write(input)
+	}()
+	go func() {
+		_, _ = io.Copy(io.Discard, clientRead)
+	}()
+	assert.NoError(t, mitmSrv.handleConn(ctx, log, upstreamRead, clientWrite,
+		inboundPrefix, DefaultInboundPolicy,
+		NewInboundPacketHandler(mitmSrv.registry, mitmSrv.observers)))
+	assert.NoError(t, w.Close())
+	// check the recorded frames
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	r := capture.NewReader(f)
+	ack, err := r.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "conn0", ack.ConnID)
+	assert.Equal(t, capture.DirectionInbound, ack.Direction)
+	assert.Equal(t, input[:58], []byte(ack.Raw))
+	assert.Equal(t, metricsAckData, []byte(ack.Cleartext))
+	assert.True(t, time.Since(ack.Time) < time.Minute)
+	ka, err := r.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, keepAlive, []byte(ka.Raw))
+	assert.Equal(t, 0, len(ka.Cleartext))
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+	// ensure test values are used
+	deviceSerial, err := deviceSerialInbound(ack.Raw)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(testDeviceSerial), deviceSerial)
+}
@@ -0,0 +1,179 @@
+package mitm
+
+import (
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	"github.com/smlx/goodwe/capture"
+)
+
+// newPacket returns a new packet of type T.
+func newPacket[T any, PT interface {
+	*T
+	encoding.BinaryUnmarshaler
+}]() encoding.BinaryUnmarshaler {
+	return PT(new(T))
+}
+
+var (
+	// outboundPackets maps outbound packet types to their body structs.
+	// Metrics packets, of the types described by packet layouts, are decoded
+	// with the layout of the device which sent them instead.
+	outboundPackets = map[PacketType]func() encoding.BinaryUnmarshaler{
+		meterTimeSync:           newPacket[OutboundMeterTimeSyncPacket],
+		meterTimeSyncRespAck:    newPacket[OutboundTimeSyncRespAckPacket],
+		inverterTimeSync:        newPacket[OutboundInverterTimeSyncPacket],
+		inverterTimeSyncRespAck: newPacket[OutboundTimeSyncRespAckPacket],
+	}
+	// inboundPackets maps inbound packet types to their body structs.
+	inboundPackets = map[PacketType]func() encoding.BinaryUnmarshaler{
+		meterMetricsAck0:     newPacket[InboundMetricsAckPacket],
+		meterMetricsAck1:     newPacket[InboundMetricsAckPacket],
+		meterMetricsAck2:     newPacket[InboundMetricsAckPacket],
+		inverterMetricsAck0:  newPacket[InboundMetricsAckPacket],
+		inverterMetricsAck1:  newPacket[InboundMetricsAckPacket],
+		meterTimeSyncResp:    newPacket[InboundTimeSyncRespPacket],
+		inverterTimeSyncResp: newPacket[InboundTimeSyncRespPacket],
+	}
+)
+
+// Decoded is a decoded SEMS packet.
+type Decoded struct {
+	Direction  string     `json:"direction"`
+	PacketType PacketType `json:"packetType"`
+	// Packet is the typed packet body, such as *InboundMetricsAckPacket, or
+	// *MetricsPacket for metrics packets. It is nil if the packet type is not
+	// recognised.
+	Packet any `json:"packet,omitempty"`
+	// Cleartext is the decrypted packet body.
+	Cleartext capture.HexBytes `json:"cleartext"`
+}
+
+// MetricsPacket is an outbound metrics packet with the cleartext decoded
+// according to the packet layout of the device which sent it.
+type MetricsPacket struct {
+	OutboundEnvelopeTS
+	// Layout is the name of the packet layout. It is empty if the device or the
+	// layout of the cleartext is unknown, in which case Values is nil.
+	Layout string
+	// Values are the raw field values keyed by field name.
+	Values map[string]int64
+
+	layout *PacketLayout
+}
+
+// FrameDirection returns the direction of the given frame based on its
+// prefix, or an empty string if the prefix is not recognised.
+func FrameDirection(frame []byte) string {
+	switch {
+	case len(frame) >= len(outboundPrefix) &&
+		slices.Equal(frame[:len(outboundPrefix)], outboundPrefix):
+		return capture.DirectionOutbound
+	case len(frame) >= len(inboundPrefix) &&
+		slices.Equal(frame[:len(inboundPrefix)], inboundPrefix):
+		return capture.DirectionInbound
+	default:
+		return ""
+	}
+}
+
+// Decode validates the header and CRC of the given frame, then decrypts and
+// decodes the packet body. Metrics packets are decoded with the packet layouts
+// of the built-in devices.
+func Decode(frame []byte) (*Decoded, error) {
+	r, err := NewRegistry()
+	if err != nil {
+		return nil, err
+	}
+	return r.Decode(frame)
+}
+
+// Decode validates the header and CRC of the given frame, then decrypts and
+// decodes the packet body. Metrics packets are decoded with the packet layout
+// of the device in the registry.
+func (r *Registry) Decode(frame []byte) (*Decoded, error) {
+	var packetPrefix []byte
+	var crcByteOrder binary.ByteOrder
+	var packets map[PacketType]func() encoding.BinaryUnmarshaler
+	dir := FrameDirection(frame)
+	switch dir {
+	case capture.DirectionOutbound:
+		packetPrefix = outboundPrefix
+		crcByteOrder = outboundCRCByteOrder
+		packets = outboundPackets
+	case capture.DirectionInbound:
+		packetPrefix = inboundPrefix
+		crcByteOrder = inboundCRCByteOrder
+		packets = inboundPackets
+	default:
+		return nil, fmt.Errorf("unknown frame prefix")
+	}
+	// prefix + length + packet type
+	headerSize := len(packetPrefix) + 4 + 2
+	if len(frame) < headerSize+2 {
+		return nil, fmt.Errorf("frame too short: %d", len(frame))
+	}
+	if err := validateCRC(frame, crcByteOrder); err != nil {
+		return nil, fmt.Errorf("couldn't validate CRC: %v", err)
+	}
+	// validate size: -2 for packet type field and +1 for length off-by-one = -1
+	length := binary.BigEndian.Uint32(frame[len(packetPrefix):])
+	bodyData := frame[headerSize : len(frame)-2]
+	if int64(len(bodyData)) != int64(length)-1 {
+		return nil, fmt.Errorf("expected body size %d, got %d",
+			int64(length)-1, len(bodyData))
+	}
+	decoded := Decoded{
+		Direction:  dir,
+		PacketType: PacketType(frame[headerSize-2 : headerSize]),
+	}
+	cleartext, err := decryptFrame(frame, packetPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decrypt frame: %v", err)
+	}
+	decoded.Cleartext = cleartext
+	if dir == capture.DirectionOutbound &&
+		isMetricsPacket(decoded.PacketType) {
+		decoded.Packet, err = r.decodeMetrics(decoded.PacketType, bodyData,
+			cleartext)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't unmarshal metrics: %v", err)
+		}
+		return &decoded, nil
+	}
+	newPacket, ok := packets[decoded.PacketType]
+	if !ok {
+		return &decoded, nil
+	}
+	packet := newPacket()
+	if err = packet.UnmarshalBinary(bodyData); err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal %T: %v", packet, err)
+	}
+	decoded.Packet = packet
+	return &decoded, nil
+}
+
+// decodeMetrics decodes the body of a metrics packet with the given
+// cleartext. If the device or the layout of the cleartext is unknown, only the
+// envelope is decoded.
+func (r *Registry) decodeMetrics(
+	packetType PacketType,
+	body, cleartext []byte,
+) (*MetricsPacket, error) {
+	var p MetricsPacket
+	if _, err := unmarshalEnvelope(body, &p.OutboundEnvelopeTS); err != nil {
+		return nil, err
+	}
+	d, err := r.lookup(p.DeviceID)
+	if err != nil {
+		return &p, nil
+	}
+	reading, err := decodeReading(d.Layout, packetType, cleartext)
+	if err != nil {
+		return &p, nil
+	}
+	p.Layout, p.Values, p.layout = d.Layout, reading.Values, reading.Layout
+	return &p, nil
+}
@@ -0,0 +1,209 @@
+package mitm
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/smlx/goodwe/capture"
+)
+
+func TestDecode(t *testing.T) {
+	env := OutboundEnvelopeTS{
+		DeviceID:     [8]byte([]byte("91000HKU")),
+		DeviceSerial: [8]byte([]byte(testDeviceSerial)),
+	}
+	unknown, err := metricsAckPacket(PacketType{0x09, 0x09}, &env,
+		metricsAckData, time.Date(2023, time.November, 26, 22, 4, 33, 0, time.UTC))
+	assert.NoError(t, err)
+	var testCases = map[string]struct {
+		input        []byte
+		expectDir    string
+		expectType   PacketType
+		expectBody   any
+		expectLayout string
+		expectError  bool
+	}{
+		"outbound meter metrics": {
+			input: []byte{
+				0x50, 0x4f, 0x53, 0x54, 0x47, 0x57, 0x00, 0x00, 0x00, 0x99, 0x03, 0x04, 0x00, 0x00, 0x39, 0x31,
+				0x30, 0x30, 0x30, 0x48, 0x4b, 0x55, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x17, 0x09,
+				0x12, 0x09, 0x09, 0x1b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x17, 0x09,
+				0x12, 0x09, 0x09, 0x1b, 0xde, 0xde, 0x93, 0x57, 0xfe, 0x05, 0x28, 0x76, 0x42, 0xac, 0x63, 0xcf,
+				0xdd, 0x7a, 0xae, 0x6d, 0xca, 0x77, 0x85, 0xca, 0x23, 0x99, 0x4c, 0x72, 0x7d, 0x33, 0x59, 0x81,
+				0x3b, 0xc8, 0xf2, 0x37, 0x22, 0x69, 0x71, 0x9d, 0xc8, 0x46, 0x62, 0xa2, 0xc0, 0xef, 0xe7, 0x44,
+				0xb3, 0x58, 0x2a, 0x2f, 0xbd, 0x2f, 0x68, 0x4c, 0xe0, 0x98, 0x0b, 0x24, 0xbf, 0x04, 0xc4, 0x4f,
+				0xa8, 0x01, 0x81, 0x8c, 0xf6, 0x5f, 0x05, 0x52, 0x73, 0x86, 0x32, 0xaa, 0x16, 0xd2, 0x9f, 0xfe,
+				0x0e, 0x52, 0xb3, 0xcc, 0x9f, 0x0a, 0xaf, 0xef, 0x6d, 0x28, 0xce, 0xad, 0x52, 0xe7, 0x9f, 0x7f,
+				0x9b, 0xe3, 0x3c, 0xa0, 0x1b, 0x22, 0xc9, 0x59, 0x33, 0x04, 0xf2, 0x39, 0x8d, 0xd1, 0x20, 0xfc,
+				0x88, 0xaa, 0x1d, 0x99, 0x4b, 0xcd,
+			},
+			expectDir:    capture.DirectionOutbound,
+			expectType:   meterMetrics0,
+			expectBody:   &MetricsPacket{},
+			expectLayout: LayoutHomeKit1000,
+		},
+		"inbound metrics ack": {
+			input: []byte{
+				0x47, 0x57, 0x00, 0x00, 0x00, 0x31, 0x03, 0x04, 0x39, 0x31, 0x30, 0x30, 0x30, 0x48, 0x4b, 0x55,
+				0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x08, 0x34, 0x0d, 0x03, 0x0b, 0x17, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0a, 0xc9, 0x51, 0x6e, 0x47, 0x9e, 0xfa, 0xed,
+				0x13, 0x7e, 0x48, 0xde, 0x86, 0xad, 0x9d, 0x42, 0xcc, 0xcb,
+			},
+			expectDir:  capture.DirectionInbound,
+			expectType: meterMetricsAck0,
+			expectBody: &InboundMetricsAckPacket{},
+		},
+		"unknown packet type": {
+			input:      unknown,
+			expectDir:  capture.DirectionInbound,
+			expectType: PacketType{0x09, 0x09},
+		},
+		"bad crc": {
+			input: []byte{
+				0x47, 0x57, 0x00, 0x00, 0x00, 0x31, 0x03, 0x04, 0x39, 0x31, 0x30, 0x30, 0x30, 0x48, 0x4b, 0x55,
+				0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x08, 0x34, 0x0d, 0x03, 0x0b, 0x17, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0a, 0xc9, 0x51, 0x6e, 0x47, 0x9e, 0xfa, 0xed,
+				0x13, 0x7e, 0x48, 0xde, 0x86, 0xad, 0x9d, 0x42, 0xcc, 0xcc,
+			},
+			expectError: true,
+		},
+		"keepalive": {
+			input:       keepAlive,
+			expectError: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			decoded, err := Decode(tc.input)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expectDir, decoded.Direction, name)
+			assert.Equal(tt, tc.expectType, decoded.PacketType, name)
+			assert.NotZero(tt, len(decoded.Cleartext), name)
+			if tc.expectBody == nil {
+				assert.Zero(tt, decoded.Packet, name)
+				return
+			}
+			assert.Equal(tt, fmt.Sprintf("%T", tc.expectBody),
+				fmt.Sprintf("%T", decoded.Packet), name)
+			if metrics, ok := decoded.Packet.(*MetricsPacket); ok {
+				assert.Equal(tt, tc.expectLayout, metrics.Layout, name)
+				assert.Equal(tt, int64(1557), metrics.Values["PowerExportWatts"],
+					name)
+			}
+		})
+	}
+}
+
+func TestDecodeMetricsUnknownDevice(t *testing.T) {
+	registry := &Registry{devices: map[DeviceID]Device{}}
+	frame := outboundSeeds(t)[0]
+	decoded, err := registry.Decode(frame)
+	assert.NoError(t, err)
+	// only the envelope is decoded
+	metrics, ok := decoded.Packet.(*MetricsPacket)
+	assert.True(t, ok, "expected *MetricsPacket, got %T", decoded.Packet)
+	assert.Equal(t, DeviceID([]byte("91000HKU")), DeviceID(metrics.DeviceID))
+	assert.Zero(t, metrics.Layout)
+	assert.Zero(t, metrics.Values)
+	annotated, err := registry.Annotate(frame)
+	assert.NoError(t, err)
+	assert.Zero(t, annotated.Cleartext)
+	assert.NotZero(t, annotated.Hexdump)
+}
+
+func TestAnnotateMetrics(t *testing.T) {
+	for name, frame := range map[string][]byte{
+		"meter metrics":      outboundSeeds(t)[0],
+		"inverter metrics 0": outboundSeeds(t)[1],
+		"inverter metrics 1": outboundSeeds(t)[2],
+	} {
+		t.Run(name, func(tt *testing.T) {
+			decoded, err := Decode(frame)
+			assert.NoError(tt, err, name)
+			metrics, ok := decoded.Packet.(*MetricsPacket)
+			assert.True(tt, ok, name)
+			annotated, err := Annotate(frame)
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, "MetricsPacket", annotated.Packet, name)
+			assert.Equal(tt, metrics.Layout, annotated.Layout, name)
+			assert.Zero(tt, annotated.Hexdump, name)
+			// the fields cover the cleartext, and agree with the decoded values
+			offset := 0
+			for _, f := range annotated.Cleartext {
+				assert.Equal(tt, offset, f.Offset, f.Name)
+				offset += f.Size
+				if value, ok := metrics.Values[f.Name]; ok {
+					assert.Equal(tt, any(value), f.Value, f.Name)
+				}
+			}
+			assert.Equal(tt, len(decoded.Cleartext), offset, name)
+		})
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	env := OutboundEnvelopeTS{
+		DeviceID:     [8]byte([]byte("91000HKU")),
+		DeviceSerial: [8]byte([]byte(testDeviceSerial)),
+	}
+	now := time.Date(2023, time.November, 26, 22, 4, 33, 0, time.UTC)
+	ack, err := metricsAckPacket(meterMetricsAck0, &env, metricsAckData, now)
+	assert.NoError(t, err)
+	unknown, err := metricsAckPacket(PacketType{0x09, 0x09}, &env,
+		metricsAckData, now)
+	assert.NoError(t, err)
+	var testCases = map[string]struct {
+		input           []byte
+		expectPacket    string
+		expectFrame     []Field
+		expectCleartext []Field
+		expectHexdump   []string
+	}{
+		"metrics ack": {
+			input:        ack,
+			expectPacket: "InboundMetricsAckPacket",
+			expectFrame: []Field{
+				{Name: "GW", Offset: 0, Size: 2, Type: "[2]uint8", Value: "4757"},
+				{Name: "Length", Offset: 2, Size: 4, Type: "uint32", Value: uint64(49)},
+				{Name: "PacketType", Offset: 6, Size: 2, Type: "[2]uint8", Value: "0304"},
+				{Name: "DeviceID", Offset: 8, Size: 8, Type: "[8]uint8", Value: "3931303030484b55"},
+				{Name: "DeviceSerial", Offset: 16, Size: 8, Type: "[8]uint8", Value: "3031323334353637"},
+				{Name: "IV", Offset: 24, Size: 16, Type: "[16]uint8", Value: "2104061b0b1700000000000000000000"},
+				{Name: "CRC", Offset: 56, Size: 2, Type: "uint16",
+					Value: inboundCRCByteOrder.Uint16(ack[56:])},
+			},
+			expectCleartext: []Field{
+				{Name: "Data", Offset: 0, Size: 16, Type: "[16]uint8", Value: "00000000000000000000000000000000"},
+			},
+		},
+		"unknown packet type": {
+			input: unknown,
+			expectFrame: []Field{
+				{Name: "GW", Offset: 0, Size: 2, Type: "[2]uint8", Value: "4757"},
+				{Name: "Length", Offset: 2, Size: 4, Type: "uint32", Value: uint64(49)},
+				{Name: "PacketType", Offset: 6, Size: 2, Type: "[2]uint8", Value: "0909"},
+				{Name: "CRC", Offset: 56, Size: 2, Type: "uint16",
+					Value: inboundCRCByteOrder.Uint16(unknown[56:])},
+			},
+			expectHexdump: []string{
+				"00000000  00 00 00 00 00 00 00 00  00 00 00 00 00 00 00 00  |................|",
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			annotated, err := Annotate(tc.input)
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expectPacket, annotated.Packet, name)
+			assert.Equal(tt, tc.expectFrame, annotated.Frame, name)
+			assert.Equal(tt, tc.expectCleartext, annotated.Cleartext, name)
+			assert.Equal(tt, tc.expectHexdump, annotated.Hexdump, name)
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package mitm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/smlx/goodwe/queue"
+)
+
+const (
+	// interval between attempts to forward queued frames upstream
+	queueRetryInterval = 30 * time.Second
+	// maximum time to wait for SEMS to reply to a queued frame
+	queueReplyTimeout = 5 * time.Second
+)
+
+var (
+	degradedConnectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "degraded_connections_total",
+		Help: "Count of device connections answered locally because the SEMS portal was unreachable.",
+	})
+	queueForwardedFramesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "queue_forwarded_frames_total",
+		Help: "Count of queued frames forwarded to the SEMS portal.",
+	})
+	queueNackedFramesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "queue_nacked_frames_total",
+		Help: "Count of queued frames forwarded to the SEMS portal which it replied to with a nack.",
+	})
+)
+
+// forwardQueue periodically forwards the frames in the queue upstream, until
+// ctx is cancelled.
+func (s *Server) forwardQueue(
+	ctx context.Context,
+	log *slog.Logger,
+	dialer *upstreamDialer,
+) {
+	ticker := time.NewTicker(queueRetryInterval)
+	defer ticker.Stop()
+	for {
+		if s.queue.Len() > 0 {
+			if err := s.drainQueue(ctx, log, dialer); err != nil {
+				log.Warn("couldn't forward queued frames", slog.Any("error", err))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// drainQueue forwards the frames in the queue upstream in order over a single
+// connection. Each frame is removed from the queue once SEMS replies, or
+// queueReplyTimeout passes without a reply.
+func (s *Server) drainQueue(
+	ctx context.Context,
+	log *slog.Logger,
+	dialer *upstreamDialer,
+) error {
+	upstream, err := dialer.DialContext(ctx, log)
+	if err != nil {
+		return fmt.Errorf("couldn't dial upstream: %v", err)
+	}
+	defer upstream.Close()
+	log.Info("forwarding queued frames", slog.Int("frames", s.queue.Len()))
+	reader := bufio.NewReader(upstream)
+	for ctx.Err() == nil {
+		frame, err := s.queue.Peek()
+		if err != nil {
+			return fmt.Errorf("couldn't read queue: %v", err)
+		}
+		if frame == nil {
+			log.Info("forwarded queued frames")
+			return nil
+		}
+		if err = upstream.SetDeadline(time.Now().Add(queueReplyTimeout)); err != nil {
+			return fmt.Errorf("couldn't set deadline: %v", err)
+		}
+		if _, err = upstream.Write(frame); err != nil {
+			return fmt.Errorf("couldn't send queued frame: %v", err)
+		}
+		// wait for the reply, so that SEMS isn't flooded
+		nack, err := readQueueReply(log, reader, frame)
+		if err != nil {
+			return err
+		}
+		if err = s.queue.Pop(); err != nil {
+			return fmt.Errorf("couldn't remove queued frame: %v", err)
+		}
+		if nack {
+			log.Warn("SEMS nacked queued frame", slog.Any("frame", frame))
+			queueNackedFramesTotal.Inc()
+		} else {
+			queueForwardedFramesTotal.Inc()
+		}
+	}
+	return nil
+}
+
+// readQueueReply reads from reader until the reply to the given queued
+// outbound frame arrives, and returns true if it is a nack. The reply is the
+// inbound frame with the same packet type as the queued frame. Other frames
+// such as time sync responses are skipped. If the read deadline passes
+// without a reply, the frame is assumed to have been received.
+func readQueueReply(
+	log *slog.Logger,
+	reader *bufio.Reader,
+	frame []byte,
+) (bool, error) {
+	var outHeader OutboundHeader
+	err := outHeader.UnmarshalBinary(frame[:binary.Size(outHeader)])
+	if err != nil {
+		return false, fmt.Errorf("couldn't unmarshal queued frame header: %v", err)
+	}
+	for {
+		reply, err := readPacket(reader, inboundPrefix)
+		var framingErr *FramingError
+		switch {
+		case errors.As(err, &framingErr):
+			log.Debug("skipped invalid reply data", slog.Any("error", err))
+			continue
+		case err != nil:
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Debug("no reply to queued frame")
+				return false, nil
+			}
+			return false, fmt.Errorf("couldn't read reply: %v", err)
+		}
+		var inHeader InboundHeader
+		headerSize := binary.Size(inHeader)
+		if err = inHeader.UnmarshalBinary(reply[:headerSize]); err != nil {
+			return false, fmt.Errorf("couldn't unmarshal reply header: %v", err)
+		}
+		if PacketType(inHeader.PacketType) != outHeader.PacketType {
+			continue
+		}
+		var ack InboundMetricsAckPacket
+		if err = ack.UnmarshalBinary(reply[headerSize : len(reply)-2]); err != nil {
+			// not a metrics ack, so not a nack
+			return false, nil
+		}
+		return bytes.Equal(ack.Data[:], metricsNackData), nil
+	}
+}
+
+// enqueue adds an outbound frame to the queue, if any.
+func enqueue(log *slog.Logger, q *queue.Queue, frame []byte) {
+	if q == nil {
+		return
+	}
+	if err := q.Push(frame); err != nil {
+		log.Warn("couldn't queue frame", slog.Any("error", err))
+	}
+}
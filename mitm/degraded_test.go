@@ -0,0 +1,174 @@
+package mitm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/smlx/goodwe/queue"
+)
+
+// freeAddr returns a local address which nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	assert.NoError(t, l.Close())
+	return addr
+}
+
+func TestServeDegraded(t *testing.T) {
+	q, err := queue.Open(t.TempDir(), 0)
+	assert.NoError(t, err)
+	defer q.Close()
+	listenAddr := freeAddr(t)
+	s, err := NewServer(false, true,
+		WithListenAddr(listenAddr),
+		WithUpstreamHost(freeAddr(t)),
+		WithQueue(q))
+	assert.NoError(t, err)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(ctx, log)
+	}()
+	var conn net.Conn
+	for range 50 {
+		if conn, err = net.Dial("tcp", listenAddr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	defer conn.Close()
+	// the device is answered locally
+	frame := outboundSeeds(t)[0]
+	_, err = conn.Write(frame)
+	assert.NoError(t, err)
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	ack, err := readPacket(bufio.NewReader(conn), inboundPrefix)
+	assert.NoError(t, err)
+	assert.NoError(t, validateCRC(ack, inboundCRCByteOrder))
+	// and its frame is queued
+	assert.Equal(t, 1, q.Len())
+	queued, err := q.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, frame, queued)
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestDrainQueue(t *testing.T) {
+	frames := outboundSeeds(t)
+	// reply functions for the fake SEMS
+	ack := func(frame []byte) ([]byte, error) {
+		responses, err := emulatedResponses(frame, time.Now())
+		return bytes.Join(responses, nil), err
+	}
+	nack := func(frame []byte) ([]byte, error) {
+		frame = bytes.Clone(frame)
+		frame[len(frame)-1] ^= 0xff // invalid CRC
+		return ack(frame)
+	}
+	var testCases = map[string]struct {
+		reply           func([]byte) ([]byte, error)
+		expectError     bool
+		expectForwarded int
+		expectNacked    int
+	}{
+		"ack": {
+			reply:           ack,
+			expectForwarded: len(frames),
+		},
+		"nack": {
+			reply:        nack,
+			expectNacked: len(frames),
+		},
+		"invalid data before ack": {
+			reply: func(frame []byte) ([]byte, error) {
+				reply, err := ack(frame)
+				return append([]byte{0x00, 0x01}, reply...), err
+			},
+			expectForwarded: len(frames),
+		},
+		"closed": {
+			reply: func([]byte) ([]byte, error) {
+				return nil, io.EOF
+			},
+			expectError: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			q, err := queue.Open(tt.TempDir(), 0)
+			assert.NoError(tt, err, name)
+			defer q.Close()
+			for _, frame := range frames {
+				assert.NoError(tt, q.Push(frame), name)
+			}
+			s, err := NewServer(false, true, WithQueue(q))
+			assert.NoError(tt, err, name)
+			// start a fake SEMS which replies to each frame
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.NoError(tt, err, name)
+			defer l.Close()
+			received := make(chan []byte, len(frames))
+			go func() {
+				defer close(received)
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					frame, err := readPacket(reader, outboundPrefix)
+					if err != nil {
+						return
+					}
+					received <- frame
+					reply, err := tc.reply(frame)
+					if err != nil {
+						return
+					}
+					if _, err = conn.Write(reply); err != nil {
+						return
+					}
+				}
+			}()
+			dialer, err := newUpstreamDialer(l.Addr().String(), 0)
+			assert.NoError(tt, err, name)
+			log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			forwarded := counterValue(tt, queueForwardedFramesTotal)
+			nacked := counterValue(tt, queueNackedFramesTotal)
+			err = s.drainQueue(context.Background(), log, dialer)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+				// the unanswered frame is still queued
+				assert.Equal(tt, len(frames), q.Len(), name)
+			} else {
+				assert.NoError(tt, err, name)
+				assert.Equal(tt, 0, q.Len(), name)
+			}
+			assert.Equal(tt, forwarded+float64(tc.expectForwarded),
+				counterValue(tt, queueForwardedFramesTotal), name)
+			assert.Equal(tt, nacked+float64(tc.expectNacked),
+				counterValue(tt, queueNackedFramesTotal), name)
+			// frames are forwarded in order
+			var i int
+			for frame := range received {
+				assert.Equal(tt, frames[i], frame, name)
+				i++
+			}
+		})
+	}
+}
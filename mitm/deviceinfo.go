@@ -0,0 +1,47 @@
+package mitm
+
+import (
+	"maps"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	deviceInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goodwe_device_info",
+		Help: "Device identity reported in time sync packets. Always 1.",
+	}, []string{"serial", "model", "firmware", "long_serial", "server_addr"})
+	deviceFirmwareChangesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "goodwe_device_firmware_changes_total",
+		Help: "Count of firmware version changes reported by the device.",
+	}, labelNames)
+)
+
+// observeDeviceInfo records the device identity reported in a time sync
+// packet. It must be called with o.mu held.
+func (o *PrometheusObserver) observeDeviceInfo(e TimeSyncEvent) {
+	labels := e.labels()
+	info := prometheus.Labels{
+		"serial":      e.Serial,
+		"model":       e.Device.Model,
+		"firmware":    e.Firmware,
+		"long_serial": e.LongSerial,
+		"server_addr": e.ServerAddr,
+	}
+	key := labelKey(labelValues(labels))
+	if prev, ok := o.info[key]; ok {
+		if !maps.Equal(prev, info) {
+			// replace the old series so that there is only one per device
+			deviceInfo.Delete(prev)
+		}
+		if prev["firmware"] != info["firmware"] {
+			deviceFirmwareChangesTotal.With(labels).Inc()
+		}
+	} else {
+		// initialise the counter so that the first change can be detected
+		deviceFirmwareChangesTotal.With(labels)
+	}
+	o.info[key] = info
+	deviceInfo.With(info).Set(1)
+}
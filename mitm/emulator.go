@@ -0,0 +1,240 @@
+package mitm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/smlx/goodwe"
+	"github.com/smlx/goodwe/queue"
+)
+
+const (
+	// interval between keepalives sent by the emulator. The real interval used
+	// by SEMS is not known.
+	keepAliveInterval = time.Minute
+)
+
+var (
+	// meterTimeSyncRespData is the fixed prefix of the meter time sync response
+	// cleartext.
+	meterTimeSyncRespData = [4]byte{0x12, 0x16, 0x12, 0x18}
+	// inverterTimeSyncRespData is the fixed prefix of the inverter time sync
+	// response cleartext. Captured responses have a null prefix.
+	inverterTimeSyncRespData = [4]byte{}
+)
+
+// inboundIV returns the IV used by SEMS in inbound packets. This is the
+// timestamp in reverse (s m H D M Y), followed by null bytes.
+func inboundIV(ts Timestamp) [16]byte {
+	var iv [16]byte
+	for i := range ts {
+		iv[i] = ts[len(ts)-1-i]
+	}
+	return iv
+}
+
+// marshalInboundPacket wraps the given body in an inbound header and CRC.
+func marshalInboundPacket(packetType PacketType, body []byte) ([]byte, error) {
+	header := InboundHeader{
+		GW:         [2]byte(inboundPrefix),
+		Length:     uint32(len(body) + 1), // off-by-one
+		PacketType: packetType,
+	}
+	packet, err := header.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't marshal header: %v", err)
+	}
+	packet = append(packet, body...)
+	return inboundCRCByteOrder.AppendUint16(packet, goodwe.CRC(packet)), nil
+}
+
+// metricsAckPacket returns a full inbound metrics ack packet with the given
+// packet type and payload.
+func metricsAckPacket(
+	packetType PacketType,
+	env *OutboundEnvelopeTS,
+	ackData []byte,
+	now time.Time,
+) ([]byte, error) {
+	ack := InboundMetricsAckPacket{
+		InboundEnvelope: InboundEnvelope{
+			DeviceID:     env.DeviceID,
+			DeviceSerial: env.DeviceSerial,
+			IV:           inboundIV(NewTimestamp(now)),
+		},
+		InboundMetricsAck: InboundMetricsAck{
+			Data: [16]byte(ackData),
+		},
+	}
+	body, err := ack.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't marshal metrics ack: %v", err)
+	}
+	return marshalInboundPacket(packetType, body)
+}
+
+// timeSyncRespPacket returns a full inbound time sync response packet of the
+// given packet type containing the given time.
+func timeSyncRespPacket(
+	packetType PacketType,
+	respData [4]byte,
+	env *OutboundEnvelopeTS,
+	now time.Time,
+) ([]byte, error) {
+	ts := NewTimestamp(now)
+	resp := InboundTimeSyncRespPacket{
+		InboundEnvelope: InboundEnvelope{
+			DeviceID:     env.DeviceID,
+			DeviceSerial: env.DeviceSerial,
+			IV:           inboundIV(ts),
+		},
+		InboundTimeSyncResp: InboundTimeSyncResp{
+			PacketType: respData,
+			Timestamp:  ts,
+		},
+	}
+	body, err := resp.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't marshal time sync response: %v", err)
+	}
+	return marshalInboundPacket(packetType, body)
+}
+
+// emulatedResponses returns the inbound packets which SEMS would send in reply
+// to the given outbound packet. It returns no packets if no reply is
+// expected.
+func emulatedResponses(data []byte, now time.Time) ([][]byte, error) {
+	header := OutboundHeader{}
+	env := OutboundEnvelopeTS{}
+	headerSize := binary.Size(header)
+	if len(data) < headerSize+binary.Size(env)+2 {
+		return nil, fmt.Errorf("packet too short: %d", len(data))
+	}
+	if err := header.UnmarshalBinary(data[:headerSize]); err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal header: %v", err)
+	}
+	switch header.PacketType {
+	case meterTimeSync, inverterTimeSync:
+	default:
+		// time sync response acks are not acknowledged, and unknown packets
+		// are ignored.
+		if !isMetricsPacket(header.PacketType) {
+			return nil, nil
+		}
+	}
+	err := binary.Read(bytes.NewBuffer(data[headerSize:]), binary.BigEndian, &env)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal envelope: %v", err)
+	}
+	// SEMS replies to a corrupted packet with a nack
+	if err = validateCRC(data, outboundCRCByteOrder); err != nil {
+		nack, err := metricsAckPacket(header.PacketType, &env, metricsNackData, now)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't construct metrics nack: %v", err)
+		}
+		return [][]byte{nack}, nil
+	}
+	switch header.PacketType {
+	case inverterTimeSync:
+		// the inverter time sync response shares the packet type of the time
+		// sync request, so it is the only reply.
+		resp, err := timeSyncRespPacket(
+			inverterTimeSyncResp, inverterTimeSyncRespData, &env, now)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't construct time sync response: %v", err)
+		}
+		return [][]byte{resp}, nil
+	}
+	// other packets are acknowledged using the packet type of the outbound
+	// packet
+	ack, err := metricsAckPacket(header.PacketType, &env, metricsAckData, now)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't construct metrics ack: %v", err)
+	}
+	switch header.PacketType {
+	case meterTimeSync:
+		resp, err := timeSyncRespPacket(
+			meterTimeSyncResp, meterTimeSyncRespData, &env, now)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't construct time sync response: %v", err)
+		}
+		return [][]byte{ack, resp}, nil
+	default:
+		return [][]byte{ack}, nil
+	}
+}
+
+// emulateUpstream replies to the outbound packets read from conn in place of
+// the SEMS portal, and occasionally sends a keepalive. If q is not nil, valid
+// outbound frames are added to it to be forwarded to SEMS later.
+func emulateUpstream(
+	ctx context.Context,
+	log *slog.Logger,
+	conn net.Conn,
+	q *queue.Queue,
+) error {
+	var reader = newFrameReader(conn, outboundPrefix, frameTimeout)
+	lastKeepAlive := time.Now()
+	for {
+		if ctx.Err() != nil {
+			return nil // context cancelled
+		}
+		if time.Since(lastKeepAlive) > keepAliveInterval {
+			if _, err := conn.Write(keepAlive); err != nil {
+				return fmt.Errorf("couldn't send keepalive: %v", err)
+			}
+			lastKeepAlive = time.Now()
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+			if errors.Is(err, io.ErrClosedPipe) {
+				log.Debug("emulator socket closed")
+				return nil
+			}
+			return fmt.Errorf("couldn't set read deadline: %v", err)
+		}
+		data, err := reader.readPacket()
+		var framingErr *FramingError
+		switch {
+		case errors.As(err, &framingErr):
+			// SEMS replies to a corrupted packet with a nack
+			if framingErr.Reason != framingErrorCRC {
+				log.Debug("emulator skipped invalid data", slog.Any("error", err))
+				continue
+			}
+		case err != nil:
+			// handle read timeout
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue // reached deadline
+			}
+			// return without error on closed socket
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) ||
+				errors.Is(err, syscall.ECONNRESET) {
+				log.Debug("emulator read socket closed")
+				return nil
+			}
+			return fmt.Errorf("couldn't read: %v", err)
+		default:
+			enqueue(log, q, data)
+		}
+		responses, err := emulatedResponses(data, timeNow())
+		if err != nil {
+			log.Warn("emulator couldn't respond to packet",
+				slog.Any("packet", data),
+				slog.Any("error", err))
+			continue
+		}
+		for _, resp := range responses {
+			if _, err = conn.Write(resp); err != nil {
+				return fmt.Errorf("couldn't send emulated response: %v", err)
+			}
+		}
+	}
+}
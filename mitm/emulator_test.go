@@ -0,0 +1,161 @@
+package mitm
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestEmulatedResponses(t *testing.T) {
+	var testCases = map[string]struct {
+		input       []byte
+		expectTypes []PacketType
+		expectNack  bool
+	}{
+		"meter metrics": {
+			input: []byte{
+				0x50, 0x4f, 0x53, 0x54, 0x47, 0x57, 0x00, 0x00, 0x00, 0x99, 0x03, 0x04, 0x00, 0x00, 0x39, 0x31,
+				0x30, 0x30, 0x30, 0x48, 0x4b, 0x55, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x17, 0x09,
+				0x12, 0x09, 0x09, 0x1b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x17, 0x09,
+				0x12, 0x09, 0x09, 0x1b, 0xde, 0xde, 0x93, 0x57, 0xfe, 0x05, 0x28, 0x76, 0x42, 0xac, 0x63, 0xcf,
+				0xdd, 0x7a, 0xae, 0x6d, 0xca, 0x77, 0x85, 0xca, 0x23, 0x99, 0x4c, 0x72, 0x7d, 0x33, 0x59, 0x81,
+				0x3b, 0xc8, 0xf2, 0x37, 0x22, 0x69, 0x71, 0x9d, 0xc8, 0x46, 0x62, 0xa2, 0xc0, 0xef, 0xe7, 0x44,
+				0xb3, 0x58, 0x2a, 0x2f, 0xbd, 0x2f, 0x68, 0x4c, 0xe0, 0x98, 0x0b, 0x24, 0xbf, 0x04, 0xc4, 0x4f,
+				0xa8, 0x01, 0x81, 0x8c, 0xf6, 0x5f, 0x05, 0x52, 0x73, 0x86, 0x32, 0xaa, 0x16, 0xd2, 0x9f, 0xfe,
+				0x0e, 0x52, 0xb3, 0xcc, 0x9f, 0x0a, 0xaf, 0xef, 0x6d, 0x28, 0xce, 0xad, 0x52, 0xe7, 0x9f, 0x7f,
+				0x9b, 0xe3, 0x3c, 0xa0, 0x1b, 0x22, 0xc9, 0x59, 0x33, 0x04, 0xf2, 0x39, 0x8d, 0xd1, 0x20, 0xfc,
+				0x88, 0xaa, 0x1d, 0x99, 0x4b, 0xcd,
+			},
+			expectTypes: []PacketType{meterMetricsAck0},
+		},
+		"meter metrics bad CRC": {
+			input: []byte{
+				0x50, 0x4f, 0x53, 0x54, 0x47, 0x57, 0x00, 0x00, 0x00, 0x99, 0x03, 0x04, 0x00, 0x00, 0x39, 0x31,
+				0x30, 0x30, 0x30, 0x48, 0x4b, 0x55, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x17, 0x09,
+				0x12, 0x09, 0x09, 0x1b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x17, 0x09,
+				0x12, 0x09, 0x09, 0x1b, 0xde, 0xde, 0x93, 0x57, 0xfe, 0x05, 0x28, 0x76, 0x42, 0xac, 0x63, 0xcf,
+				0xdd, 0x7a, 0xae, 0x6d, 0xca, 0x77, 0x85, 0xca, 0x23, 0x99, 0x4c, 0x72, 0x7d, 0x33, 0x59, 0x81,
+				0x3b, 0xc8, 0xf2, 0x37, 0x22, 0x69, 0x71, 0x9d, 0xc8, 0x46, 0x62, 0xa2, 0xc0, 0xef, 0xe7, 0x44,
+				0xb3, 0x58, 0x2a, 0x2f, 0xbd, 0x2f, 0x68, 0x4c, 0xe0, 0x98, 0x0b, 0x24, 0xbf, 0x04, 0xc4, 0x4f,
+				0xa8, 0x01, 0x81, 0x8c, 0xf6, 0x5f, 0x05, 0x52, 0x73, 0x86, 0x32, 0xaa, 0x16, 0xd2, 0x9f, 0xfe,
+				0x0e, 0x52, 0xb3, 0xcc, 0x9f, 0x0a, 0xaf, 0xef, 0x6d, 0x28, 0xce, 0xad, 0x52, 0xe7, 0x9f, 0x7f,
+				0x9b, 0xe3, 0x3c, 0xa0, 0x1b, 0x22, 0xc9, 0x59, 0x33, 0x04, 0xf2, 0x39, 0x8d, 0xd1, 0x20, 0xfc,
+				0x88, 0xaa, 0x1d, 0x99, 0x4b, 0xce,
+			},
+			expectTypes: []PacketType{meterMetricsAck0},
+			expectNack:  true,
+		},
+		"meter time sync": {
+			input: []byte{
+				0x50, 0x4f, 0x53, 0x54, 0x47, 0x57, 0x00, 0x00, 0x00, 0x89, 0x03, 0x03, 0x00, 0x00, 0x39, 0x31,
+				0x30, 0x30, 0x30, 0x48, 0x4b, 0x55, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x17, 0x0a,
+				0x1e, 0x0e, 0x14, 0x11, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x17, 0x0a,
+				0x1e, 0x0e, 0x14, 0x11, 0x15, 0x03, 0x6e, 0x21, 0x65, 0xf4, 0x5c, 0xfb, 0x95, 0x7f, 0xc0, 0x74,
+				0x5c, 0xd0, 0x0a, 0x09, 0x62, 0x64, 0xa5, 0x98, 0x81, 0x05, 0xda, 0x21, 0xcd, 0x1c, 0xae, 0x60,
+				0x90, 0x2f, 0xde, 0x42, 0x5e, 0x93, 0x24, 0x23, 0xd1, 0x4c, 0x7a, 0xa2, 0xc7, 0xe4, 0xbb, 0xfd,
+				0xd4, 0xdb, 0xb3, 0x43, 0x3b, 0x34, 0x1a, 0x63, 0x0c, 0x8b, 0xc4, 0x74, 0x6e, 0xb4, 0x39, 0x66,
+				0x44, 0x0d, 0xa5, 0xe0, 0xc0, 0x07, 0xf8, 0x29, 0xec, 0x50, 0x61, 0xf5, 0x4c, 0x6d, 0x4c, 0x15,
+				0x6e, 0x14, 0x00, 0x9f, 0x43, 0x82, 0x63, 0xca, 0xd6, 0x4f, 0x3f, 0x98, 0x07, 0x3f, 0x9e, 0xcb,
+				0x94, 0xe2, 0xd9, 0x6c, 0xf9, 0x69,
+			},
+			expectTypes: []PacketType{meterMetricsAck2, meterTimeSyncResp},
+		},
+		"inverter time sync": {
+			// the last seed is an inverter time sync packet
+			input:       outboundSeeds(t)[3],
+			expectTypes: []PacketType{inverterTimeSyncResp},
+		},
+		"meter time sync response ack": {
+			input: []byte{
+				0x50, 0x4f, 0x53, 0x54, 0x47, 0x57, 0x00, 0x00, 0x00, 0x31, 0x03, 0x10, 0x39, 0x31, 0x30, 0x30,
+				0x30, 0x48, 0x4b, 0x55, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x17, 0x0b, 0x05, 0x0e,
+				0x0c, 0x38, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xcb, 0xef, 0x10, 0xd3,
+				0x6c, 0x1e, 0xa8, 0x34, 0x83, 0x2b, 0x7b, 0x7d, 0x9a, 0x1b, 0x22, 0x16, 0x03, 0xb6,
+			},
+			expectTypes: nil,
+		},
+	}
+	ctx := context.Background()
+	log := slog.New(slog.NewJSONHandler(os.Stderr,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	ph := NewInboundPacketHandler(defaultRegistry(t), Observers{})
+	now := time.Date(2023, time.November, 5, 19, 14, 18, 0, time.UTC)
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			responses, err := emulatedResponses(tc.input, now)
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, len(tc.expectTypes), len(responses), name)
+			for i, resp := range responses {
+				// the responses must be valid inbound packets
+				_, err = ph.HandlePacket(ctx, log, resp)
+				assert.NoError(tt, err, name)
+				header := InboundHeader{}
+				assert.NoError(tt, header.UnmarshalBinary(resp[:8]), name)
+				assert.Equal(tt, tc.expectTypes[i], PacketType(header.PacketType), name)
+				deviceSerial, err := deviceSerialInbound(resp)
+				assert.NoError(tt, err, name)
+				assert.Equal(tt, []byte(testDeviceSerial), deviceSerial, name)
+				switch PacketType(header.PacketType) {
+				case meterTimeSyncResp, inverterTimeSyncResp:
+					var timeSyncResp InboundTimeSyncRespPacket
+					assert.NoError(tt, timeSyncResp.UnmarshalBinary(resp[8:len(resp)-2]))
+					assert.True(tt, now.Equal(timeSyncResp.Timestamp.Time()),
+						"expected: %v, got %v", now, timeSyncResp.Timestamp.Time())
+				default:
+					var metricsAck InboundMetricsAckPacket
+					assert.NoError(tt, metricsAck.UnmarshalBinary(resp[8:len(resp)-2]))
+					if tc.expectNack {
+						assert.Equal(tt, metricsNackData, metricsAck.Data[:], name)
+					} else {
+						assert.Equal(tt, metricsAckData, metricsAck.Data[:], name)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEmulateUpstream(t *testing.T) {
+	input := []byte{
+		0x50, 0x4f, 0x53, 0x54, 0x47, 0x57, 0x00, 0x00, 0x00, 0x99, 0x03, 0x04, 0x00, 0x00, 0x39, 0x31,
+		0x30, 0x30, 0x30, 0x48, 0x4b, 0x55, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x17, 0x09,
+		0x12, 0x09, 0x09, 0x1b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x17, 0x09,
+		0x12, 0x09, 0x09, 0x1b, 0xde, 0xde, 0x93, 0x57, 0xfe, 0x05, 0x28, 0x76, 0x42, 0xac, 0x63, 0xcf,
+		0xdd, 0x7a, 0xae, 0x6d, 0xca, 0x77, 0x85, 0xca, 0x23, 0x99, 0x4c, 0x72, 0x7d, 0x33, 0x59, 0x81,
+		0x3b, 0xc8, 0xf2, 0x37, 0x22, 0x69, 0x71, 0x9d, 0xc8, 0x46, 0x62, 0xa2, 0xc0, 0xef, 0xe7, 0x44,
+		0xb3, 0x58, 0x2a, 0x2f, 0xbd, 0x2f, 0x68, 0x4c, 0xe0, 0x98, 0x0b, 0x24, 0xbf, 0x04, 0xc4, 0x4f,
+		0xa8, 0x01, 0x81, 0x8c, 0xf6, 0x5f, 0x05, 0x52, 0x73, 0x86, 0x32, 0xaa, 0x16, 0xd2, 0x9f, 0xfe,
+		0x0e, 0x52, 0xb3, 0xcc, 0x9f, 0x0a, 0xaf, 0xef, 0x6d, 0x28, 0xce, 0xad, 0x52, 0xe7, 0x9f, 0x7f,
+		0x9b, 0xe3, 0x3c, 0xa0, 0x1b, 0x22, 0xc9, 0x59, 0x33, 0x04, 0xf2, 0x39, 0x8d, 0xd1, 0x20, 0xfc,
+		0x88, 0xaa, 0x1d, 0x99, 0x4b, 0xcd,
+	}
+	log := slog.New(slog.NewJSONHandler(os.Stderr,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	ctx, cancel := context.WithTimeout(context.Background(), 4*readTimeout)
+	defer cancel()
+	client, emulator := net.Pipe()
+	defer client.Close()
+	done := make(chan error)
+	go func() {
+		defer emulator.Close()
+		done <- emulateUpstream(ctx, log, emulator, nil)
+	}()
+	// send a metrics packet and expect an ack
+	_, err := client.Write(input)
+	assert.NoError(t, err)
+	assert.NoError(t, client.SetReadDeadline(time.Now().Add(2*readTimeout)))
+	ack, err := readPacket(bufio.NewReader(client), inboundPrefix)
+	assert.NoError(t, err)
+	ph := NewInboundPacketHandler(defaultRegistry(t), Observers{})
+	_, err = ph.HandlePacket(ctx, log, ack)
+	assert.NoError(t, err)
+	// closing the client causes the emulator to exit cleanly
+	assert.NoError(t, client.Close())
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,207 @@
+package mitm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/smlx/goodwe/capture"
+)
+
+const (
+	// maxFrameSize is the maximum size of a frame, including the prefix and
+	// CRC. The largest known frame is an 790 byte inverter time sync packet.
+	maxFrameSize = 2048
+	// frameTimeout is how long the start of a frame may be buffered before the
+	// frame is considered truncated. It allows for TCP retransmission of the
+	// rest of the frame.
+	frameTimeout = 10 * time.Second
+)
+
+// framing error reasons, used as metric label values
+const (
+	framingErrorPrefix    = "prefix"
+	framingErrorLength    = "length"
+	framingErrorCRC       = "crc"
+	framingErrorTruncated = "truncated"
+)
+
+var (
+	inboundFramingErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "inbound_framing_errors_total",
+		Help: "Count of inbound data skipped while resynchronising on the next frame.",
+	}, []string{"reason"})
+	outboundFramingErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_framing_errors_total",
+		Help: "Count of outbound data skipped while resynchronising on the next frame.",
+	}, []string{"reason"})
+)
+
+// FramingError is returned by readPacket along with the data skipped while
+// resynchronising on the next frame.
+type FramingError struct {
+	// Reason is why the data was skipped: the prefix didn't match, the length
+	// in the header was implausible, the frame was still incomplete after
+	// frameTimeout, or the CRC was invalid.
+	Reason string
+	// Skipped is the number of bytes skipped.
+	Skipped int
+}
+
+// Error implements the error interface.
+func (e *FramingError) Error() string {
+	return fmt.Sprintf("skipped %d bytes: invalid frame %s", e.Skipped, e.Reason)
+}
+
+// crcByteOrder returns the byte order of the CRC in frames with the given
+// prefix.
+func crcByteOrder(packetPrefix []byte) binary.ByteOrder {
+	if direction(packetPrefix) == capture.DirectionOutbound {
+		return outboundCRCByteOrder
+	}
+	return inboundCRCByteOrder
+}
+
+// frameSize returns the size of the frame starting with header, which must
+// contain at least the prefix and length, or zero if the length is
+// implausible.
+func frameSize(header []byte, prefix []byte) int {
+	length := binary.BigEndian.Uint32(header[len(prefix):])
+	// the body size is length-1, so length must be at least 1
+	if length < 1 || length > maxFrameSize {
+		return 0
+	}
+	size := int(length) +
+		len(prefix) + 4 + // prefix and length
+		2 + // CRC
+		1 // off-by-one error in header length :-/
+	if size > maxFrameSize {
+		return 0
+	}
+	return size
+}
+
+// frameStart returns true if data may be the start of a frame with the given
+// prefix. That is, data starts with the prefix followed by a plausible
+// length, or is too short to tell.
+func frameStart(data []byte, prefix []byte) bool {
+	if len(data) < len(prefix) {
+		return bytes.HasPrefix(prefix, data)
+	}
+	if !bytes.HasPrefix(data, prefix) {
+		return false
+	}
+	return len(data) < len(prefix)+4 || frameSize(data, prefix) > 0
+}
+
+// readPacket reads a full frame from r, using the header length immediately
+// after the prefix to know how much to read. The frame is only returned if
+// its CRC is valid. Otherwise readPacket skips to the start of the next
+// plausible frame, and returns the skipped data with a *FramingError. Other
+// errors, including read timeouts, are returned from r, in which case no data
+// is consumed.
+//
+// r must have a buffer of at least maxFrameSize bytes.
+func readPacket(r *bufio.Reader, prefix []byte) ([]byte, error) {
+	header, err := r.Peek(len(prefix) + 4)
+	if err != nil {
+		return nil, err
+	}
+	var reason string
+	switch size := frameSize(header, prefix); {
+	case !bytes.HasPrefix(header, prefix):
+		reason = framingErrorPrefix
+	case size == 0:
+		reason = framingErrorLength
+	default:
+		frame, err := r.Peek(size)
+		if err != nil {
+			return nil, err
+		}
+		if validateCRC(frame, crcByteOrder(prefix)) == nil {
+			frame = bytes.Clone(frame)
+			_, _ = r.Discard(size)
+			return frame, nil
+		}
+		reason = framingErrorCRC
+	}
+	return skipFrame(r, prefix, reason)
+}
+
+// skipFrame discards the buffered data in r up to the start of the next
+// plausible frame, and returns the skipped data with a *FramingError with the
+// given reason.
+func skipFrame(r *bufio.Reader, prefix []byte, reason string) ([]byte, error) {
+	buf, _ := r.Peek(r.Buffered())
+	skip := len(buf)
+	for i := 1; i < len(buf); i++ {
+		if frameStart(buf[i:], prefix) {
+			skip = i
+			break
+		}
+	}
+	data := bytes.Clone(buf[:skip])
+	_, _ = r.Discard(skip)
+	return data, &FramingError{Reason: reason, Skipped: skip}
+}
+
+// frameReader reads frames from a connection with read deadlines. A frame
+// which spans a read deadline is kept buffered until it is complete, or until
+// it has been buffered for longer than timeout, when it is skipped as
+// truncated.
+type frameReader struct {
+	*bufio.Reader
+	prefix  []byte
+	timeout time.Duration
+	// partial is when the buffered start of a frame was first seen, or zero if
+	// none is buffered.
+	partial time.Time
+}
+
+// newFrameReader returns a frameReader for frames with the given prefix read
+// from conn.
+func newFrameReader(
+	conn net.Conn,
+	prefix []byte,
+	timeout time.Duration,
+) *frameReader {
+	return &frameReader{
+		Reader:  bufio.NewReader(conn),
+		prefix:  prefix,
+		timeout: timeout,
+	}
+}
+
+// readPacket behaves like the readPacket function, except that a frame which
+// is still incomplete after the timeout is skipped with a *FramingError.
+func (fr *frameReader) readPacket() ([]byte, error) {
+	data, err := readPacket(fr.Reader, fr.prefix)
+	netErr, ok := err.(net.Error)
+	if !ok || !netErr.Timeout() || fr.Buffered() == 0 {
+		fr.partial = time.Time{}
+		return data, err
+	}
+	switch {
+	case fr.partial.IsZero():
+		fr.partial = time.Now()
+	case time.Since(fr.partial) > fr.timeout:
+		fr.partial = time.Time{}
+		return skipFrame(fr.Reader, fr.prefix, framingErrorTruncated)
+	}
+	return nil, err
+}
+
+// countFramingError increments the framing error metric for the direction of
+// frames with the given prefix.
+func countFramingError(packetPrefix []byte, err *FramingError) {
+	if direction(packetPrefix) == capture.DirectionOutbound {
+		outboundFramingErrorsTotal.WithLabelValues(err.Reason).Inc()
+	} else {
+		inboundFramingErrorsTotal.WithLabelValues(err.Reason).Inc()
+	}
+}
@@ -0,0 +1,162 @@
+package mitm
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestReadPacketResync(t *testing.T) {
+	valid := testFrame(inboundPrefix, meterTimeSyncResp, inboundCRCByteOrder)
+	invalidCRC := bytes.Clone(valid)
+	invalidCRC[len(invalidCRC)-1] ^= 0xff
+	oversize := append([]byte{}, inboundPrefix...)
+	oversize = append(oversize, 0x00, 0x00, 0x10, 0x00)
+	type read struct {
+		packet []byte
+		reason string
+	}
+	var testCases = map[string]struct {
+		input  []byte
+		expect []read
+	}{
+		"valid frame": {
+			input:  valid,
+			expect: []read{{packet: valid}},
+		},
+		"junk before frame": {
+			input: append([]byte{0x00, 0x47, 0x01}, valid...),
+			expect: []read{
+				{packet: []byte{0x00, 0x47, 0x01}, reason: framingErrorPrefix},
+				{packet: valid},
+			},
+		},
+		"implausible length": {
+			input: append(bytes.Clone(oversize), valid...),
+			expect: []read{
+				{packet: oversize, reason: framingErrorLength},
+				{packet: valid},
+			},
+		},
+		"invalid CRC": {
+			input: append(bytes.Clone(invalidCRC), valid...),
+			expect: []read{
+				{packet: invalidCRC, reason: framingErrorCRC},
+				{packet: valid},
+			},
+		},
+		"prefix without plausible length": {
+			input: append([]byte{0x47, 0x57, 0xff, 0xff, 0xff, 0xff}, valid...),
+			expect: []read{
+				{
+					packet: []byte{0x47, 0x57, 0xff, 0xff, 0xff, 0xff},
+					reason: framingErrorLength,
+				},
+				{packet: valid},
+			},
+		},
+		"partial prefix at end": {
+			input: []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x47},
+			expect: []read{
+				{
+					packet: []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+					reason: framingErrorPrefix,
+				},
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			r := bufio.NewReaderSize(bytes.NewReader(tc.input), maxFrameSize)
+			for _, expect := range tc.expect {
+				packet, err := readPacket(r, inboundPrefix)
+				assert.Equal(tt, expect.packet, packet, name)
+				if expect.reason == "" {
+					assert.NoError(tt, err, name)
+					continue
+				}
+				var framingErr *FramingError
+				assert.True(tt, errors.As(err, &framingErr), name)
+				assert.Equal(tt, expect.reason, framingErr.Reason, name)
+				assert.Equal(tt, len(expect.packet), framingErr.Skipped, name)
+			}
+			_, err := readPacket(r, inboundPrefix)
+			assert.Error(tt, err, name)
+		})
+	}
+}
+
+// timeoutReader returns each of reads in turn, with a read timeout error
+// after each one. Once reads is exhausted it only returns read timeouts.
+type timeoutReader struct {
+	reads   [][]byte
+	timeout bool
+}
+
+// Read implements io.Reader.
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	if r.timeout || len(r.reads) == 0 {
+		r.timeout = false
+		return 0, os.ErrDeadlineExceeded
+	}
+	n := copy(p, r.reads[0])
+	r.reads = r.reads[1:]
+	r.timeout = true
+	return n, nil
+}
+
+func TestFrameReader(t *testing.T) {
+	valid := inboundSeeds(t)[0]
+	var testCases = map[string]struct {
+		reads        [][]byte
+		timeout      time.Duration
+		expectPacket []byte
+		expectReason string
+	}{
+		"frame spans deadline": {
+			reads:        [][]byte{valid[:10], valid[10:]},
+			timeout:      time.Minute,
+			expectPacket: valid,
+		},
+		"truncated frame": {
+			reads:        [][]byte{valid[:10]},
+			expectPacket: valid[:10],
+			expectReason: framingErrorTruncated,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			fr := frameReader{
+				Reader:  bufio.NewReader(&timeoutReader{reads: tc.reads}),
+				prefix:  inboundPrefix,
+				timeout: tc.timeout,
+			}
+			var packet []byte
+			var err error
+			for range 4 {
+				packet, err = fr.readPacket()
+				if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+					break
+				}
+				// the partial frame is kept until the timeout
+				assert.Equal(tt, 10, fr.Buffered(), name)
+				time.Sleep(time.Millisecond)
+			}
+			assert.Equal(tt, tc.expectPacket, packet, name)
+			if tc.expectReason == "" {
+				assert.NoError(tt, err, name)
+				return
+			}
+			var framingErr *FramingError
+			assert.True(tt, errors.As(err, &framingErr), name)
+			assert.Equal(tt, tc.expectReason, framingErr.Reason, name)
+			assert.Equal(tt, 0, fr.Buffered(), name)
+		})
+	}
+}
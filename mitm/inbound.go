@@ -1,15 +1,16 @@
 package mitm
 
 import (
-	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"log/slog"
 	"slices"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/smlx/goodwe/capture"
 )
 
 var (
@@ -44,45 +45,64 @@ var (
 )
 
 // handleMetricsAckPacket handles metrics ack packet envelope and ciphertext.
-func handleMetricsAckPacket(
-	data []byte,
+func (h *InboundPacketHandler) handleMetricsAckPacket(
+	ctx context.Context,
 	log *slog.Logger,
+	packetType PacketType,
+	data []byte,
 ) error {
 	var metricsAck InboundMetricsAckPacket
 	err := metricsAck.UnmarshalBinary(data)
 	if err != nil {
 		return fmt.Errorf("couldn't unmarshal metrics ack: %v", err)
 	}
-	devInfo, ok := deviceInfo[metricsAck.DeviceID]
-	if !ok {
-		return fmt.Errorf("unknown device ID: %v", metricsAck.DeviceID)
+	// an unknown device doesn't stop the ack being forwarded, but there is no
+	// device information for the event.
+	devInfo, err := h.registry.lookup(metricsAck.DeviceID)
+	if err != nil {
+		log.Warn("skipping metrics ack event", slog.Any("error", err))
+		return nil
+	}
+	event := MetricsAckEvent{
+		Source: Source{
+			Device: devInfo,
+			Serial: string(metricsAck.DeviceSerial[:]),
+		},
+		PacketType: packetType,
+		Data:       metricsAck.Data,
 	}
 	switch {
 	case slices.Equal(metricsAck.Data[:], metricsAckData):
+		event.Status = AckStatusAck
 		log.Debug("metrics ack",
-			slog.String("device", devInfo[0]),
-			slog.String("model", devInfo[1]),
+			slog.String("device", devInfo.Type),
+			slog.String("model", devInfo.Model),
 			slog.String("serial", string(metricsAck.DeviceSerial[:])))
 	case slices.Equal(metricsAck.Data[:], metricsNackData):
+		event.Status = AckStatusNack
 		log.Warn("metrics nack. bad metrics CRC?",
-			slog.String("device", devInfo[0]),
-			slog.String("model", devInfo[1]),
+			slog.String("device", devInfo.Type),
+			slog.String("model", devInfo.Model),
 			slog.String("serial", string(metricsAck.DeviceSerial[:])))
 	default:
+		event.Status = AckStatusUnknown
 		log.Warn("unknown cleartext in metrics ack",
 			slog.Any("cleartext", metricsAck.Data[:]),
-			slog.String("device", devInfo[0]),
-			slog.String("model", devInfo[1]),
+			slog.String("device", devInfo.Type),
+			slog.String("model", devInfo.Model),
 			slog.String("serial", string(metricsAck.DeviceSerial[:])))
 	}
+	h.observer.Observe(ctx, event)
 	return nil
 }
 
 // handleTimeSyncRespPacket handles time sync response packet envelope and
 // ciphertext.
-func handleTimeSyncRespPacket(
-	data []byte,
+func (h *InboundPacketHandler) handleTimeSyncRespPacket(
+	ctx context.Context,
 	log *slog.Logger,
+	packetType PacketType,
+	data []byte,
 ) error {
 	var timeSyncResp InboundTimeSyncRespPacket
 	err := timeSyncResp.UnmarshalBinary(data)
@@ -91,38 +111,70 @@ func handleTimeSyncRespPacket(
 	}
 	log.Debug("inbound time sync response",
 		slog.Time("responseTimestamp", timeSyncResp.Timestamp.Time()))
+	// an unknown device doesn't stop the response being forwarded, but there is
+	// no device information for the event.
+	devInfo, err := h.registry.lookup(timeSyncResp.DeviceID)
+	if err != nil {
+		log.Warn("skipping time sync response event", slog.Any("error", err))
+		return nil
+	}
+	h.observer.Observe(ctx, TimeSyncRespEvent{
+		Source: Source{
+			Device: devInfo,
+			Serial: string(timeSyncResp.DeviceSerial[:]),
+		},
+		PacketType: packetType,
+		Timestamp:  timeSyncResp.Timestamp.Time(),
+	})
 	return nil
 }
 
 // handleUnknownInboundPacket decrypts and logs the cleartext of an
 // unrecognized inbound packet.
-func handleUnknownInboundPacket(
-	data []byte,
+func (h *InboundPacketHandler) handleUnknownInboundPacket(
+	ctx context.Context,
 	log *slog.Logger,
+	packetType PacketType,
+	frame []byte,
+	data []byte,
 ) error {
 	log.Info("unknown packet", slog.Any("data", data))
-	inboundUnknownPacketsTotal.Inc()
+	event := UnknownPacketEvent{
+		Direction:  capture.DirectionInbound,
+		PacketType: packetType,
+		Frame:      frame,
+	}
+	defer func() { h.observer.Observe(ctx, event) }()
 	envelope := InboundEnvelope{}
-	envData, bodyData := data[:binary.Size(envelope)], data[binary.Size(envelope):]
-	envBuf := bytes.NewBuffer(envData)
-	err := binary.Read(envBuf, binary.BigEndian, &envelope)
+	ciphertext, err := unmarshalEnvelope(data, &envelope)
 	if err != nil {
 		return fmt.Errorf("couldn't unmarshal envelope %T: %v", envelope, err)
 	}
-	cleartext, err := decryptCiphertext(envelope.IV[:], bodyData)
+	cleartext, err := decryptCiphertext(envelope.IV[:], ciphertext)
 	if err != nil {
 		return fmt.Errorf("couldn't decrypt ciphertext: %v", err)
 	}
+	event.Cleartext = cleartext
 	log.Info("unknown packet cleartext", slog.Any("cleartext", cleartext))
 	return nil
 }
 
 // InboundPacketHandler is a PacketHandler for inbound packets.
-type InboundPacketHandler struct{}
+type InboundPacketHandler struct {
+	registry *Registry
+	observer Observer
+}
 
-// NewInboundPacketHandler constructs an InboundPacketHandler.
-func NewInboundPacketHandler() *InboundPacketHandler {
-	return &InboundPacketHandler{}
+// NewInboundPacketHandler constructs an InboundPacketHandler which publishes
+// events to the given observer.
+func NewInboundPacketHandler(
+	registry *Registry,
+	observer Observer,
+) *InboundPacketHandler {
+	return &InboundPacketHandler{
+		registry: registry,
+		observer: observer,
+	}
 }
 
 // HandlePacket implements the PacketHandler interface.
@@ -136,6 +188,13 @@ func (h *InboundPacketHandler) HandlePacket(
 	}
 	// slice up the header and body, and discard CRC bytes
 	header := InboundHeader{}
+	if len(data) < binary.Size(header)+2 {
+		return nil, &TruncatedError{
+			Type: "frame",
+			Need: binary.Size(header) + 2,
+			Got:  len(data),
+		}
+	}
 	headerData, bodyData :=
 		data[:binary.Size(header)], data[binary.Size(header):len(data)-2]
 	if err := header.UnmarshalBinary(headerData); err != nil {
@@ -150,18 +209,24 @@ func (h *InboundPacketHandler) HandlePacket(
 	switch header.PacketType {
 	case meterMetricsAck0, meterMetricsAck1, meterMetricsAck2,
 		inverterMetricsAck0, inverterMetricsAck1:
-		if err := handleMetricsAckPacket(bodyData, log); err != nil {
+		err := h.handleMetricsAckPacket(ctx, log, header.PacketType, bodyData)
+		if err != nil {
 			return nil, fmt.Errorf("couldn't handle metrics ack packet: %v", err)
 		}
 		return nil, nil
 	case meterTimeSyncResp, inverterTimeSyncResp:
-		if err := handleTimeSyncRespPacket(bodyData, log); err != nil {
+		err := h.handleTimeSyncRespPacket(ctx, log, header.PacketType, bodyData)
+		if err != nil {
 			return nil,
 				fmt.Errorf("couldn't handle time sync response packet: %v", err)
 		}
 		return nil, nil
 	default:
-		if err := handleUnknownInboundPacket(bodyData, log); err != nil {
+		// log the full frame so it can be passed to the decode command
+		log = log.With(slog.String("frame", hex.EncodeToString(data)))
+		err := h.handleUnknownInboundPacket(ctx, log, header.PacketType, data,
+			bodyData)
+		if err != nil {
 			return nil, fmt.Errorf("couldn't handle unknown packet: %v", err)
 		}
 		return nil, fmt.Errorf("unknown packet type")
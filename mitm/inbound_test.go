@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -77,7 +78,7 @@ func TestHandleInboundPacket(t *testing.T) {
 	ctx := context.Background()
 	log := slog.New(slog.NewJSONHandler(os.Stderr,
 		&slog.HandlerOptions{Level: slog.LevelDebug}))
-	ph := NewInboundPacketHandler()
+	ph := NewInboundPacketHandler(defaultRegistry(t), Observers{})
 	for name, tc := range testCases {
 		t.Run(name, func(tt *testing.T) {
 			_, err := ph.HandlePacket(ctx, log, tc.input)
@@ -94,6 +95,20 @@ func TestHandleInboundPacket(t *testing.T) {
 	}
 }
 
+func TestHandleInboundPacketUnknownDevice(t *testing.T) {
+	// inbound packets for devices missing from the registry are still handled
+	// so that they are forwarded.
+	ctx := context.Background()
+	log := slog.New(slog.NewJSONHandler(os.Stderr,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	ph := NewInboundPacketHandler(
+		&Registry{devices: map[DeviceID]Device{}}, Observers{})
+	for _, frame := range inboundSeeds(t) {
+		_, err := ph.HandlePacket(ctx, log, frame)
+		assert.NoError(t, err)
+	}
+}
+
 func TestHandleInbound(t *testing.T) {
 	var testCases = map[string]struct {
 		input               []byte
@@ -156,7 +171,7 @@ func TestHandleInbound(t *testing.T) {
 				0x3d, 0x40, 0x77, 0x88, 0xca, 0x68, 0xe0, 0xd7, 0xdb, 0x43,
 			},
 			expectForward:       true,
-			expectForwardOffset: 0x64,
+			expectForwardOffset: 0x2a,
 		},
 		"invalid packet bitflip followed by valid packet": {
 			input: []byte{
@@ -214,9 +229,11 @@ func TestHandleInbound(t *testing.T) {
 				return err
 			})
 			// test the function
-			mitmSrv := NewServer(false)
+			mitmSrv, err := NewServer(false, true)
+			assert.NoError(tt, err, name)
 			assert.NoError(tt, mitmSrv.handleConn(ctx, log, upstreamRead, clientWrite,
-				inboundPrefix, false, NewInboundPacketHandler()), name)
+				inboundPrefix, DefaultInboundPolicy,
+				NewInboundPacketHandler(mitmSrv.registry, mitmSrv.observers)), name)
 			if err := eg.Wait(); err != nil {
 				tt.Fatal(err)
 			}
@@ -231,6 +248,10 @@ func TestHandleInbound(t *testing.T) {
 			testBuf := bufio.NewReader(bytes.NewBuffer(tc.input))
 			packet, err := readPacket(testBuf, inboundPrefix)
 			for ; len(packet) > 0; packet, err = readPacket(testBuf, inboundPrefix) {
+				var framingErr *FramingError
+				if errors.As(err, &framingErr) {
+					continue
+				}
 				assert.NoError(tt, err, name)
 				if err = validateCRC(packet, inboundCRCByteOrder); err == nil {
 					deviceSerial, err = deviceSerialInbound(packet)
@@ -245,3 +266,36 @@ func TestHandleInbound(t *testing.T) {
 		})
 	}
 }
+
+// inboundSeeds returns valid inbound frames, for use as a fuzzing corpus.
+func inboundSeeds(tb testing.TB) [][]byte {
+	tb.Helper()
+	env := OutboundEnvelopeTS{
+		DeviceID:     [8]byte([]byte("91000HKU")),
+		DeviceSerial: [8]byte([]byte(testDeviceSerial)),
+	}
+	now := time.Date(2023, time.November, 26, 22, 4, 33, 0, time.UTC)
+	ack, err := metricsAckPacket(meterMetricsAck0, &env, metricsAckData, now)
+	assert.NoError(tb, err)
+	timeSyncResp, err := timeSyncRespPacket(
+		meterTimeSyncResp, meterTimeSyncRespData, &env, now)
+	assert.NoError(tb, err)
+	env.DeviceID = [8]byte([]byte("53000DSC"))
+	inverterTimeSyncResp, err := timeSyncRespPacket(
+		inverterTimeSyncResp, inverterTimeSyncRespData, &env, now)
+	assert.NoError(tb, err)
+	return [][]byte{ack, timeSyncResp, inverterTimeSyncResp}
+}
+
+func FuzzHandleInboundPacket(f *testing.F) {
+	for _, frame := range inboundSeeds(f) {
+		f.Add(frame)
+	}
+	observer, err := NewPrometheusObserver(MetricStyleBoth, 0, StaleActionDelete)
+	assert.NoError(f, err)
+	ph := NewInboundPacketHandler(defaultRegistry(f), observer)
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = ph.HandlePacket(context.Background(), log, data)
+	})
+}
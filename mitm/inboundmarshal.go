@@ -24,8 +24,7 @@ func (h *InboundHeader) MarshalBinary() ([]byte, error) {
 
 // UnmarshalBinary implements binary.Unmarshaler
 func (h *InboundHeader) UnmarshalBinary(data []byte) error {
-	buf := bytes.NewBuffer(data)
-	return binary.Read(buf, binary.BigEndian, h)
+	return unmarshalFixed(data, h)
 }
 
 // InboundEnvelope is the plaintext wrapper around the ciphertext.
@@ -47,28 +46,37 @@ type InboundMetricsAckPacket struct {
 	InboundMetricsAck
 }
 
-// UnmarshalBinary implements binary.Unmarshaler
-func (p *InboundMetricsAckPacket) UnmarshalBinary(data []byte) error {
-	envData, bodyData := data[:binary.Size(p.InboundEnvelope)],
-		data[binary.Size(p.InboundEnvelope):]
-	envBuf := bytes.NewBuffer(envData)
-	err := binary.Read(envBuf, binary.BigEndian, &p.InboundEnvelope)
+// MarshalBinary implements binary.Marshaler
+func (p *InboundMetricsAckPacket) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	// marshal envelope
+	err := binary.Write(&buf, binary.BigEndian, p.InboundEnvelope)
 	if err != nil {
-		return fmt.Errorf("couldn't read unmarshal %T: %v", p.InboundEnvelope, err)
+		return nil, fmt.Errorf("couldn't marshal %T: %v", p.InboundEnvelope, err)
 	}
-	cleartext, err := decryptCiphertext(p.IV[:], bodyData)
+	// marshal ack
+	var cleartextBuf bytes.Buffer
+	err = binary.Write(&cleartextBuf, binary.BigEndian, p.InboundMetricsAck)
 	if err != nil {
-		return fmt.Errorf("couldn't decrypt ciphertext: %v", err)
+		return nil, fmt.Errorf("couldn't marshal %T: %v", p.InboundMetricsAck, err)
 	}
-	if len(cleartext) != binary.Size(p.InboundMetricsAck) {
-		return fmt.Errorf("invalid cleartext length: %d", len(cleartext))
+	// encrypt ack
+	ciphertext, err := encryptCleartext(p.IV[:], cleartextBuf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encrypt metrics ack: %v", err)
 	}
-	buf := bytes.NewBuffer(cleartext)
-	err = binary.Read(buf, binary.BigEndian, &p.InboundMetricsAck)
+	// ignore error since it is defined to always be nil
+	_, _ = buf.Write(ciphertext)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements binary.Unmarshaler
+func (p *InboundMetricsAckPacket) UnmarshalBinary(data []byte) error {
+	ciphertext, err := unmarshalEnvelope(data, &p.InboundEnvelope)
 	if err != nil {
-		return fmt.Errorf("couldn't read cleartext: %v", err)
+		return err
 	}
-	return nil
+	return unmarshalCleartext(p.IV[:], ciphertext, &p.InboundMetricsAck)
 }
 
 // InboundTimeSyncResp is the cleartext body of an inbound time sync packet.
@@ -85,26 +93,35 @@ type InboundTimeSyncRespPacket struct {
 	InboundTimeSyncResp
 }
 
-// UnmarshalBinary implements binary.Unmarshaler
-func (p *InboundTimeSyncRespPacket) UnmarshalBinary(data []byte) error {
-	envData, bodyData := data[:binary.Size(p.InboundEnvelope)],
-		data[binary.Size(p.InboundEnvelope):]
-	envBuf := bytes.NewBuffer(envData)
-	err := binary.Read(envBuf, binary.BigEndian, &p.InboundEnvelope)
+// MarshalBinary implements binary.Marshaler
+func (p *InboundTimeSyncRespPacket) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	// marshal envelope
+	err := binary.Write(&buf, binary.BigEndian, p.InboundEnvelope)
 	if err != nil {
-		return fmt.Errorf("couldn't read unmarshal %T: %v", p.InboundEnvelope, err)
+		return nil, fmt.Errorf("couldn't marshal %T: %v", p.InboundEnvelope, err)
 	}
-	cleartext, err := decryptCiphertext(p.IV[:], bodyData)
+	// marshal time sync response
+	var cleartextBuf bytes.Buffer
+	err = binary.Write(&cleartextBuf, binary.BigEndian, p.InboundTimeSyncResp)
 	if err != nil {
-		return fmt.Errorf("couldn't decrypt ciphertext: %v", err)
+		return nil, fmt.Errorf("couldn't marshal %T: %v", p.InboundTimeSyncResp, err)
 	}
-	if len(cleartext) != binary.Size(p.InboundTimeSyncResp) {
-		return fmt.Errorf("invalid cleartext length: %d", len(cleartext))
+	// encrypt time sync response
+	ciphertext, err := encryptCleartext(p.IV[:], cleartextBuf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encrypt time sync response: %v", err)
 	}
-	buf := bytes.NewBuffer(cleartext)
-	err = binary.Read(buf, binary.BigEndian, &p.InboundTimeSyncResp)
+	// ignore error since it is defined to always be nil
+	_, _ = buf.Write(ciphertext)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements binary.Unmarshaler
+func (p *InboundTimeSyncRespPacket) UnmarshalBinary(data []byte) error {
+	ciphertext, err := unmarshalEnvelope(data, &p.InboundEnvelope)
 	if err != nil {
-		return fmt.Errorf("couldn't read cleartext: %v", err)
+		return err
 	}
-	return nil
+	return unmarshalCleartext(p.IV[:], ciphertext, &p.InboundTimeSyncResp)
 }
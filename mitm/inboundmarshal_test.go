@@ -1,6 +1,7 @@
 package mitm
 
 import (
+	"encoding/binary"
 	"testing"
 
 	"github.com/alecthomas/assert/v2"
@@ -27,3 +28,16 @@ func TestUnmarshalMetricsAck(t *testing.T) {
 		})
 	}
 }
+
+func FuzzInboundUnmarshalBinary(f *testing.F) {
+	for _, frame := range inboundSeeds(f) {
+		f.Add(frame[binary.Size(InboundHeader{}) : len(frame)-2])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var header InboundHeader
+		_ = header.UnmarshalBinary(data)
+		for _, newPacket := range inboundPackets {
+			_ = newPacket().UnmarshalBinary(data)
+		}
+	})
+}
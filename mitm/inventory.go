@@ -0,0 +1,164 @@
+package mitm
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeviceStatus describes a device seen by the Inventory.
+type DeviceStatus struct {
+	Serial string `json:"serial"`
+	Type   string `json:"type"`
+	Model  string `json:"model"`
+	// FirstSeen and LastSeen are the times of the first and last packets
+	// received from the device.
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	// RemoteAddr is the address of the last connection from the device.
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	// ConnID is the ID of the active connection from the device, or empty if
+	// the device is not connected.
+	ConnID string `json:"connID,omitempty"`
+	// OutboundPackets and InboundPackets are the number of packets sent by
+	// and to the device, by packet type. Packet type values are reused
+	// between directions.
+	OutboundPackets map[PacketType]uint64 `json:"outboundPackets"`
+	InboundPackets  map[PacketType]uint64 `json:"inboundPackets"`
+	// Identity fields reported in time sync packets. See TimeSyncEvent.
+	Firmware   string `json:"firmware,omitempty"`
+	ServerAddr string `json:"serverAddr,omitempty"`
+	LongSerial string `json:"longSerial,omitempty"`
+}
+
+// Inventory is an Observer which keeps track of the devices which have
+// connected to the Server. It implements http.Handler, serving the device
+// list as JSON.
+type Inventory struct {
+	now func() time.Time
+
+	mu sync.Mutex
+	// conns are the remote addresses of open connections, by connection ID.
+	conns map[string]string
+	// devices are indexed by serial number.
+	devices map[string]*DeviceStatus
+}
+
+// NewInventory constructs an empty Inventory.
+func NewInventory() *Inventory {
+	return &Inventory{
+		now:     time.Now,
+		conns:   map[string]string{},
+		devices: map[string]*DeviceStatus{},
+	}
+}
+
+// Observe implements the Observer interface.
+func (inv *Inventory) Observe(ctx context.Context, e Event) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	switch e := e.(type) {
+	case ConnOpenEvent:
+		inv.conns[ConnID(ctx)] = e.RemoteAddr.String()
+	case ConnCloseEvent:
+		connID := ConnID(ctx)
+		delete(inv.conns, connID)
+		for _, d := range inv.devices {
+			if d.ConnID == connID {
+				d.ConnID = ""
+			}
+		}
+	case MetricsEvent:
+		inv.touch(ctx, e.Source, e.PacketType)
+	case TimeSyncEvent:
+		d := inv.touch(ctx, e.Source, e.PacketType)
+		if e.Firmware != "" {
+			d.Firmware = e.Firmware
+		}
+		if e.ServerAddr != "" {
+			d.ServerAddr = e.ServerAddr
+		}
+		if e.LongSerial != "" {
+			d.LongSerial = e.LongSerial
+		}
+	case TimeSyncRespAckEvent:
+		inv.touch(ctx, e.Source, e.PacketType)
+	case TimeSyncRespEvent:
+		inv.count(e.Source, e.PacketType)
+	case MetricsAckEvent:
+		inv.count(e.Source, e.PacketType)
+	}
+}
+
+// touch records a packet received from the device identified by source, and
+// returns its status. It must be called with inv.mu held.
+func (inv *Inventory) touch(
+	ctx context.Context,
+	source Source,
+	packetType PacketType,
+) *DeviceStatus {
+	serial := strings.TrimRight(source.Serial, "\x00")
+	now := inv.now()
+	d, ok := inv.devices[serial]
+	if !ok {
+		d = &DeviceStatus{
+			Serial:          serial,
+			FirstSeen:       now,
+			OutboundPackets: map[PacketType]uint64{},
+			InboundPackets:  map[PacketType]uint64{},
+		}
+		inv.devices[serial] = d
+	}
+	d.Type = source.Device.Type
+	d.Model = source.Device.Model
+	d.LastSeen = now
+	// replayed packets have no connection
+	if connID := ConnID(ctx); connID != "" {
+		d.ConnID = connID
+		d.RemoteAddr = inv.conns[connID]
+	}
+	d.OutboundPackets[packetType]++
+	return d
+}
+
+// count records a packet sent to the device identified by source, if it has
+// been seen before. It must be called with inv.mu held.
+func (inv *Inventory) count(source Source, packetType PacketType) {
+	if d, ok := inv.devices[strings.TrimRight(source.Serial, "\x00")]; ok {
+		d.InboundPackets[packetType]++
+	}
+}
+
+// Devices returns the status of all devices seen, sorted by serial number.
+func (inv *Inventory) Devices() []DeviceStatus {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	devices := make([]DeviceStatus, 0, len(inv.devices))
+	for _, d := range inv.devices {
+		status := *d
+		status.OutboundPackets = maps.Clone(d.OutboundPackets)
+		status.InboundPackets = maps.Clone(d.InboundPackets)
+		devices = append(devices, status)
+	}
+	slices.SortFunc(devices, func(a, b DeviceStatus) int {
+		return strings.Compare(a.Serial, b.Serial)
+	})
+	return devices
+}
+
+// ServeHTTP implements http.Handler.
+func (inv *Inventory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(inv.Devices())
+}
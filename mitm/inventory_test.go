@@ -0,0 +1,107 @@
+package mitm
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestInventory(t *testing.T) {
+	inv := NewInventory()
+	now := time.Date(2023, time.September, 18, 1, 9, 27, 0, time.UTC)
+	inv.now = func() time.Time { return now }
+	meter := Source{
+		Device: Device{Type: "meter", Model: "HomeKit 1000 Smart Meter"},
+		Serial: testDeviceSerial + "\x00\x00",
+	}
+	remoteAddr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	ctx := withConnID(context.Background(), "conn1")
+	inv.Observe(ctx, ConnOpenEvent{RemoteAddr: remoteAddr})
+	// packets sent to unknown devices are ignored
+	inv.Observe(ctx, TimeSyncRespEvent{Source: meter, PacketType: meterTimeSyncResp})
+	assert.Equal(t, 0, len(inv.Devices()))
+	inv.Observe(ctx, TimeSyncEvent{
+		Source:     meter,
+		PacketType: meterTimeSync,
+		Firmware:   "V18 V4",
+		ServerAddr: "20001,tcp.goodwe-power.com",
+		LongSerial: "02053-05-000Me05",
+	})
+	inv.Observe(ctx, TimeSyncRespEvent{Source: meter, PacketType: meterTimeSyncResp})
+	now = now.Add(time.Minute)
+	inv.Observe(ctx, MetricsEvent{Source: meter, PacketType: meterMetrics0})
+	inv.Observe(ctx, MetricsEvent{Source: meter, PacketType: meterMetrics0})
+	inv.Observe(ctx, MetricsAckEvent{Source: meter, PacketType: meterMetricsAck0})
+	expect := DeviceStatus{
+		Serial:     testDeviceSerial,
+		Type:       "meter",
+		Model:      "HomeKit 1000 Smart Meter",
+		FirstSeen:  now.Add(-time.Minute),
+		LastSeen:   now,
+		RemoteAddr: "192.0.2.1:40000",
+		ConnID:     "conn1",
+		OutboundPackets: map[PacketType]uint64{
+			meterTimeSync: 1,
+			meterMetrics0: 2,
+		},
+		InboundPackets: map[PacketType]uint64{
+			meterTimeSyncResp: 1,
+			meterMetricsAck0:  1,
+		},
+		Firmware:   "V18 V4",
+		ServerAddr: "20001,tcp.goodwe-power.com",
+		LongSerial: "02053-05-000Me05",
+	}
+	assert.Equal(t, []DeviceStatus{expect}, inv.Devices())
+	// the device disconnects
+	inv.Observe(ctx, ConnCloseEvent{RemoteAddr: remoteAddr})
+	expect.ConnID = ""
+	assert.Equal(t, []DeviceStatus{expect}, inv.Devices())
+	// check the HTTP API
+	rec := httptest.NewRecorder()
+	inv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/devices", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var devices []struct {
+		Serial          string            `json:"serial"`
+		LastSeen        string            `json:"lastSeen"`
+		ConnID          *string           `json:"connID"`
+		OutboundPackets map[string]uint64 `json:"outboundPackets"`
+		InboundPackets  map[string]uint64 `json:"inboundPackets"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &devices))
+	assert.Equal(t, 1, len(devices))
+	assert.Equal(t, testDeviceSerial, devices[0].Serial)
+	assert.Equal(t, "2023-09-18T01:10:27Z", devices[0].LastSeen)
+	assert.Zero(t, devices[0].ConnID)
+	assert.Equal(t, map[string]uint64{"0x0303": 1, "0x0304": 2},
+		devices[0].OutboundPackets)
+	assert.Equal(t, map[string]uint64{"0x0116": 1, "0x0304": 1},
+		devices[0].InboundPackets)
+	rec = httptest.NewRecorder()
+	inv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/devices", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestASCIIString(t *testing.T) {
+	var testCases = map[string]struct {
+		input  []byte
+		expect string
+	}{
+		"padding":     {input: []byte("20001,tcp.goodwe-power.com\x00\xff\xff"), expect: "20001,tcp.goodwe-power.com"},
+		"line breaks": {input: []byte("V18\r\nV4\r\n\x00\xff"), expect: "V18 V4"},
+		"no nul":      {input: []byte("02053-05-000Me05"), expect: "02053-05-000Me05"},
+		"empty":       {input: []byte("\x00V1"), expect: ""},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			assert.Equal(tt, tc.expect, asciiString(tc.input), name)
+		})
+	}
+}
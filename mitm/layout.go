@@ -0,0 +1,493 @@
+package mitm
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.yaml.in/yaml/v3"
+)
+
+// Stale behaviours of a LayoutField.
+const (
+	staleDelete = "delete"
+	staleZero   = "zero"
+	staleKeep   = "keep"
+)
+
+// layoutsYAML describes the built-in packet layouts. See the comment at the
+// top of the file for the format.
+//
+//go:embed layouts.yaml
+var layoutsYAML []byte
+
+var (
+	// layoutMetrics are the metrics registered for the fields of packet
+	// layouts, keyed by metric name.
+	layoutMetrics = map[string]*layoutMetric{}
+	// packetLayouts are the packet layouts keyed by layout name. They are the
+	// built-in layouts, unless others are loaded by LoadPacketLayouts. Their
+	// metrics are registered in the default registry.
+	packetLayouts = mustRegisterLayouts(layoutsYAML)
+)
+
+// PacketLayout describes the numeric fields in the cleartext of a packet.
+type PacketLayout struct {
+	// Types are the packet types which use this layout.
+	Types []PacketType `yaml:"types"`
+	// Cached are the packet types, of Types, which carry cached readings that
+	// the device was not able to send earlier.
+	Cached []PacketType `yaml:"cached"`
+	// Size of the cleartext in bytes.
+	Size   int           `yaml:"size"`
+	Fields []LayoutField `yaml:"fields"`
+}
+
+// LayoutField describes a single numeric field of a PacketLayout.
+type LayoutField struct {
+	Name     string  `yaml:"name"`
+	Offset   int     `yaml:"offset"`
+	Type     string  `yaml:"type"`
+	Endian   string  `yaml:"endian"`
+	Scale    float64 `yaml:"scale"`
+	Unit     string  `yaml:"unit"`
+	Metric   string  `yaml:"metric"`
+	SIMetric string  `yaml:"si_metric"`
+	Counter  bool    `yaml:"counter"`
+	Stale    string  `yaml:"stale"`
+	Help     string  `yaml:"help"`
+
+	// the following fields are set when the layout is validated
+	size    int
+	order   binary.ByteOrder
+	signed  bool
+	divisor float64
+	// the following fields are set when the metrics are registered
+	gauge   *prometheus.GaugeVec
+	siGauge *prometheus.GaugeVec
+	siTotal *totalVec
+}
+
+// Reading is a packet decoded according to a PacketLayout.
+type Reading struct {
+	Layout *PacketLayout
+	// Values are the raw field values keyed by field name.
+	Values map[string]int64
+}
+
+// fieldTypes maps field types to their size and signedness.
+var fieldTypes = map[string]struct {
+	size   int
+	signed bool
+}{
+	"int16":  {2, true},
+	"uint16": {2, false},
+	"int32":  {4, true},
+	"uint32": {4, false},
+}
+
+// validate the field, which must fit in a cleartext of the given size, and
+// set its unexported fields.
+func (f *LayoutField) validate(size int) error {
+	if f.Name == "" {
+		return fmt.Errorf("missing field name")
+	}
+	ft, ok := fieldTypes[f.Type]
+	if !ok {
+		return fmt.Errorf("field %s: invalid type %q", f.Name, f.Type)
+	}
+	f.size, f.signed = ft.size, ft.signed
+	if f.Offset < 0 || f.Offset+f.size > size {
+		return fmt.Errorf("field %s: offset %d out of range", f.Name, f.Offset)
+	}
+	switch f.Endian {
+	case "", "big":
+		f.order = binary.BigEndian
+	case "little":
+		f.order = binary.LittleEndian
+	default:
+		return fmt.Errorf("field %s: invalid endian %q", f.Name, f.Endian)
+	}
+	switch {
+	case f.Scale == 0:
+		f.Scale = 1
+	case f.Scale < 0:
+		return fmt.Errorf("field %s: negative scale", f.Name)
+	}
+	// Scales which are the reciprocal of an integer are applied by division,
+	// so that e.g. a scale of 0.1 converts 2403 decivolts to exactly 240.3
+	// volts.
+	if d := math.Round(1 / f.Scale); f.Scale < 1 && d*f.Scale == 1 {
+		f.divisor = d
+	}
+	if f.Metric == "" && (f.SIMetric != "" || f.Help != "") {
+		return fmt.Errorf("field %s: si_metric and help require metric", f.Name)
+	}
+	if f.Metric != "" && f.Scale != 1 && f.SIMetric == "" {
+		return fmt.Errorf("field %s: scaled metric requires si_metric", f.Name)
+	}
+	// only the SI metric is exported as a counter
+	if f.Counter && f.SIMetric == "" {
+		return fmt.Errorf("field %s: counter requires si_metric", f.Name)
+	}
+	// a 16 bit signed total wraps negative, which a counter must never be
+	if f.Counter && f.size == 2 && f.signed {
+		return fmt.Errorf("field %s: counter can't be %s", f.Name, f.Type)
+	}
+	switch f.Stale {
+	case "":
+		f.Stale = staleDelete
+		if f.Counter {
+			f.Stale = staleKeep
+		}
+	case staleDelete, staleZero, staleKeep:
+		if f.Counter && f.Stale != staleKeep {
+			return fmt.Errorf("field %s: counter must have stale %s",
+				f.Name, staleKeep)
+		}
+	default:
+		return fmt.Errorf("field %s: invalid stale %q", f.Name, f.Stale)
+	}
+	return nil
+}
+
+// validate the layout and its fields.
+func (l *PacketLayout) validate() error {
+	if len(l.Types) == 0 {
+		return fmt.Errorf("missing packet types")
+	}
+	for _, t := range l.Types {
+		if _, ok := outboundPackets[t]; ok {
+			return fmt.Errorf("%v: packet type %s isn't a metrics packet", l.Types,
+				t)
+		}
+	}
+	for _, t := range l.Cached {
+		if !slices.Contains(l.Types, t) {
+			return fmt.Errorf("%v: cached packet type %s isn't in types", l.Types,
+				t)
+		}
+	}
+	if l.Size <= 0 {
+		return fmt.Errorf("%v: invalid size %d", l.Types, l.Size)
+	}
+	used := make([]string, l.Size)
+	for i := range l.Fields {
+		f := &l.Fields[i]
+		if err := f.validate(l.Size); err != nil {
+			return fmt.Errorf("%v: %v", l.Types, err)
+		}
+		for j := f.Offset; j < f.Offset+f.size; j++ {
+			if used[j] != "" {
+				return fmt.Errorf("%v: field %s overlaps %s", l.Types, f.Name,
+					used[j])
+			}
+			used[j] = f.Name
+		}
+		for _, g := range l.Fields[:i] {
+			if g.Name == f.Name {
+				return fmt.Errorf("%v: duplicate field %s", l.Types, f.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// parseLayouts parses and validates packet layouts in YAML.
+func parseLayouts(data []byte) (map[string][]*PacketLayout, error) {
+	var pls map[string][]*PacketLayout
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&pls); err != nil {
+		return nil, fmt.Errorf("couldn't parse packet layouts: %v", err)
+	}
+	for name, ls := range pls {
+		if name == "" {
+			return nil, fmt.Errorf("missing layout name")
+		}
+		for i, l := range ls {
+			if err := l.validate(); err != nil {
+				return nil, fmt.Errorf("layout %s: %v", name, err)
+			}
+			for _, m := range ls[:i] {
+				for _, t := range l.Types {
+					if m.Size == l.Size && slices.Contains(m.Types, t) {
+						return nil, fmt.Errorf(
+							"layout %s: duplicate %d byte packet type %s",
+							name, l.Size, t)
+					}
+				}
+			}
+		}
+	}
+	return pls, nil
+}
+
+// layoutMetric is a metric registered for one or more layout fields.
+type layoutMetric struct {
+	help    string
+	counter bool
+	gauge   *prometheus.GaugeVec
+	total   *totalVec
+}
+
+// registerLayoutMetrics registers the metrics of the given layouts in the
+// default registry. Fields of different layouts, including layouts registered
+// earlier, may share a metric if they agree on its help and type. On error no
+// metrics are registered.
+func registerLayoutMetrics(pls map[string][]*PacketLayout) error {
+	added := map[string]*layoutMetric{}
+	if err := addLayoutMetrics(pls, added); err != nil {
+		for _, m := range added {
+			if m.gauge != nil {
+				prometheus.Unregister(m.gauge)
+			} else {
+				prometheus.Unregister(m.total)
+			}
+		}
+		return err
+	}
+	maps.Copy(layoutMetrics, added)
+	return nil
+}
+
+// addLayoutMetrics sets the metrics of the fields of the given layouts.
+// Metrics which aren't in layoutMetrics are registered and added to added.
+func addLayoutMetrics(
+	pls map[string][]*PacketLayout,
+	added map[string]*layoutMetric,
+) error {
+	// register returns the metric with the given name, registering it if
+	// required.
+	register := func(name, help string, counter bool) (*layoutMetric, error) {
+		m, ok := layoutMetrics[name]
+		if !ok {
+			m, ok = added[name]
+		}
+		if ok {
+			if m.help != help || m.counter != counter {
+				return nil, fmt.Errorf("conflicting definitions of metric %s", name)
+			}
+			return m, nil
+		}
+		m = &layoutMetric{help: help, counter: counter}
+		var c prometheus.Collector
+		if counter {
+			m.total = newTotalVec(name, help)
+			c = m.total
+		} else {
+			m.gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name: name,
+				Help: help,
+			}, labelNames)
+			c = m.gauge
+		}
+		if err := prometheus.Register(c); err != nil {
+			return nil, fmt.Errorf("couldn't register metric %s: %v", name, err)
+		}
+		added[name] = m
+		return m, nil
+	}
+	// register in layout name order so that any error is deterministic
+	for _, name := range slices.Sorted(maps.Keys(pls)) {
+		for _, l := range pls[name] {
+			for i := range l.Fields {
+				f := &l.Fields[i]
+				if f.Metric == "" {
+					continue
+				}
+				m, err := register(f.Metric, f.Help, false)
+				if err != nil {
+					return fmt.Errorf("layout %s: %v", name, err)
+				}
+				f.gauge = m.gauge
+				if f.SIMetric == "" {
+					continue
+				}
+				if m, err = register(f.SIMetric, f.Help, f.Counter); err != nil {
+					return fmt.Errorf("layout %s: %v", name, err)
+				}
+				f.siGauge, f.siTotal = m.gauge, m.total
+			}
+		}
+	}
+	return nil
+}
+
+// mustRegisterLayouts parses the given layouts and registers their metrics.
+// It panics on error, since the built-in layouts are known to be valid.
+func mustRegisterLayouts(data []byte) map[string][]*PacketLayout {
+	pls, err := parseLayouts(data)
+	if err != nil {
+		panic(err)
+	}
+	if err = registerLayoutMetrics(pls); err != nil {
+		panic(err)
+	}
+	return pls
+}
+
+// LoadPacketLayouts merges the packet layouts in the YAML file at the given
+// path over the built-in layouts, in the format of mitm/layouts.yaml. Layouts
+// in the file replace built-in layouts with the same name, and other layout
+// names may be used by devices in the device registry. The metrics of the
+// loaded layouts are registered in the default registry.
+//
+// LoadPacketLayouts must be called before any Registry or Server is
+// constructed.
+func LoadPacketLayouts(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("couldn't read packet layouts: %v", err)
+	}
+	pls, err := parseLayouts(data)
+	if err != nil {
+		return err
+	}
+	if err = registerLayoutMetrics(pls); err != nil {
+		return fmt.Errorf("invalid packet layouts: %v", err)
+	}
+	merged := maps.Clone(packetLayouts)
+	maps.Copy(merged, pls)
+	packetLayouts = merged
+	return nil
+}
+
+// PacketLayouts returns the built-in and loaded packet layouts keyed by
+// layout name.
+func PacketLayouts() map[string][]*PacketLayout {
+	return maps.Clone(packetLayouts)
+}
+
+// isMetricsPacket returns true if any packet layout describes the packet
+// type.
+func isMetricsPacket(packetType PacketType) bool {
+	for _, ls := range packetLayouts {
+		for _, l := range ls {
+			if slices.Contains(l.Types, packetType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decodeReading decodes the cleartext of a packet of the given type sent by a
+// device using the given layout.
+func decodeReading(
+	layout string,
+	packetType PacketType,
+	cleartext []byte,
+) (Reading, error) {
+	var sizes []int
+	for _, l := range packetLayouts[layout] {
+		if !slices.Contains(l.Types, packetType) {
+			continue
+		}
+		if l.Size == len(cleartext) {
+			return l.decode(cleartext), nil
+		}
+		sizes = append(sizes, l.Size)
+	}
+	if len(sizes) == 0 {
+		return Reading{}, fmt.Errorf("layout %s doesn't describe packet type %s",
+			layout, packetType)
+	}
+	return Reading{}, fmt.Errorf(
+		"no %s layout of packet type %s has a %d byte cleartext (known sizes: %v)",
+		layout, packetType, len(cleartext), sizes)
+}
+
+// decode the fields of cleartext, which must be l.Size bytes.
+func (l *PacketLayout) decode(cleartext []byte) Reading {
+	r := Reading{Layout: l, Values: make(map[string]int64, len(l.Fields))}
+	for _, f := range l.Fields {
+		data := cleartext[f.Offset : f.Offset+f.size]
+		var v int64
+		switch {
+		case f.size == 2 && f.signed:
+			v = int64(int16(f.order.Uint16(data)))
+		case f.size == 2:
+			v = int64(f.order.Uint16(data))
+		case f.signed:
+			v = int64(int32(f.order.Uint32(data)))
+		default:
+			v = int64(f.order.Uint32(data))
+		}
+		r.Values[f.Name] = v
+	}
+	return r
+}
+
+// Scaled returns the raw value converted to the field unit.
+func (f *LayoutField) Scaled(raw int64) float64 {
+	if f.divisor != 0 {
+		return float64(raw) / f.divisor
+	}
+	return float64(raw) * f.Scale
+}
+
+// observeReading records the metrics of each field of the reading.
+func (o *PrometheusObserver) observeReading(
+	labels prometheus.Labels,
+	r Reading,
+) {
+	if r.Layout == nil {
+		return
+	}
+	for i := range r.Layout.Fields {
+		f := &r.Layout.Fields[i]
+		raw, ok := r.Values[f.Name]
+		if !ok {
+			continue
+		}
+		if f.gauge != nil && (f.SIMetric == "" || o.style.legacy()) {
+			f.gauge.With(labels).Set(float64(raw))
+		}
+		if !o.style.si() {
+			continue
+		}
+		switch {
+		case f.siGauge != nil:
+			f.siGauge.With(labels).Set(f.Scaled(raw))
+		case f.siTotal != nil:
+			f.siTotal.Set(labels, f.Scaled(raw))
+		}
+	}
+}
+
+// layoutGauges returns the gauges of the fields of the given layouts with
+// one of the given stale behaviours, in the given style. If style is empty,
+// the gauges of all styles are returned.
+func layoutGauges(
+	pls []*PacketLayout,
+	style MetricStyle,
+	stale ...string,
+) []*prometheus.GaugeVec {
+	var gauges []*prometheus.GaugeVec
+	add := func(g *prometheus.GaugeVec) {
+		if g != nil && !slices.Contains(gauges, g) {
+			gauges = append(gauges, g)
+		}
+	}
+	for _, l := range pls {
+		for _, f := range l.Fields {
+			if !slices.Contains(stale, f.Stale) {
+				continue
+			}
+			if style == "" || f.SIMetric == "" || style.legacy() {
+				add(f.gauge)
+			}
+			if style == "" || style.si() {
+				add(f.siGauge)
+			}
+		}
+	}
+	return gauges
+}
@@ -0,0 +1,419 @@
+package mitm
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+// testReading is a helper function which returns a reading of the given
+// packet type with the given raw values, using the first matching built-in
+// layout.
+func testReading(
+	t *testing.T,
+	layout string,
+	packetType PacketType,
+	values map[string]int64,
+) Reading {
+	t.Helper()
+	for _, l := range packetLayouts[layout] {
+		if slices.Contains(l.Types, packetType) {
+			return Reading{Layout: l, Values: values}
+		}
+	}
+	t.Fatalf("no %s layout of packet type %s", layout, packetType)
+	return Reading{}
+}
+
+func TestLayoutsMatchStructs(t *testing.T) {
+	var testCases = map[string]struct {
+		layout     string
+		packetType PacketType
+		body       any
+	}{
+		"meter metrics": {
+			layout:     LayoutHomeKit1000,
+			packetType: meterMetrics0,
+			body:       OutboundMeterMetrics{},
+		},
+		"inverter metrics 0": {
+			layout:     LayoutDNSG3,
+			packetType: inverterMetrics0,
+			body:       OutboundInverterMetrics0{},
+		},
+		"inverter metrics 1": {
+			layout:     LayoutDNSG3,
+			packetType: inverterMetrics1,
+			body:       OutboundInverterMetrics1{},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			size := binary.Size(tc.body)
+			// decoding a zeroed cleartext of the struct size must succeed
+			r, err := decodeReading(tc.layout, tc.packetType, make([]byte, size))
+			assert.NoError(tt, err, name)
+			structFields := map[string]Field{}
+			for _, f := range fields(reflect.ValueOf(tc.body), "", 0) {
+				structFields[f.Name] = f
+			}
+			for _, f := range r.Layout.Fields {
+				sf, ok := structFields[f.Name]
+				assert.True(tt, ok, f.Name)
+				assert.Equal(tt, sf.Offset, f.Offset, f.Name)
+				assert.Equal(tt, sf.Type, f.Type, f.Name)
+			}
+		})
+	}
+}
+
+func TestDecodeReading(t *testing.T) {
+	pls, err := parseLayouts([]byte(`
+hk1000:
+- types: ["0x0304"]
+  size: 8
+  fields:
+  - {name: Big, offset: 0, type: int16}
+  - {name: Little, offset: 2, type: int16, endian: little}
+  - {name: Signed, offset: 4, type: int16}
+  - {name: Unsigned, offset: 6, type: uint16}
+`))
+	assert.NoError(t, err)
+	r := pls[LayoutHomeKit1000][0].decode(
+		[]byte{0x01, 0x02, 0x01, 0x02, 0xff, 0xfe, 0xff, 0xfe})
+	assert.Equal(t, map[string]int64{
+		"Big":      0x0102,
+		"Little":   0x0201,
+		"Signed":   -2,
+		"Unsigned": 0xfffe,
+	}, r.Values)
+	// the built-in layouts don't describe cleartext of an unknown size or
+	// packet type
+	_, err = decodeReading(LayoutHomeKit1000, meterMetrics0, make([]byte, 7))
+	assert.Error(t, err)
+	_, err = decodeReading(LayoutHomeKit1000, inverterMetrics0, make([]byte, 112))
+	assert.Error(t, err)
+}
+
+func TestScaled(t *testing.T) {
+	var testCases = map[string]struct {
+		scale  float64
+		raw    int64
+		expect float64
+	}{
+		"deci":  {scale: 0.1, raw: 2403, expect: 240.3},
+		"centi": {scale: 0.01, raw: 5002, expect: 50.02},
+		"hecto": {scale: 100, raw: 789, expect: 78900},
+		"unit":  {scale: 0, raw: -12, expect: -12},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			f := LayoutField{Name: "Test", Type: "int16", Scale: tc.scale}
+			assert.NoError(tt, f.validate(2), name)
+			assert.Equal(tt, tc.expect, f.Scaled(tc.raw), name)
+		})
+	}
+}
+
+func TestParseLayouts(t *testing.T) {
+	var testCases = map[string]struct {
+		input       string
+		expectError bool
+	}{
+		"valid": {
+			input: `
+hk1000:
+- types: ["0x0304", "0x0345"]
+  cached: ["0x0345"]
+  size: 4
+  fields:
+  - {name: A, offset: 0, type: int16, metric: a}
+  - {name: B, offset: 2, type: uint16, scale: 0.1, metric: b, si_metric: b_si}
+- types: ["0x0304"]
+  size: 6
+  fields:
+  - {name: A, offset: 4, type: int16, metric: a}
+`,
+		},
+		"invalid yaml": {
+			input:       "hk1000: [",
+			expectError: true,
+		},
+		"missing layout name": {
+			input: `
+"":
+- {types: ["0x0304"], size: 2}
+`,
+			expectError: true,
+		},
+		"invalid packet type": {
+			input: `
+hk1000:
+- {types: ["0x03"], size: 2}
+`,
+			expectError: true,
+		},
+		"time sync packet type": {
+			input: `
+hk1000:
+- {types: ["0x0303"], size: 2}
+`,
+			expectError: true,
+		},
+		"cached type not in types": {
+			input: `
+hk1000:
+- {types: ["0x0304"], cached: ["0x0345"], size: 2}
+`,
+			expectError: true,
+		},
+		"missing types": {
+			input: `
+hk1000:
+- {size: 2}
+`,
+			expectError: true,
+		},
+		"invalid size": {
+			input: `
+hk1000:
+- {types: ["0x0304"], size: 0}
+`,
+			expectError: true,
+		},
+		"invalid type": {
+			input: `
+hk1000:
+- types: ["0x0304"]
+  size: 2
+  fields: [{name: A, offset: 0, type: int8}]
+`,
+			expectError: true,
+		},
+		"out of range": {
+			input: `
+hk1000:
+- types: ["0x0304"]
+  size: 4
+  fields: [{name: A, offset: 2, type: int32}]
+`,
+			expectError: true,
+		},
+		"invalid endian": {
+			input: `
+hk1000:
+- types: ["0x0304"]
+  size: 2
+  fields: [{name: A, offset: 0, type: int16, endian: middle}]
+`,
+			expectError: true,
+		},
+		"negative scale": {
+			input: `
+hk1000:
+- types: ["0x0304"]
+  size: 2
+  fields: [{name: A, offset: 0, type: int16, scale: -1}]
+`,
+			expectError: true,
+		},
+		"scaled metric without si metric": {
+			input: `
+hk1000:
+- types: ["0x0304"]
+  size: 2
+  fields: [{name: A, offset: 0, type: int16, scale: 10, metric: a}]
+`,
+			expectError: true,
+		},
+		"si metric without metric": {
+			input: `
+hk1000:
+- types: ["0x0304"]
+  size: 2
+  fields: [{name: A, offset: 0, type: int16, si_metric: a}]
+`,
+			expectError: true,
+		},
+		"stale counter": {
+			input: `
+hk1000:
+- types: ["0x0304"]
+  size: 2
+  fields:
+  - {name: A, offset: 0, type: int32, metric: a, si_metric: a_si, counter: true, stale: zero}
+`,
+			expectError: true,
+		},
+		"signed 16 bit counter": {
+			input: `
+hk1000:
+- types: ["0x0304"]
+  size: 2
+  fields: [{name: A, offset: 0, type: int16, metric: a, si_metric: a_si, counter: true}]
+`,
+			expectError: true,
+		},
+		"counter without si metric": {
+			input: `
+hk1000:
+- types: ["0x0304"]
+  size: 4
+  fields: [{name: A, offset: 0, type: int32, metric: a, counter: true}]
+`,
+			expectError: true,
+		},
+		"invalid stale": {
+			input: `
+hk1000:
+- types: ["0x0304"]
+  size: 2
+  fields: [{name: A, offset: 0, type: int16, stale: forget}]
+`,
+			expectError: true,
+		},
+		"overlap": {
+			input: `
+hk1000:
+- types: ["0x0304"]
+  size: 4
+  fields:
+  - {name: A, offset: 0, type: int32}
+  - {name: B, offset: 2, type: int16}
+`,
+			expectError: true,
+		},
+		"duplicate field": {
+			input: `
+hk1000:
+- types: ["0x0304"]
+  size: 4
+  fields:
+  - {name: A, offset: 0, type: int16}
+  - {name: A, offset: 2, type: int16}
+`,
+			expectError: true,
+		},
+		"duplicate variant": {
+			input: `
+hk1000:
+- {types: ["0x0304", "0x0345"], size: 2}
+- {types: ["0x0345"], size: 2}
+`,
+			expectError: true,
+		},
+		"unknown key": {
+			input: `
+hk1000:
+- types: ["0x0304"]
+  size: 2
+  fields: [{name: A, offset: 0, type: int16, units: volts}]
+`,
+			expectError: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			_, err := parseLayouts([]byte(tc.input))
+			if tc.expectError {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+		})
+	}
+}
+
+func TestLoadPacketLayouts(t *testing.T) {
+	var testCases = map[string]struct {
+		input       string
+		expectError bool
+	}{
+		"new layout": {
+			input: `
+hk2000:
+- types: ["0x0304"]
+  size: 4
+  fields:
+  - {name: A, offset: 0, type: int32, metric: test_loaded_a, help: A.}
+`,
+		},
+		"shared metric": {
+			input: `
+hk2000:
+- types: ["0x0304"]
+  size: 4
+  fields:
+  - {name: A, offset: 0, type: int32, metric: test_loaded_a, help: A.}
+dns-g3:
+- types: ["0x0104"]
+  size: 4
+  fields:
+  - {name: A, offset: 0, type: int32, metric: test_loaded_a, help: A.}
+`,
+		},
+		"conflicting metric": {
+			input: `
+hk2000:
+- types: ["0x0304"]
+  size: 4
+  fields:
+  - {name: A, offset: 0, type: int32, metric: test_loaded_b, help: A.}
+dns-g3:
+- types: ["0x0104"]
+  size: 4
+  fields:
+  - {name: A, offset: 0, type: int32, metric: test_loaded_b, help: B.}
+`,
+			expectError: true,
+		},
+		"conflicting built-in metric": {
+			input: `
+hk2000:
+- types: ["0x0304"]
+  size: 4
+  fields:
+  - {name: A, offset: 0, type: int32, metric: device_up, help: A.}
+`,
+			expectError: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			builtin := packetLayouts
+			tt.Cleanup(func() { packetLayouts = builtin })
+			path := filepath.Join(tt.TempDir(), "layouts.yaml")
+			assert.NoError(tt, os.WriteFile(path, []byte(tc.input), 0600), name)
+			err := LoadPacketLayouts(path)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+				// no metrics are registered
+				_, ok := layoutMetrics["test_loaded_b"]
+				assert.False(tt, ok, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			// the built-in layouts are still known
+			_, err = decodeReading(LayoutHomeKit1000, meterMetrics0,
+				make([]byte, binary.Size(OutboundMeterMetrics{})))
+			assert.NoError(tt, err, name)
+			// devices may use the loaded layout
+			_, err = NewRegistry(Device{
+				ID:     DeviceID([]byte("92000HKU")),
+				Type:   "meter",
+				Model:  "HomeKit 2000 Smart Meter",
+				Layout: "hk2000",
+			})
+			assert.NoError(tt, err, name)
+			r, err := decodeReading("hk2000", meterMetrics0,
+				[]byte{0x00, 0x00, 0x01, 0x02})
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, int64(0x0102), r.Values["A"], name)
+		})
+	}
+}
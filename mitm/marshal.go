@@ -0,0 +1,95 @@
+package mitm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+)
+
+// TruncatedError is returned when data is too short to unmarshal.
+type TruncatedError struct {
+	// Type is the name of the type being unmarshalled.
+	Type string
+	// Need is the minimum length of data required.
+	Need int
+	// Got is the length of data.
+	Got int
+}
+
+// Error implements the error interface.
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("couldn't unmarshal %s: need at least %d bytes, got %d",
+		e.Type, e.Need, e.Got)
+}
+
+// LengthError is returned when the ciphertext or cleartext of a packet body
+// has an invalid length.
+type LengthError struct {
+	// Type is the name of the type being unmarshalled, or "ciphertext".
+	Type string
+	// Want is the required length, or zero if the length must be a multiple
+	// of the AES block size.
+	Want int
+	// Got is the length of data.
+	Got int
+}
+
+// Error implements the error interface.
+func (e *LengthError) Error() string {
+	if e.Want == 0 {
+		return fmt.Sprintf("invalid %s length %d: not a multiple of %d",
+			e.Type, e.Got, aes.BlockSize)
+	}
+	return fmt.Sprintf("invalid %s length: expected %d, got %d",
+		e.Type, e.Want, e.Got)
+}
+
+// CRCError is returned when the CRC of a frame doesn't match its contents.
+type CRCError struct {
+	Expected uint16
+	Got      uint16
+}
+
+// Error implements the error interface.
+func (e *CRCError) Error() string {
+	return fmt.Sprintf("CRC mismatch: expected %v, got %v", e.Expected, e.Got)
+}
+
+// typeName returns the name of the type pointed to by v.
+func typeName(v any) string {
+	return reflect.TypeOf(v).Elem().Name()
+}
+
+// unmarshalFixed reads data into v, which must be a pointer to a fixed-size
+// struct. Trailing bytes are ignored.
+func unmarshalFixed(data []byte, v any) error {
+	size := binary.Size(v)
+	if len(data) < size {
+		return &TruncatedError{Type: typeName(v), Need: size, Got: len(data)}
+	}
+	return binary.Read(bytes.NewReader(data[:size]), binary.BigEndian, v)
+}
+
+// unmarshalEnvelope reads the plaintext envelope at the start of data into
+// env, and returns the ciphertext following it.
+func unmarshalEnvelope(data []byte, env any) ([]byte, error) {
+	if err := unmarshalFixed(data, env); err != nil {
+		return nil, err
+	}
+	return data[binary.Size(env):], nil
+}
+
+// unmarshalCleartext decrypts ciphertext and reads the cleartext into body.
+// The cleartext must be exactly the size of body.
+func unmarshalCleartext(iv, ciphertext []byte, body any) error {
+	cleartext, err := decryptCiphertext(iv, ciphertext)
+	if err != nil {
+		return err
+	}
+	if size := binary.Size(body); len(cleartext) != size {
+		return &LengthError{Type: typeName(body), Want: size, Got: len(cleartext)}
+	}
+	return unmarshalFixed(cleartext, body)
+}
@@ -0,0 +1,78 @@
+package mitm
+
+import (
+	"encoding"
+	"errors"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestUnmarshalErrors(t *testing.T) {
+	meterMetrics := outboundSeeds(t)[0]
+	var testCases = map[string]struct {
+		packet          encoding.BinaryUnmarshaler
+		input           []byte
+		expectTruncated bool
+		expectString    string
+	}{
+		"empty envelope": {
+			packet:          &InboundMetricsAckPacket{},
+			input:           nil,
+			expectTruncated: true,
+			expectString:    "couldn't unmarshal InboundEnvelope: need at least 32 bytes, got 0",
+		},
+		"short envelope": {
+			packet:          &OutboundMeterMetricsPacket{},
+			input:           make([]byte, 20),
+			expectTruncated: true,
+			expectString:    "couldn't unmarshal OutboundEnvelopeTS: need at least 40 bytes, got 20",
+		},
+		"short header": {
+			packet:          &OutboundHeader{},
+			input:           outboundPrefix,
+			expectTruncated: true,
+			expectString:    "couldn't unmarshal OutboundHeader: need at least 12 bytes, got 6",
+		},
+		"partial block": {
+			packet:       &OutboundTimeSyncRespAckPacket{},
+			input:        make([]byte, 32+15),
+			expectString: "invalid ciphertext length 15: not a multiple of 16",
+		},
+		"wrong cleartext length": {
+			packet:       &InboundTimeSyncRespPacket{},
+			input:        make([]byte, 32+32),
+			expectString: "invalid InboundTimeSyncResp length: expected 16, got 32",
+		},
+		"truncated body": {
+			packet: &OutboundMeterMetricsPacket{},
+			// strip the header, the CRC and the last block of ciphertext
+			input:        meterMetrics[12 : len(meterMetrics)-2-16],
+			expectString: "invalid OutboundMeterMetrics length: expected 112, got 96",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			err := tc.packet.UnmarshalBinary(tc.input)
+			assert.Error(tt, err, name)
+			var truncatedErr *TruncatedError
+			var lengthErr *LengthError
+			if tc.expectTruncated {
+				assert.True(tt, errors.As(err, &truncatedErr), name)
+			} else {
+				assert.True(tt, errors.As(err, &lengthErr), name)
+			}
+			assert.EqualError(tt, err, tc.expectString, name)
+		})
+	}
+}
+
+func TestValidateCRC(t *testing.T) {
+	frame := inboundSeeds(t)[0]
+	assert.NoError(t, validateCRC(frame, inboundCRCByteOrder))
+	var crcErr *CRCError
+	assert.True(t, errors.As(validateCRC(frame, outboundCRCByteOrder), &crcErr))
+	var truncatedErr *TruncatedError
+	assert.True(t, errors.As(validateCRC(frame[:1], inboundCRCByteOrder),
+		&truncatedErr))
+}
@@ -0,0 +1,143 @@
+package mitm
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// number of frames buffered for each mirror before frames are dropped
+	mirrorBufferSize = 64
+	// interval between attempts to connect to an unreachable mirror
+	mirrorRetryInterval = 30 * time.Second
+)
+
+var (
+	mirrorSentFramesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mirror_sent_frames_total",
+		Help: "Count of outbound frames sent to a mirror.",
+	}, []string{"mirror"})
+	mirrorDroppedFramesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mirror_dropped_frames_total",
+		Help: "Count of outbound frames not sent to a mirror because it was unreachable or too slow.",
+	}, []string{"mirror"})
+)
+
+// mirror sends a copy of the outbound frames of a single device connection
+// to a secondary upstream. Replies from the mirror are discarded.
+type mirror struct {
+	addr   string
+	dialer *upstreamDialer
+	frames chan []byte
+}
+
+// send queues a copy of frame to be sent to the mirror without blocking. If
+// the mirror is too slow the frame is dropped.
+func (m *mirror) send(frame []byte) {
+	select {
+	case m.frames <- append([]byte{}, frame...):
+	default:
+		mirrorDroppedFramesTotal.WithLabelValues(m.addr).Inc()
+	}
+}
+
+// run sends queued frames to the mirror until ctx is cancelled. Errors are
+// logged and never returned, so that the mirror can't affect the primary
+// upstream connection.
+func (m *mirror) run(ctx context.Context, log *slog.Logger) {
+	var conn net.Conn
+	var retry time.Time
+	defer func() {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+	dropped := mirrorDroppedFramesTotal.WithLabelValues(m.addr)
+	for {
+		var frame []byte
+		select {
+		case <-ctx.Done():
+			return
+		case frame = <-m.frames:
+		}
+		if conn == nil {
+			if time.Now().Before(retry) {
+				dropped.Inc()
+				continue
+			}
+			var err error
+			conn, err = m.dialer.DialContext(ctx, log)
+			if err != nil {
+				log.Warn("couldn't dial mirror", slog.Any("error", err))
+				retry = time.Now().Add(mirrorRetryInterval)
+				dropped.Inc()
+				continue
+			}
+			// discard replies
+			go func(conn net.Conn) {
+				_, _ = io.Copy(io.Discard, conn)
+			}(conn)
+		}
+		err := conn.SetWriteDeadline(time.Now().Add(connTimeout))
+		if err == nil {
+			_, err = conn.Write(frame)
+		}
+		if err != nil {
+			log.Warn("couldn't send frame to mirror", slog.Any("error", err))
+			_ = conn.Close()
+			conn = nil
+			dropped.Inc()
+			continue
+		}
+		mirrorSentFramesTotal.WithLabelValues(m.addr).Inc()
+	}
+}
+
+// mirroredConn is an upstream connection which also sends everything written
+// to it to mirrors. Reads only come from the upstream connection.
+type mirroredConn struct {
+	net.Conn
+	mirrors []*mirror
+}
+
+// newMirroredConn wraps upstream, sending a copy of the frames written to it
+// to each of the given mirrors until ctx is cancelled.
+func newMirroredConn(
+	ctx context.Context,
+	log *slog.Logger,
+	wg *sync.WaitGroup,
+	upstream net.Conn,
+	dialers map[string]*upstreamDialer,
+) *mirroredConn {
+	c := mirroredConn{Conn: upstream}
+	for addr, dialer := range dialers {
+		m := mirror{
+			addr:   addr,
+			dialer: dialer,
+			frames: make(chan []byte, mirrorBufferSize),
+		}
+		c.mirrors = append(c.mirrors, &m)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.run(ctx, log.With(slog.String("mirror", addr)))
+		}()
+	}
+	return &c
+}
+
+// Write implements net.Conn. The mirrors receive a copy of p regardless of
+// the result of writing to the upstream connection.
+func (c *mirroredConn) Write(p []byte) (int, error) {
+	for _, m := range c.mirrors {
+		m.send(p)
+	}
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,88 @@
+package mitm
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestServeMirror(t *testing.T) {
+	// a mirror which records frames and replies with junk
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		frame, err := readPacket(bufio.NewReader(conn), outboundPrefix)
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("junk"))
+		received <- frame
+		// hold the connection open until the test completes
+		_, _ = conn.Read(make([]byte, 1))
+	}()
+	mirrorAddr := l.Addr().String()
+	unreachableAddr := freeAddr(t)
+	listenAddr := freeAddr(t)
+	// the primary upstream is the emulator
+	s, err := NewServer(false, false,
+		WithListenAddr(listenAddr),
+		WithMirror(mirrorAddr),
+		WithMirror(unreachableAddr))
+	assert.NoError(t, err)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(ctx, log)
+	}()
+	sent := counterValue(t, mirrorSentFramesTotal.WithLabelValues(mirrorAddr))
+	dropped := counterValue(t,
+		mirrorDroppedFramesTotal.WithLabelValues(unreachableAddr))
+	var conn net.Conn
+	for range 50 {
+		if conn, err = net.Dial("tcp", listenAddr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	defer conn.Close()
+	frame := outboundSeeds(t)[0]
+	_, err = conn.Write(frame)
+	assert.NoError(t, err)
+	// the device only receives the reply of the primary upstream
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	reader := bufio.NewReader(conn)
+	ack, err := readPacket(reader, inboundPrefix)
+	assert.NoError(t, err)
+	assert.NoError(t, validateCRC(ack, inboundCRCByteOrder))
+	// the mirror receives a copy of the frame
+	select {
+	case mirrored := <-received:
+		assert.Equal(t, frame, mirrored)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for mirrored frame")
+	}
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = reader.Peek(1)
+	assert.Error(t, err)
+	cancel()
+	assert.NoError(t, <-done)
+	assert.Equal(t, sent+1,
+		counterValue(t, mirrorSentFramesTotal.WithLabelValues(mirrorAddr)))
+	assert.Equal(t, dropped+1, counterValue(t,
+		mirrorDroppedFramesTotal.WithLabelValues(unreachableAddr)))
+}
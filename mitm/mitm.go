@@ -1,30 +1,40 @@
 // Package mitm implements a MITM attack on the SEMS portal protocol in order
 // to extract metrics.
+//
+// Decoded packets are published as typed events to the Observers registered
+// with WithObserver. PrometheusObserver records them as Prometheus metrics.
 package mitm
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/netip"
 	"slices"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/lithammer/shortuuid/v4"
 	"github.com/smlx/goodwe"
+	"github.com/smlx/goodwe/capture"
+	"github.com/smlx/goodwe/queue"
 )
 
 const (
-	// semsportal server endpoint
-	upstreamHost = "tcp.goodwe-power.com:20001"
+	// DefaultUpstreamHost is the semsportal server endpoint.
+	DefaultUpstreamHost = "tcp.goodwe-power.com:20001"
+	// DefaultListenAddr is the address devices connect to.
+	DefaultListenAddr = ":20001"
 	// network timeouts
 	listenTimeout = 2 * time.Second
 	readTimeout   = time.Second
@@ -45,20 +55,44 @@ var (
 	keepAlive = []byte{0x01, 0x02}
 	// prometheus metrics labels
 	labelNames = []string{"device", "model", "serial"}
-	// known Device IDs mapped to device type and model
-	deviceInfo = map[[8]byte][2]string{
-		{0x39, 0x31, 0x30, 0x30, 0x30, 0x48, 0x4b, 0x55}: {
-			"meter", "HomeKit 1000 Smart Meter",
-		},
-		{0x35, 0x33, 0x30, 0x30, 0x30, 0x44, 0x53, 0x43}: {
-			"inverter", "GW3000-DNS-30",
-		},
-	}
 )
 
 // PacketType indicates the type of the packet.
 type PacketType [2]byte
 
+// String implements fmt.Stringer.
+func (pt PacketType) String() string {
+	return fmt.Sprintf("0x%02x%02x", pt[0], pt[1])
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (pt PacketType) MarshalText() ([]byte, error) {
+	return []byte(pt.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It accepts four hex
+// digits with an optional 0x prefix, as printed by String.
+func (pt *PacketType) UnmarshalText(text []byte) error {
+	s := strings.TrimPrefix(strings.ToLower(string(text)), "0x")
+	if len(s) != hex.EncodedLen(len(pt)) {
+		return fmt.Errorf("invalid packet type %q: must be 4 hex digits", text)
+	}
+	if _, err := hex.Decode(pt[:], []byte(s)); err != nil {
+		return fmt.Errorf("invalid packet type %q: %v", text, err)
+	}
+	return nil
+}
+
+// asciiString returns the NUL-terminated ASCII string in b. Bytes after the
+// NUL are padding (0xff) and are ignored. Runs of whitespace, such as the line
+// breaks in firmware versions, are collapsed to a single space.
+func asciiString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.Join(strings.Fields(string(b)), " ")
+}
+
 // Timestamp is a time representation.
 // TZ appears to be China Standard Time, AKA Beijing time (+08:00).
 type Timestamp [6]byte
@@ -70,6 +104,20 @@ func (t *Timestamp) Time() time.Time {
 		time.FixedZone("+08", 8*60*60))
 }
 
+// MarshalText implements encoding.TextMarshaler.
+func (t Timestamp) MarshalText() ([]byte, error) {
+	return []byte(t.Time().Format(time.RFC3339)), nil
+}
+
+// NewTimestamp returns a Timestamp representation of t.
+func NewTimestamp(t time.Time) Timestamp {
+	t = t.In(time.FixedZone("+08", 8*60*60))
+	return Timestamp{
+		byte(t.Year() - 2000), byte(t.Month()), byte(t.Day()),
+		byte(t.Hour()), byte(t.Minute()), byte(t.Second()),
+	}
+}
+
 // PacketHandler is an interface implemented by both outbound and inbound
 // packet handlers.
 type PacketHandler interface {
@@ -82,8 +130,8 @@ type PacketHandler interface {
 
 // decryptCiphertext decrypts the given ciphertext using the fixed key.
 func decryptCiphertext(iv, ciphertext []byte) ([]byte, error) {
-	if len(ciphertext)%16 != 0 {
-		return nil, fmt.Errorf("invalid ciphertext length: %d", len(ciphertext))
+	if len(ciphertext)%aes.BlockSize != 0 {
+		return nil, &LengthError{Type: "ciphertext", Got: len(ciphertext)}
 	}
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -99,8 +147,8 @@ func decryptCiphertext(iv, ciphertext []byte) ([]byte, error) {
 // This function does no padding - the cleartext length must be a multiple of
 // blocksize.
 func encryptCleartext(iv, cleartext []byte) ([]byte, error) {
-	if len(cleartext)%16 != 0 {
-		return nil, fmt.Errorf("invalid cleartext length: %d", len(cleartext))
+	if len(cleartext)%aes.BlockSize != 0 {
+		return nil, &LengthError{Type: "cleartext", Got: len(cleartext)}
 	}
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -115,41 +163,50 @@ func encryptCleartext(iv, cleartext []byte) ([]byte, error) {
 // validateCRC checks that the Modbus CRC of the given data is correct. It
 // assumes the expected CRC is the last two bytes of data.
 func validateCRC(data []byte, bo binary.ByteOrder) error {
+	if len(data) < 2 {
+		return &TruncatedError{Type: "frame", Need: 2, Got: len(data)}
+	}
 	crcVal := bo.Uint16(data[len(data)-2:])
 	expectedCRCVal := goodwe.CRC(data[:len(data)-2])
 	if expectedCRCVal != crcVal {
-		return fmt.Errorf("CRC mismatch: expected %v, got %v", expectedCRCVal, crcVal)
+		return &CRCError{Expected: expectedCRCVal, Got: crcVal}
 	}
 	return nil
 }
 
-// readPacket reads a full packet from r, using the header length immediately
-// after the prefix to know how much to read.
-func readPacket(r *bufio.Reader, prefix []byte) ([]byte, error) {
-	headerLen := len(prefix) + 4 // prefix + 4 byte int32 packet length
-	data, err := r.Peek(headerLen)
-	if err != nil {
-		return nil, fmt.Errorf("couldn't peek packet header: %v", err)
+// readError handles an error reading from a connection. It returns true if
+// the read should be retried. Otherwise the connection handler should return
+// the returned error.
+func readError(ctx context.Context, log *slog.Logger, err error) (bool, error) {
+	// handle read timeout
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true, nil // reached deadline
 	}
-	packetLen :=
-		int(binary.BigEndian.Uint32(data[len(prefix):])) + // length in header
-			headerLen + // length of header itself
-			2 + // CRC
-			1 // off-by-one error in header length :-/
-	return io.ReadAll(io.LimitReader(r, int64(packetLen)))
+	// return wihtout error on closed socket
+	if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) {
+		log.Debug("read socket closed")
+		return false, nil
+	}
+	// return without error if we are in teardown
+	if errors.Is(ctx.Err(), context.Canceled) {
+		log.Debug("context cancelled")
+		return false, nil
+	}
+	return false, fmt.Errorf("couldn't read: %v", err)
 }
 
-// handleConn intercepts traffic in one direction of a TCP connection.
+// handleConn intercepts traffic in one direction of a TCP connection. Frames
+// are forwarded according to policy.
 func (s *Server) handleConn(
 	ctx context.Context,
 	log *slog.Logger,
 	in net.Conn,
 	out net.Conn,
 	packetPrefix []byte,
-	forwardOnError bool,
+	policy Policy,
 	ph PacketHandler,
 ) error {
-	var reader = bufio.NewReader(in)
+	var reader = newFrameReader(in, packetPrefix, s.frameTimeout)
 	var data, newData []byte
 	for {
 		if ctx.Err() != nil {
@@ -159,79 +216,50 @@ func (s *Server) handleConn(
 			return fmt.Errorf("couldn't set read deadline: %v", err)
 		}
 		prefix, err := reader.Peek(len(packetPrefix))
-		if err != nil {
-			// handle read timeout
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				continue // reached deadline
-			}
-			// return wihtout error on closed socket
-			if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) {
-				log.Debug("read socket closed")
-				return nil
-			}
-			// return without error if we are in teardown
-			if errors.Is(ctx.Err(), context.Canceled) {
-				log.Debug("context cancelled")
-				return nil
-			}
-			return fmt.Errorf("couldn't read: %v", err)
-		}
-		switch {
-		case slices.Equal(keepAlive, prefix):
+		if err == nil && slices.Equal(keepAlive, prefix) {
 			log.Debug("keepalive(?)")
 			data = keepAlive
 			if _, err = reader.Discard(len(data)); err != nil {
 				log.Warn("couldn't discard keepalive", slog.Any("error", err))
 			}
-		case slices.Equal(packetPrefix, prefix):
-			data, err = readPacket(reader, packetPrefix)
-			if err != nil {
+			s.recordFrame(ctx, log, data, packetPrefix)
+		} else {
+			// a peek error may be due to a partial frame, so let the frame
+			// reader handle it.
+			data, err = reader.readPacket()
+			var framingErr *FramingError
+			if err != nil && !errors.As(err, &framingErr) {
+				if retry, err := readError(ctx, log, err); !retry {
+					return err
+				}
+				continue
+			}
+			s.recordFrame(ctx, log, data, packetPrefix)
+			if framingErr != nil {
+				countFramingError(packetPrefix, framingErr)
 				log.Warn("couldn't read packet",
 					slog.Any("data", data),
 					slog.Any("error", err))
-				// skip to next packet
-				discard, err := reader.ReadBytes(packetPrefix[0])
+				if !policy.forward(log, packetPrefix, data, false) {
+					continue // don't forward invalid data
+				}
+			} else {
+				newData, err = ph.HandlePacket(ctx, log, data)
 				if err != nil {
-					log.Debug("couldn't find next prefix",
-						slog.Any("discard", discard),
+					// not a fatal error, since maybe we just don't handle the
+					// packet correctly yet.
+					log.Warn("couldn't handle packet",
+						slog.Any("packet", data),
 						slog.Any("error", err))
 				}
-				if err = reader.UnreadByte(); err != nil {
-					log.Debug("couldn't unread byte")
+				if !policy.forward(log, packetPrefix, data, err == nil) {
+					continue
 				}
-				if !forwardOnError {
-					continue // don't forward invalid data
+				if newData != nil && s.batsignal {
+					// mutate the packet to summon batman to the SEMS Portal
+					data = newData
 				}
 			}
-			newData, err = ph.HandlePacket(ctx, log, data)
-			if err != nil {
-				// not a fatal error, since maybe we just don't handle the
-				// packet correctly yet.
-				log.Warn("couldn't handle packet",
-					slog.Any("packet", data),
-					slog.Any("error", err))
-				if !forwardOnError {
-					continue // don't forward packets with handling errors
-				}
-			}
-			if newData != nil && s.batsignal {
-				// mutate the packet to summon batman to the SEMS Portal
-				data = newData
-			}
-		default:
-			log.Warn("unknown prefix", slog.Any("prefix", prefix))
-			// skip to next packet
-			if discard, err := reader.ReadBytes(packetPrefix[0]); err != nil {
-				log.Debug("couldn't find next prefix",
-					slog.Any("discard", discard),
-					slog.Any("error", err))
-			}
-			if err = reader.UnreadByte(); err != nil {
-				log.Debug("couldn't unread byte")
-			}
-			if !forwardOnError {
-				continue // don't forward unrecognized packets
-			}
 		}
 		// forward traffic
 		_, err = out.Write(data)
@@ -243,14 +271,72 @@ func (s *Server) handleConn(
 
 // Server implements the MITM server.
 type Server struct {
-	batsignal bool
+	batsignal    bool
+	passthrough  bool
+	listenAddr   string
+	upstreamHost string
+	resolveTTL   time.Duration
+	dnsServer    string
+	upstreamIPs  []netip.Addr
+	mirrors      []string
+	capture      *capture.Writer
+	queue        *queue.Queue
+	registry     *Registry
+	observers    Observers
+	inbound      Policy
+	outbound     Policy
+	frameTimeout time.Duration
 }
 
-// NewServer constructs a new Server.
-func NewServer(batsignal bool) *Server {
-	return &Server{
-		batsignal: batsignal,
+// NewServer constructs a new Server. If passthrough is false, the Server
+// emulates the SEMS portal instead of forwarding traffic upstream.
+func NewServer(batsignal, passthrough bool, opts ...Option) (*Server, error) {
+	s := Server{
+		batsignal:    batsignal,
+		passthrough:  passthrough,
+		listenAddr:   DefaultListenAddr,
+		upstreamHost: DefaultUpstreamHost,
+		resolveTTL:   DefaultResolveTTL,
+		inbound:      DefaultInboundPolicy,
+		outbound:     DefaultOutboundPolicy,
+		frameTimeout: frameTimeout,
+	}
+	for _, opt := range opts {
+		if err := opt(&s); err != nil {
+			return nil, err
+		}
 	}
+	if s.registry == nil {
+		registry, err := NewRegistry()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't construct device registry: %v", err)
+		}
+		s.registry = registry
+	}
+	return &s, nil
+}
+
+// emulatedUpstream returns a connection to an in-process SEMS emulator which
+// exits when ctx is cancelled or the connection is closed. If q is not nil,
+// outbound frames are added to it.
+func emulatedUpstream(
+	ctx context.Context,
+	log *slog.Logger,
+	wg *sync.WaitGroup,
+	q *queue.Queue,
+) net.Conn {
+	upstream, emulator := net.Pipe()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer emulator.Close()
+		emulatorLog := log.With(slog.String("direction", "emulator"))
+		if err := emulateUpstream(ctx, emulatorLog, emulator, q); err != nil {
+			emulatorLog.Error("couldn't emulate upstream", slog.Any("error", err))
+		}
+		emulatorLog.Debug("emulator exiting")
+	}()
+	return upstream
 }
 
 // Serve starts the sniff server.
@@ -258,18 +344,58 @@ func (s *Server) Serve(ctx context.Context, log *slog.Logger) error {
 	if s.batsignal {
 		setupBatsignal()
 	}
-	// make an outbound connection upstream as per a regular Goodwe device
-	upstreamAddr, err := net.ResolveTCPAddr("tcp4", upstreamHost)
+	// listen for an incoming connection from the local device. If the host is
+	// empty or unspecified, both IPv4 and IPv6 connections are accepted.
+	listenAddr, err := net.ResolveTCPAddr("tcp", s.listenAddr)
 	if err != nil {
-		return fmt.Errorf(`couldn't resolve "%s": %v`, upstreamHost, err)
+		return fmt.Errorf(`couldn't resolve listen address "%s": %v`,
+			s.listenAddr, err)
 	}
-	// listen for an incoming connection from the local device
-	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: 20001})
+	listener, err := net.ListenTCP("tcp", listenAddr)
 	if err != nil {
-		return fmt.Errorf(`couldn't listen: %v`, err)
+		return fmt.Errorf(`couldn't listen on "%s": %v`, s.listenAddr, err)
+	}
+	defer listener.Close()
+	log.Info("listening for device connections",
+		slog.String("listenAddr", listener.Addr().String()))
+	// make outbound connections upstream as per a regular Goodwe device
+	var dialer *upstreamDialer
+	if s.passthrough {
+		dialer, err = newUpstreamDialer(s.upstreamHost, s.resolveTTL)
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(s.upstreamIPs) > 0:
+			dialer.lookup = staticLookup(s.upstreamIPs)
+		case s.dnsServer != "":
+			dialer.lookup = dnsServerLookup(s.dnsServer)
+		}
+		dialer.local = listenerAddrs(listener.Addr())
+	}
+	// secondary upstreams which receive a copy of outbound traffic
+	mirrorDialers := map[string]*upstreamDialer{}
+	for _, addr := range s.mirrors {
+		mirrorDialers[addr], err = newUpstreamDialer(addr, s.resolveTTL)
+		if err != nil {
+			return err
+		}
+		if s.dnsServer != "" {
+			mirrorDialers[addr].lookup = dnsServerLookup(s.dnsServer)
+		}
+		mirrorDialers[addr].local = listenerAddrs(listener.Addr())
 	}
 	listenCtx, cancel := context.WithCancel(ctx)
 	var wg sync.WaitGroup
+	// forward frames queued while upstream was unreachable
+	if dialer != nil && s.queue != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.forwardQueue(listenCtx, log.With(slog.String("direction", "queue")),
+				dialer)
+		}()
+	}
 	for {
 		// break if ctx cancelled
 		if listenCtx.Err() != nil {
@@ -292,31 +418,55 @@ func (s *Server) Serve(ctx context.Context, log *slog.Logger) error {
 			cancel()
 			break
 		}
+		connID := shortuuid.New()
+		connLog := log.With(slog.Any("connID", connID))
+		connCtx, cancel := context.WithCancel(withConnID(listenCtx, connID))
 		// connect upstream
-		outDialer := net.Dialer{Timeout: connTimeout}
-		upstream, err := outDialer.DialContext(ctx, upstreamAddr.Network(),
-			upstreamAddr.String())
-		if err != nil {
-			log.Error("couldn't dial upstream",
-				slog.String("upstreamAddr", upstreamAddr.String()),
-				slog.Any("error", err))
-			conn.Close()
-			continue
+		var upstream net.Conn
+		if s.passthrough {
+			upstream, err = dialer.DialContext(ctx, connLog)
+			if err != nil {
+				connLog.Error("couldn't dial upstream",
+					slog.String("upstreamHost", s.upstreamHost),
+					slog.Any("error", err))
+				if s.queue == nil {
+					conn.Close()
+					cancel()
+					continue
+				}
+				// degraded mode: answer the device locally and queue its frames
+				connLog.Warn("emulating upstream and queueing frames")
+				degradedConnectionsTotal.Inc()
+				upstream = emulatedUpstream(connCtx, connLog, &wg, s.queue)
+			} else {
+				// keep the device connected if the upstream connection fails
+				upstream = newRedialConn(connCtx, connLog, upstream, s.queue,
+					func(ctx context.Context) (net.Conn, error) {
+						return dialer.DialContext(ctx, connLog)
+					})
+			}
+		} else {
+			upstream = emulatedUpstream(connCtx, connLog, &wg, nil)
+		}
+		if len(mirrorDialers) > 0 {
+			upstream = newMirroredConn(connCtx, connLog, &wg, upstream, mirrorDialers)
 		}
-		connLog := log.With(slog.Any("connID", shortuuid.New()))
 		connLog.Debug("new outbound connection",
 			slog.String("client", conn.RemoteAddr().String()))
-		connCtx, cancel := context.WithCancel(listenCtx)
+		s.observers.Observe(connCtx, ConnOpenEvent{RemoteAddr: conn.RemoteAddr()})
 		// Handle duplex MITM connection in a pair of goroutines.
+		var connWG sync.WaitGroup
+		connWG.Add(2)
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			defer connWG.Done()
 			defer conn.Close()
 			defer upstream.Close()
 			defer cancel()
 			outboundLog := connLog.With(slog.String("direction", "outbound"))
 			err := s.handleConn(connCtx, outboundLog, conn, upstream, outboundPrefix,
-				true, NewOutboundPacketHandler(s.batsignal))
+				s.outbound, NewOutboundPacketHandler(s.batsignal, s.registry, s.observers))
 			if err != nil {
 				outboundLog.Error("couldn't handle connection", slog.Any("error", err))
 			}
@@ -325,17 +475,28 @@ func (s *Server) Serve(ctx context.Context, log *slog.Logger) error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			defer connWG.Done()
 			defer conn.Close()
 			defer upstream.Close()
 			defer cancel()
 			inboundLog := connLog.With(slog.String("direction", "inbound"))
 			err := s.handleConn(connCtx, inboundLog, upstream, conn, inboundPrefix,
-				false, NewInboundPacketHandler())
+				s.inbound, NewInboundPacketHandler(s.registry, s.observers))
 			if err != nil {
 				inboundLog.Error("couldn't handle connection", slog.Any("error", err))
 			}
 			inboundLog.Debug("connection handler exiting")
 		}()
+		// publish the close event once both directions are done
+		wg.Add(1)
+		go func(opened time.Time) {
+			defer wg.Done()
+			connWG.Wait()
+			s.observers.Observe(connCtx, ConnCloseEvent{
+				RemoteAddr: conn.RemoteAddr(),
+				Duration:   time.Since(opened),
+			})
+		}(time.Now())
 	}
 	// wait for subprocessing to complete
 	wg.Wait()
@@ -1,6 +1,9 @@
 package mitm
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"testing"
 	"time"
 
@@ -29,3 +32,38 @@ func TestTimestamp(t *testing.T) {
 		})
 	}
 }
+
+func FuzzReadPacket(f *testing.F) {
+	for _, frame := range outboundSeeds(f) {
+		f.Add(frame, true)
+	}
+	for _, frame := range inboundSeeds(f) {
+		f.Add(frame, false)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, outbound bool) {
+		prefix := inboundPrefix
+		if outbound {
+			prefix = outboundPrefix
+		}
+		r := bufio.NewReader(bytes.NewReader(data))
+		var read int
+		for {
+			packet, err := readPacket(r, prefix)
+			read += len(packet)
+			var framingErr *FramingError
+			if errors.As(err, &framingErr) {
+				if framingErr.Skipped != len(packet) {
+					t.Fatalf("skipped %d bytes but returned %d",
+						framingErr.Skipped, len(packet))
+				}
+				continue
+			}
+			if err != nil || len(packet) == 0 {
+				break
+			}
+		}
+		if read > len(data) {
+			t.Fatalf("read %d bytes from %d bytes of input", read, len(data))
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package mitm
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Observer receives events from the Server as packets are decoded.
+//
+// Observe is called synchronously from the connection handler goroutines, so
+// it must be safe for concurrent use and should not block. Events and the
+// packets they refer to must not be modified.
+type Observer interface {
+	Observe(context.Context, Event)
+}
+
+// ObserverFunc is an adapter to allow the use of ordinary functions as
+// Observers.
+type ObserverFunc func(context.Context, Event)
+
+// Observe implements the Observer interface.
+func (f ObserverFunc) Observe(ctx context.Context, e Event) {
+	f(ctx, e)
+}
+
+// Observers is an Observer which forwards each event to all its elements in
+// order.
+type Observers []Observer
+
+// Observe implements the Observer interface.
+func (obs Observers) Observe(ctx context.Context, e Event) {
+	for _, o := range obs {
+		o.Observe(ctx, e)
+	}
+}
+
+// Event is implemented by all the event types passed to an Observer:
+//
+//   - ConnOpenEvent
+//   - ConnCloseEvent
+//   - MetricsEvent
+//   - TimeSyncEvent
+//   - TimeSyncRespEvent
+//   - TimeSyncRespAckEvent
+//   - MetricsAckEvent
+//   - UnknownPacketEvent
+//
+// The ID of the device connection the event occurred on is available by
+// calling ConnID on the context passed to Observe.
+type Event interface {
+	isEvent()
+}
+
+// Source identifies the device which sent, or is the destination of, a
+// packet.
+type Source struct {
+	Device Device
+	// Serial is the device serial number from the packet envelope.
+	Serial string
+}
+
+// ConnOpenEvent is published when a device connects.
+type ConnOpenEvent struct {
+	RemoteAddr net.Addr
+}
+
+// ConnCloseEvent is published when a device connection is closed.
+type ConnCloseEvent struct {
+	RemoteAddr net.Addr
+	Duration   time.Duration
+}
+
+// MetricsEvent is published when a device sends a metrics packet of a type
+// described by its packet layout.
+type MetricsEvent struct {
+	Source
+	PacketType PacketType
+	// Cached is true if the layout lists the packet type as cached, e.g.
+	// 0x0345, which carries a reading that the device was not able to send
+	// earlier. Observers which can't record a reading at Timestamp should
+	// ignore cached events.
+	Cached bool
+	// Timestamp is the device time of the reading.
+	Timestamp time.Time
+	Reading   Reading
+	// Packet is the packet decoded with the fixed struct of a built-in packet
+	// type: *OutboundMeterMetricsPacket, *OutboundInverterMetrics0Packet or
+	// *OutboundInverterMetrics1Packet. It is nil for other packet types, or
+	// if the cleartext is a different size, as sent by devices with other
+	// layouts.
+	Packet any
+}
+
+// TimeSyncEvent is published when a device sends a time sync request.
+type TimeSyncEvent struct {
+	Source
+	PacketType PacketType
+	// Timestamp is the device time.
+	Timestamp time.Time
+	// Firmware is the firmware version reported by the device.
+	Firmware string
+	// ServerAddr is the SEMS Portal address configured on the device. Only
+	// reported by smart meters.
+	ServerAddr string
+	// LongSerial is the long form of the device serial number. Only reported
+	// by smart meters.
+	LongSerial string
+}
+
+// TimeSyncRespEvent is published when SEMS responds to a time sync request.
+type TimeSyncRespEvent struct {
+	Source
+	PacketType PacketType
+	// Timestamp is the SEMS time.
+	Timestamp time.Time
+}
+
+// TimeSyncRespAckEvent is published when a device acknowledges a time sync
+// response.
+type TimeSyncRespAckEvent struct {
+	Source
+	PacketType PacketType
+}
+
+// AckStatus is the status of a MetricsAckEvent.
+type AckStatus string
+
+// AckStatus values.
+const (
+	// AckStatusAck indicates that SEMS accepted the metrics.
+	AckStatusAck AckStatus = "ack"
+	// AckStatusNack indicates that SEMS rejected the metrics. e.g. bad CRC.
+	AckStatusNack AckStatus = "nack"
+	// AckStatusUnknown indicates that the ack payload was not recognised.
+	AckStatusUnknown AckStatus = "unknown"
+)
+
+// MetricsAckEvent is published when SEMS acknowledges a metrics or time sync
+// packet.
+type MetricsAckEvent struct {
+	Source
+	PacketType PacketType
+	Status     AckStatus
+	// Data is the cleartext ack payload.
+	Data [16]byte
+}
+
+// UnknownPacketEvent is published when a packet of an unknown type is
+// received.
+type UnknownPacketEvent struct {
+	// Direction is capture.DirectionOutbound or capture.DirectionInbound.
+	Direction  string
+	PacketType PacketType
+	// Frame is the full frame, including header and CRC.
+	Frame []byte
+	// Cleartext is the decrypted packet body, or nil if it could not be
+	// decrypted.
+	Cleartext []byte
+}
+
+func (ConnOpenEvent) isEvent()        {}
+func (ConnCloseEvent) isEvent()       {}
+func (MetricsEvent) isEvent()         {}
+func (TimeSyncEvent) isEvent()        {}
+func (TimeSyncRespEvent) isEvent()    {}
+func (TimeSyncRespAckEvent) isEvent() {}
+func (MetricsAckEvent) isEvent()      {}
+func (UnknownPacketEvent) isEvent()   {}
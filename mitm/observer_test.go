@@ -0,0 +1,276 @@
+package mitm
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/smlx/goodwe"
+	"github.com/smlx/goodwe/capture"
+)
+
+// recorder is an Observer which records all events.
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// Observe implements the Observer interface.
+func (r *recorder) Observe(_ context.Context, e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+// Events returns a copy of the recorded events.
+func (r *recorder) Events() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+func TestObservePackets(t *testing.T) {
+	env := OutboundEnvelopeTS{
+		DeviceID:     [8]byte([]byte("91000HKU")),
+		DeviceSerial: [8]byte([]byte(testDeviceSerial)),
+	}
+	now := time.Date(2023, time.November, 26, 22, 4, 33, 0, time.UTC)
+	ack, err := metricsAckPacket(meterMetricsAck0, &env, metricsAckData, now)
+	assert.NoError(t, err)
+	nack, err := metricsAckPacket(meterMetricsAck0, &env, metricsNackData, now)
+	assert.NoError(t, err)
+	unknown, err := metricsAckPacket(PacketType{0x09, 0x09}, &env,
+		metricsAckData, now)
+	assert.NoError(t, err)
+	registry := defaultRegistry(t)
+	meter, err := registry.lookup(env.DeviceID)
+	assert.NoError(t, err)
+	source := Source{Device: meter, Serial: testDeviceSerial}
+	var testCases = map[string]struct {
+		input    []byte
+		outbound bool
+		check    func(*testing.T, Event)
+	}{
+		"meter metrics": {
+			input: []byte{
+				0x50, 0x4f, 0x53, 0x54, 0x47, 0x57, 0x00, 0x00, 0x00, 0x99, 0x03, 0x04, 0x00, 0x00, 0x39, 0x31,
+				0x30, 0x30, 0x30, 0x48, 0x4b, 0x55, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x17, 0x09,
+				0x12, 0x09, 0x09, 0x1b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x17, 0x09,
+				0x12, 0x09, 0x09, 0x1b, 0xde, 0xde, 0x93, 0x57, 0xfe, 0x05, 0x28, 0x76, 0x42, 0xac, 0x63, 0xcf,
+				0xdd, 0x7a, 0xae, 0x6d, 0xca, 0x77, 0x85, 0xca, 0x23, 0x99, 0x4c, 0x72, 0x7d, 0x33, 0x59, 0x81,
+				0x3b, 0xc8, 0xf2, 0x37, 0x22, 0x69, 0x71, 0x9d, 0xc8, 0x46, 0x62, 0xa2, 0xc0, 0xef, 0xe7, 0x44,
+				0xb3, 0x58, 0x2a, 0x2f, 0xbd, 0x2f, 0x68, 0x4c, 0xe0, 0x98, 0x0b, 0x24, 0xbf, 0x04, 0xc4, 0x4f,
+				0xa8, 0x01, 0x81, 0x8c, 0xf6, 0x5f, 0x05, 0x52, 0x73, 0x86, 0x32, 0xaa, 0x16, 0xd2, 0x9f, 0xfe,
+				0x0e, 0x52, 0xb3, 0xcc, 0x9f, 0x0a, 0xaf, 0xef, 0x6d, 0x28, 0xce, 0xad, 0x52, 0xe7, 0x9f, 0x7f,
+				0x9b, 0xe3, 0x3c, 0xa0, 0x1b, 0x22, 0xc9, 0x59, 0x33, 0x04, 0xf2, 0x39, 0x8d, 0xd1, 0x20, 0xfc,
+				0x88, 0xaa, 0x1d, 0x99, 0x4b, 0xcd,
+			},
+			outbound: true,
+			check: func(tt *testing.T, e Event) {
+				metrics, ok := e.(MetricsEvent)
+				assert.True(tt, ok, "expected MetricsEvent, got %T", e)
+				assert.Equal(tt, source, metrics.Source)
+				assert.Equal(tt, meterMetrics0, metrics.PacketType)
+				assert.False(tt, metrics.Cached)
+				assert.Equal(tt, int64(1557), metrics.Reading.Values["PowerExportWatts"])
+				assert.Equal(tt, int64(2601), metrics.Reading.Values["PowerGenerationWatts"])
+				// the typed packet agrees with the reading
+				packet, ok := metrics.Packet.(*OutboundMeterMetricsPacket)
+				assert.True(tt, ok, "expected *OutboundMeterMetricsPacket, got %T",
+					metrics.Packet)
+				assert.Equal(tt, int32(1557), packet.PowerExportWatts)
+				assert.Equal(tt, int32(2601), packet.PowerGenerationWatts)
+			},
+		},
+		"meter time sync": {
+			input: []byte{
+				0x50, 0x4f, 0x53, 0x54, 0x47, 0x57, 0x00, 0x00, 0x00, 0x89, 0x03, 0x03, 0x00, 0x00, 0x39, 0x31,
+				0x30, 0x30, 0x30, 0x48, 0x4b, 0x55, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x17, 0x0a,
+				0x1e, 0x0e, 0x14, 0x11, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x17, 0x0a,
+				0x1e, 0x0e, 0x14, 0x11, 0x15, 0x03, 0x6e, 0x21, 0x65, 0xf4, 0x5c, 0xfb, 0x95, 0x7f, 0xc0, 0x74,
+				0x5c, 0xd0, 0x0a, 0x09, 0x62, 0x64, 0xa5, 0x98, 0x81, 0x05, 0xda, 0x21, 0xcd, 0x1c, 0xae, 0x60,
+				0x90, 0x2f, 0xde, 0x42, 0x5e, 0x93, 0x24, 0x23, 0xd1, 0x4c, 0x7a, 0xa2, 0xc7, 0xe4, 0xbb, 0xfd,
+				0xd4, 0xdb, 0xb3, 0x43, 0x3b, 0x34, 0x1a, 0x63, 0x0c, 0x8b, 0xc4, 0x74, 0x6e, 0xb4, 0x39, 0x66,
+				0x44, 0x0d, 0xa5, 0xe0, 0xc0, 0x07, 0xf8, 0x29, 0xec, 0x50, 0x61, 0xf5, 0x4c, 0x6d, 0x4c, 0x15,
+				0x6e, 0x14, 0x00, 0x9f, 0x43, 0x82, 0x63, 0xca, 0xd6, 0x4f, 0x3f, 0x98, 0x07, 0x3f, 0x9e, 0xcb,
+				0x94, 0xe2, 0xd9, 0x6c, 0xf9, 0x69,
+			},
+			outbound: true,
+			check: func(tt *testing.T, e Event) {
+				assert.Equal(tt, Event(TimeSyncEvent{
+					Source:     source,
+					PacketType: meterTimeSync,
+					Timestamp: time.Date(2023, time.October, 30, 14, 20, 17, 0,
+						time.FixedZone("+08", 8*60*60)),
+					Firmware:   "V18 V4",
+					ServerAddr: "20001,tcp.goodwe-power.com",
+					LongSerial: "02053-05-000Me05",
+				}), e)
+			},
+		},
+		"metrics ack": {
+			input: ack,
+			check: func(tt *testing.T, e Event) {
+				assert.Equal(tt, Event(MetricsAckEvent{
+					Source:     source,
+					PacketType: meterMetricsAck0,
+					Status:     AckStatusAck,
+					Data:       [16]byte(metricsAckData),
+				}), e)
+			},
+		},
+		"metrics nack": {
+			input: nack,
+			check: func(tt *testing.T, e Event) {
+				assert.Equal(tt, Event(MetricsAckEvent{
+					Source:     source,
+					PacketType: meterMetricsAck0,
+					Status:     AckStatusNack,
+					Data:       [16]byte(metricsNackData),
+				}), e)
+			},
+		},
+		"unknown packet": {
+			input: unknown,
+			check: func(tt *testing.T, e Event) {
+				assert.Equal(tt, Event(UnknownPacketEvent{
+					Direction:  capture.DirectionInbound,
+					PacketType: PacketType{0x09, 0x09},
+					Frame:      unknown,
+					Cleartext:  metricsAckData,
+				}), e)
+			},
+		},
+	}
+	log := slog.New(slog.NewJSONHandler(os.Stderr,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			rec := recorder{}
+			var ph PacketHandler = NewInboundPacketHandler(registry, &rec)
+			if tc.outbound {
+				ph = NewOutboundPacketHandler(false, registry, &rec)
+			}
+			_, _ = ph.HandlePacket(context.Background(), log, tc.input)
+			events := rec.Events()
+			assert.Equal(tt, 1, len(events), name)
+			tc.check(tt, events[0])
+		})
+	}
+}
+
+func TestObserveLayoutPacketTypes(t *testing.T) {
+	builtin := packetLayouts
+	t.Cleanup(func() { packetLayouts = builtin })
+	path := filepath.Join(t.TempDir(), "layouts.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+hk2000:
+- types: ["0x0398", "0x0399"]
+  cached: ["0x0399"]
+  size: 16
+  fields:
+  - {name: A, offset: 0, type: int32, metric: test_observed_a, help: A.}
+`), 0600))
+	assert.NoError(t, LoadPacketLayouts(path))
+	meter := Device{
+		ID:     DeviceID([]byte("92000HKU")),
+		Type:   "meter",
+		Model:  "HomeKit 2000 Smart Meter",
+		Layout: "hk2000",
+	}
+	registry, err := NewRegistry(meter)
+	assert.NoError(t, err)
+	var testCases = map[string]struct {
+		packetType   PacketType
+		expectCached bool
+	}{
+		"live":   {packetType: PacketType{0x03, 0x98}},
+		"cached": {packetType: PacketType{0x03, 0x99}, expectCached: true},
+	}
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			// construct an outbound frame of the packet type
+			env := OutboundEnvelopeTS{
+				DeviceID:     [8]byte(meter.ID),
+				DeviceSerial: [8]byte([]byte(testDeviceSerial)),
+				Timestamp:    NewTimestamp(time.Now()),
+			}
+			cleartext := binary.BigEndian.AppendUint32(nil, 1234)
+			cleartext = append(cleartext, make([]byte, 12)...)
+			ciphertext, err := encryptCleartext(env.IV[:], cleartext)
+			assert.NoError(tt, err, name)
+			body, err := binary.Append(nil, binary.BigEndian, &env)
+			assert.NoError(tt, err, name)
+			body = append(body, ciphertext...)
+			header := OutboundHeader{
+				PostGW:     [6]byte(outboundPrefix),
+				Length:     uint32(len(body) + 1), // off-by-one
+				PacketType: tc.packetType,
+			}
+			frame, err := header.MarshalBinary()
+			assert.NoError(tt, err, name)
+			frame = append(frame, body...)
+			frame = outboundCRCByteOrder.AppendUint16(frame, goodwe.CRC(frame))
+			// handle the frame
+			rec := recorder{}
+			ph := NewOutboundPacketHandler(false, registry, &rec)
+			_, err = ph.HandlePacket(context.Background(), log, frame)
+			assert.NoError(tt, err, name)
+			events := rec.Events()
+			assert.Equal(tt, 1, len(events), name)
+			metrics, ok := events[0].(MetricsEvent)
+			assert.True(tt, ok, "expected MetricsEvent, got %T", events[0])
+			assert.Equal(tt, tc.packetType, metrics.PacketType, name)
+			assert.Equal(tt, tc.expectCached, metrics.Cached, name)
+			assert.Equal(tt, int64(1234), metrics.Reading.Values["A"], name)
+			assert.Zero(tt, metrics.Packet, name)
+		})
+	}
+}
+
+func TestObserveConn(t *testing.T) {
+	// find a free port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	assert.NoError(t, l.Close())
+	rec := recorder{}
+	s, err := NewServer(false, false, WithListenAddr(addr), WithObserver(&rec))
+	assert.NoError(t, err)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(ctx, log)
+	}()
+	// connect and disconnect
+	var conn net.Conn
+	for range 50 {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Close())
+	// wait for the server to exit
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	assert.NoError(t, <-done)
+	events := rec.Events()
+	assert.Equal(t, 2, len(events))
+	open, ok := events[0].(ConnOpenEvent)
+	assert.True(t, ok, "expected ConnOpenEvent, got %T", events[0])
+	assert.Equal(t, conn.LocalAddr().String(), open.RemoteAddr.String())
+	closed, ok := events[1].(ConnCloseEvent)
+	assert.True(t, ok, "expected ConnCloseEvent, got %T", events[1])
+	assert.Equal(t, conn.LocalAddr().String(), closed.RemoteAddr.String())
+}
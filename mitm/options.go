@@ -0,0 +1,194 @@
+package mitm
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/smlx/goodwe/capture"
+	"github.com/smlx/goodwe/queue"
+)
+
+// Option configures a Server.
+type Option func(*Server) error
+
+// ValidateAddr checks that addr is a valid host:port TCP address. If listen
+// is true the host may be empty and the port may be zero, as accepted by
+// net.Listen.
+func ValidateAddr(addr string, listen bool) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf(`invalid address "%s": %v`, addr, err)
+	}
+	if host == "" && !listen {
+		return fmt.Errorf(`invalid address "%s": missing host`, addr)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf(`invalid address "%s": invalid port "%s"`, addr, port)
+	}
+	if portNum == 0 && !listen {
+		return fmt.Errorf(`invalid address "%s": port must be non-zero`, addr)
+	}
+	return nil
+}
+
+// WithListenAddr sets the address the Server listens on for device
+// connections. The default is DefaultListenAddr.
+func WithListenAddr(addr string) Option {
+	return func(s *Server) error {
+		if err := ValidateAddr(addr, true); err != nil {
+			return fmt.Errorf("couldn't set listen address: %v", err)
+		}
+		s.listenAddr = addr
+		return nil
+	}
+}
+
+// WithUpstreamHost sets the SEMS portal address the Server forwards traffic
+// to. The default is DefaultUpstreamHost.
+func WithUpstreamHost(addr string) Option {
+	return func(s *Server) error {
+		if err := ValidateAddr(addr, false); err != nil {
+			return fmt.Errorf("couldn't set upstream host: %v", err)
+		}
+		s.upstreamHost = addr
+		return nil
+	}
+}
+
+// WithResolveTTL sets how long the resolved addresses of the upstream host
+// are cached. If ttl is zero the upstream host is resolved for every device
+// connection. The default is DefaultResolveTTL.
+func WithResolveTTL(ttl time.Duration) Option {
+	return func(s *Server) error {
+		if ttl < 0 {
+			return fmt.Errorf("couldn't set resolve TTL: negative duration %v", ttl)
+		}
+		s.resolveTTL = ttl
+		return nil
+	}
+}
+
+// WithUpstreamDNSServer sets the DNS server used to resolve the upstream
+// host, bypassing the system resolver. This avoids resolving the upstream host
+// to the Server itself where its DNS entry points at the Server. The port
+// defaults to 53 if addr doesn't include one.
+func WithUpstreamDNSServer(addr string) Option {
+	return func(s *Server) error {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		if err := ValidateAddr(addr, false); err != nil {
+			return fmt.Errorf("couldn't set upstream DNS server: %v", err)
+		}
+		if len(s.upstreamIPs) > 0 {
+			return fmt.Errorf("couldn't set upstream DNS server: " +
+				"static upstream IPs are already set")
+		}
+		s.dnsServer = addr
+		return nil
+	}
+}
+
+// WithUpstreamIPs sets static IP addresses for the upstream host, which is
+// then not resolved. The port of the upstream host is used.
+func WithUpstreamIPs(ips []netip.Addr) Option {
+	return func(s *Server) error {
+		if s.dnsServer != "" {
+			return fmt.Errorf("couldn't set upstream IPs: " +
+				"upstream DNS server is already set")
+		}
+		for _, ip := range ips {
+			if !ip.IsValid() {
+				return fmt.Errorf("couldn't set upstream IPs: invalid IP address")
+			}
+		}
+		s.upstreamIPs = ips
+		return nil
+	}
+}
+
+// WithMirror adds a secondary upstream address which receives a copy of the
+// traffic sent by devices. Replies from the mirror are discarded, and a mirror
+// which is unreachable doesn't affect the primary upstream connection. It may
+// be given multiple times.
+func WithMirror(addr string) Option {
+	return func(s *Server) error {
+		if err := ValidateAddr(addr, false); err != nil {
+			return fmt.Errorf("couldn't add mirror: %v", err)
+		}
+		if slices.Contains(s.mirrors, addr) {
+			return fmt.Errorf(`couldn't add mirror: duplicate address "%s"`, addr)
+		}
+		s.mirrors = append(s.mirrors, addr)
+		return nil
+	}
+}
+
+// WithCapture configures the Server to record every frame it sees to the
+// given capture file writer. The caller is responsible for closing w after
+// Serve returns.
+func WithCapture(w *capture.Writer) Option {
+	return func(s *Server) error {
+		s.capture = w
+		return nil
+	}
+}
+
+// WithQueue enables degraded mode. If the upstream host is unreachable when a
+// device connects, the Server answers the device in place of SEMS and adds its
+// frames to q. Queued frames are forwarded upstream in order once it is
+// reachable again. The caller is responsible for closing q after Serve
+// returns.
+func WithQueue(q *queue.Queue) Option {
+	return func(s *Server) error {
+		s.queue = q
+		return nil
+	}
+}
+
+// WithRegistry sets the device registry used to identify devices. The default
+// is a registry containing only the built-in devices.
+func WithRegistry(r *Registry) Option {
+	return func(s *Server) error {
+		s.registry = r
+		return nil
+	}
+}
+
+// WithObserver adds an Observer which receives events from the Server. It
+// may be given multiple times, and observers are called in the order given.
+func WithObserver(o Observer) Option {
+	return func(s *Server) error {
+		s.observers = append(s.observers, o)
+		return nil
+	}
+}
+
+// WithInboundPolicy sets the policy applied to packets from the SEMS portal.
+// The default is DefaultInboundPolicy.
+func WithInboundPolicy(p Policy) Option {
+	return func(s *Server) error {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("couldn't set inbound policy: %v", err)
+		}
+		s.inbound = p
+		return nil
+	}
+}
+
+// WithOutboundPolicy sets the policy applied to packets from devices. The
+// default is DefaultOutboundPolicy.
+func WithOutboundPolicy(p Policy) Option {
+	return func(s *Server) error {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("couldn't set outbound policy: %v", err)
+		}
+		s.outbound = p
+		return nil
+	}
+}
@@ -0,0 +1,76 @@
+package mitm
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestValidateAddr(t *testing.T) {
+	var testCases = map[string]struct {
+		addr        string
+		listen      bool
+		expectError bool
+	}{
+		"listen all interfaces": {addr: ":20001", listen: true},
+		"listen ipv4":           {addr: "127.0.0.1:20001", listen: true},
+		"listen ipv6":           {addr: "[::1]:20001", listen: true},
+		"listen random port":    {addr: "127.0.0.1:0", listen: true},
+		"upstream hostname":     {addr: "tcp.goodwe-power.com:20001"},
+		"upstream missing host": {addr: ":20001", expectError: true},
+		"upstream zero port":    {addr: "example.com:0", expectError: true},
+		"missing port":          {addr: "example.com", expectError: true},
+		"invalid port":          {addr: "example.com:http", expectError: true},
+		"port out of range":     {addr: "example.com:65536", expectError: true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			err := ValidateAddr(tc.addr, tc.listen)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+		})
+	}
+}
+
+func TestNewServerOptions(t *testing.T) {
+	s, err := NewServer(false, true,
+		WithListenAddr("127.0.0.1:0"),
+		WithUpstreamHost("example.com:20001"))
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:0", s.listenAddr)
+	assert.Equal(t, "example.com:20001", s.upstreamHost)
+	assert.Equal(t, DefaultResolveTTL, s.resolveTTL)
+	_, err = NewServer(false, true, WithUpstreamHost("example.com"))
+	assert.Error(t, err)
+	_, err = NewServer(false, true, WithResolveTTL(-time.Second))
+	assert.Error(t, err)
+	s, err = NewServer(false, true, WithUpstreamDNSServer("192.0.2.53"))
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.53:53", s.dnsServer)
+	_, err = NewServer(false, true,
+		WithUpstreamDNSServer("192.0.2.53"),
+		WithUpstreamIPs([]netip.Addr{netip.MustParseAddr("192.0.2.1")}))
+	assert.Error(t, err)
+}
+
+func TestServeBindError(t *testing.T) {
+	// occupy a port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	s, err := NewServer(false, false, WithListenAddr(l.Addr().String()))
+	assert.NoError(t, err)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	err = s.Serve(context.Background(), log)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), l.Addr().String())
+}
@@ -1,15 +1,17 @@
 package mitm
 
 import (
-	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"log/slog"
+	"slices"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/smlx/goodwe"
+	"github.com/smlx/goodwe/capture"
 )
 
 var (
@@ -47,36 +49,187 @@ var (
 // weird packet type, so tries to decrypt and parse it as such. This is mostly
 // useful when occasionally the device sends a metrics packet with an unknown
 // packet type header.
-func handleUnknownOutboundPacket(
-	data []byte,
+func (h *OutboundPacketHandler) handleUnknownOutboundPacket(
+	ctx context.Context,
 	log *slog.Logger,
+	packetType PacketType,
+	frame []byte,
+	data []byte,
 ) error {
 	log.Info("unknown packet", slog.Any("data", data))
-	outboundUnknownPacketsTotal.Inc()
+	event := UnknownPacketEvent{
+		Direction:  capture.DirectionOutbound,
+		PacketType: packetType,
+		Frame:      frame,
+	}
+	defer func() { h.observer.Observe(ctx, event) }()
 	envelope := OutboundEnvelope{}
-	envData, bodyData := data[:binary.Size(envelope)], data[binary.Size(envelope):]
-	envBuf := bytes.NewBuffer(envData)
-	err := binary.Read(envBuf, binary.BigEndian, &envelope)
+	ciphertext, err := unmarshalEnvelope(data, &envelope)
 	if err != nil {
 		return fmt.Errorf("couldn't unmarshal envelope %T: %v", envelope, err)
 	}
-	cleartext, err := decryptCiphertext(envelope.IV[:], bodyData)
+	cleartext, err := decryptCiphertext(envelope.IV[:], ciphertext)
 	if err != nil {
 		return fmt.Errorf("couldn't decrypt ciphertext: %v", err)
 	}
+	event.Cleartext = cleartext
 	log.Info("unknown packet cleartext", slog.Any("cleartext", cleartext))
 	return nil
 }
 
+// metricsPacket is an outbound metrics packet decoded according to the layout
+// of the device which sent it.
+type metricsPacket struct {
+	OutboundEnvelopeTS
+	device    Device
+	cleartext []byte
+	reading   Reading
+}
+
+// unmarshalFixed unmarshals the cleartext into body, the fixed struct of the
+// packet type. It returns false if the cleartext is a different size, as sent
+// by devices with other layouts.
+func (p *metricsPacket) unmarshalFixed(body any) bool {
+	return len(p.cleartext) == binary.Size(body) &&
+		unmarshalFixed(p.cleartext, body) == nil
+}
+
+// unmarshalMetrics decodes the envelope and ciphertext of a metrics packet.
+// The layout of the device which sent it must describe the packet type.
+func (h *OutboundPacketHandler) unmarshalMetrics(
+	packetType PacketType,
+	data []byte,
+) (*metricsPacket, error) {
+	var p metricsPacket
+	ciphertext, err := unmarshalEnvelope(data, &p.OutboundEnvelopeTS)
+	if err != nil {
+		return nil, err
+	}
+	if p.device, err = h.registry.lookup(p.DeviceID); err != nil {
+		return nil, err
+	}
+	if p.cleartext, err = decryptCiphertext(p.IV[:], ciphertext); err != nil {
+		return nil, err
+	}
+	p.reading, err = decodeReading(p.device.Layout, packetType, p.cleartext)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// fixedPacket returns the packet decoded with the fixed struct of its packet
+// type. It returns nil if the packet type has no fixed struct, or if the
+// cleartext is a different size.
+func (p *metricsPacket) fixedPacket(packetType PacketType) any {
+	switch packetType {
+	case meterMetrics0, meterMetrics1:
+		packet := &OutboundMeterMetricsPacket{OutboundEnvelopeTS: p.OutboundEnvelopeTS}
+		if p.unmarshalFixed(&packet.OutboundMeterMetrics) {
+			return packet
+		}
+	case inverterMetrics0:
+		packet := &OutboundInverterMetrics0Packet{OutboundEnvelopeTS: p.OutboundEnvelopeTS}
+		if p.unmarshalFixed(&packet.OutboundInverterMetrics0) {
+			return packet
+		}
+	case inverterMetrics1:
+		packet := &OutboundInverterMetrics1Packet{OutboundEnvelopeTS: p.OutboundEnvelopeTS}
+		if p.unmarshalFixed(&packet.OutboundInverterMetrics1) {
+			return packet
+		}
+	}
+	return nil
+}
+
+// handleMetricsPacket handles metrics packet envelope and ciphertext. If
+// batsignal is enabled it returns the rewritten frame of a meter metrics
+// packet.
+func (h *OutboundPacketHandler) handleMetricsPacket(
+	ctx context.Context,
+	log *slog.Logger,
+	packetType PacketType,
+	headerData []byte,
+	bodyData []byte,
+) ([]byte, error) {
+	metrics, err := h.unmarshalMetrics(packetType, bodyData)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal metrics: %v", err)
+	}
+	log.Debug("outbound metrics",
+		slog.String("device", metrics.device.Type),
+		slog.String("model", metrics.device.Model),
+		slog.String("serial", string(metrics.DeviceSerial[:])))
+	h.observer.Observe(ctx, MetricsEvent{
+		Source: Source{
+			Device: metrics.device,
+			Serial: string(metrics.DeviceSerial[:]),
+		},
+		PacketType: packetType,
+		Cached:     slices.Contains(metrics.reading.Layout.Cached, packetType),
+		Timestamp:  metrics.Timestamp.Time(),
+		Reading:    metrics.reading,
+		Packet:     metrics.fixedPacket(packetType),
+	})
+	if !h.batsignal || (packetType != meterMetrics0 && packetType != meterMetrics1) {
+		return nil, nil
+	}
+	var batmetrics OutboundMeterMetricsPacket
+	if err = batmetrics.UnmarshalBinary(bodyData); err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal metrics: %v", err)
+	}
+	newBodyData, err := batsignal(&batmetrics)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't signal batman: %v", err)
+	}
+	var fullPacket []byte
+	fullPacket = append(fullPacket, headerData...)
+	fullPacket = append(fullPacket, newBodyData...)
+	fullPacket =
+		outboundCRCByteOrder.AppendUint16(fullPacket, goodwe.CRC(fullPacket))
+	return fullPacket, nil
+}
+
+// observeMetrics records the reading of a metrics packet. Cached readings are
+// not written to the live gauges. Packets of 0x01xx types are counted as
+// inverter packets, and others as meter packets.
+func (o *PrometheusObserver) observeMetrics(e MetricsEvent) {
+	labels := e.labels()
+	packetsTotal, cachedPacketsTotal, cacheLagSeconds :=
+		meterMetricsPacketsTotal, meterCachedPacketsTotal, meterCacheLagSeconds
+	if e.PacketType[0] == inverterMetrics0[0] {
+		packetsTotal, cachedPacketsTotal, cacheLagSeconds =
+			inverterMetricsPacketsTotal, inverterCachedPacketsTotal,
+			inverterCacheLagSeconds
+	}
+	// record internal metrics
+	packetsTotal.With(labels).Inc()
+	if e.Cached {
+		o.observeCached(cachedPacketsTotal, cacheLagSeconds, labels, e.Timestamp)
+		return
+	}
+	// record metrics
+	o.observeReading(labels, e.Reading)
+}
+
 // OutboundPacketHandler is a PacketHandler for outbound packets.
 type OutboundPacketHandler struct {
 	batsignal bool
+	registry  *Registry
+	observer  Observer
 }
 
-// NewOutboundPacketHandler constructs an OutboundPacketHandler.
-func NewOutboundPacketHandler(batsignal bool) *OutboundPacketHandler {
+// NewOutboundPacketHandler constructs an OutboundPacketHandler which
+// publishes events to the given observer.
+func NewOutboundPacketHandler(
+	batsignal bool,
+	registry *Registry,
+	observer Observer,
+) *OutboundPacketHandler {
 	return &OutboundPacketHandler{
 		batsignal: batsignal,
+		registry:  registry,
+		observer:  observer,
 	}
 }
 
@@ -91,6 +244,13 @@ func (h *OutboundPacketHandler) HandlePacket(
 	}
 	// slice up the header and body, and discard CRC bytes
 	header := OutboundHeader{}
+	if len(data) < binary.Size(header)+2 {
+		return nil, &TruncatedError{
+			Type: "frame",
+			Need: binary.Size(header) + 2,
+			Got:  len(data),
+		}
+	}
 	headerData, bodyData :=
 		data[:binary.Size(header)], data[binary.Size(header):len(data)-2]
 	if err := header.UnmarshalBinary(headerData); err != nil {
@@ -104,55 +264,36 @@ func (h *OutboundPacketHandler) HandlePacket(
 	}
 	switch header.PacketType {
 	case meterTimeSync:
-		if err := handleMeterTimeSyncPacket(bodyData, log); err != nil {
+		err := h.handleMeterTimeSyncPacket(ctx, log, header.PacketType, bodyData)
+		if err != nil {
 			return nil,
 				fmt.Errorf("couldn't handle meter time sync packet: %v", err)
 		}
 		return nil, nil
-	case meterMetrics0, meterMetrics1:
-		metrics, err := handleMeterMetricsPacket(bodyData, log)
-		if err != nil {
-			return nil, fmt.Errorf("couldn't handle meter metrics packet: %v", err)
-		}
-		if h.batsignal {
-			newBodyData, err := batsignal(metrics)
-			if err != nil {
-				return nil, fmt.Errorf("couldn't signal batman: %v", err)
-			}
-			var fullPacket []byte
-			fullPacket = append(fullPacket, headerData...)
-			fullPacket = append(fullPacket, newBodyData...)
-			fullPacket =
-				outboundCRCByteOrder.AppendUint16(fullPacket, goodwe.CRC(fullPacket))
-			return fullPacket, nil
-		}
-		return nil, nil
 	case meterTimeSyncRespAck, inverterTimeSyncRespAck:
-		if err := handleTimeSyncRespAckPacket(bodyData, log); err != nil {
+		err := h.handleTimeSyncRespAckPacket(ctx, log, header.PacketType, bodyData)
+		if err != nil {
 			return nil,
 				fmt.Errorf("couldn't handle time sync response ack packet: %v", err)
 		}
 		return nil, nil
-	case inverterMetrics0:
-		if err := handleInverterMetrics0Packet(bodyData, log); err != nil {
-			return nil,
-				fmt.Errorf("couldn't handle inverter metrics packet: %v", err)
-		}
-		return nil, nil
-	case inverterMetrics1:
-		if err := handleInverterMetrics1Packet(bodyData, log); err != nil {
-			return nil,
-				fmt.Errorf("couldn't handle inverter metrics packet: %v", err)
-		}
-		return nil, nil
 	case inverterTimeSync:
-		if err := handleInverterTimeSyncPacket(bodyData, log); err != nil {
+		err := h.handleInverterTimeSyncPacket(ctx, log, header.PacketType, bodyData)
+		if err != nil {
 			return nil,
 				fmt.Errorf("couldn't handle inverter time sync packet: %v", err)
 		}
 		return nil, nil
 	default:
-		if err := handleUnknownOutboundPacket(bodyData, log); err != nil {
+		if isMetricsPacket(header.PacketType) {
+			return h.handleMetricsPacket(ctx, log, header.PacketType, headerData,
+				bodyData)
+		}
+		// log the full frame so it can be passed to the decode command
+		log = log.With(slog.String("frame", hex.EncodeToString(data)))
+		err := h.handleUnknownOutboundPacket(ctx, log, header.PacketType, data,
+			bodyData)
+		if err != nil {
 			return nil, fmt.Errorf("couldn't handle unknown packet: %v", err)
 		}
 		return nil, fmt.Errorf("unknown packet type")
@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -14,6 +16,7 @@ import (
 	"time"
 
 	"github.com/alecthomas/assert/v2"
+	"github.com/smlx/goodwe"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -124,7 +127,7 @@ func TestHandleOutboundPacket(t *testing.T) {
 	ctx := context.Background()
 	log := slog.New(slog.NewJSONHandler(os.Stderr,
 		&slog.HandlerOptions{Level: slog.LevelDebug}))
-	ph := NewOutboundPacketHandler(false)
+	ph := NewOutboundPacketHandler(false, defaultRegistry(t), Observers{})
 	for name, tc := range testCases {
 		t.Run(name, func(tt *testing.T) {
 			_, err := ph.HandlePacket(ctx, log, tc.input)
@@ -219,7 +222,8 @@ func TestHandleOutbound(t *testing.T) {
 			upstreamRead, upstreamWrite := net.Pipe()
 			clientRead, clientWrite := net.Pipe()
 			// set up context, and ensure it times out
-			ctx, cancel := context.WithTimeout(context.Background(), 2*readTimeout)
+			// allow time for an incomplete frame to be skipped as truncated
+			ctx, cancel := context.WithTimeout(context.Background(), 3*readTimeout)
 			defer cancel()
 			// set up the reader since pipe blocks writes otherwise
 			var eg errgroup.Group
@@ -247,9 +251,13 @@ func TestHandleOutbound(t *testing.T) {
 				return err
 			})
 			// test the function
-			mitmSrv := NewServer(false)
+			mitmSrv, err := NewServer(false, true)
+			assert.NoError(tt, err, name)
+			mitmSrv.frameTimeout = 0
 			assert.NoError(tt, mitmSrv.handleConn(ctx, log, clientRead, upstreamWrite,
-				outboundPrefix, true, NewOutboundPacketHandler(false)), name)
+				outboundPrefix, DefaultOutboundPolicy,
+				NewOutboundPacketHandler(false, mitmSrv.registry, mitmSrv.observers)),
+				name)
 			if err := eg.Wait(); err != nil {
 				tt.Fatal(err)
 			}
@@ -264,6 +272,10 @@ func TestHandleOutbound(t *testing.T) {
 			testBuf := bufio.NewReader(bytes.NewBuffer(tc.input))
 			packet, err := readPacket(testBuf, outboundPrefix)
 			for ; len(packet) > 0; packet, err = readPacket(testBuf, outboundPrefix) {
+				var framingErr *FramingError
+				if errors.As(err, &framingErr) {
+					continue
+				}
 				assert.NoError(tt, err, name)
 				deviceSerial, err = deviceSerialOutbound(packet)
 				assert.NoError(tt, err, name)
@@ -274,3 +286,57 @@ func TestHandleOutbound(t *testing.T) {
 		})
 	}
 }
+
+// outboundSeeds returns valid outbound frames, for use as a fuzzing corpus.
+func outboundSeeds(tb testing.TB) [][]byte {
+	tb.Helper()
+	meter := OutboundEnvelopeTS{
+		DeviceID:     [8]byte([]byte("91000HKU")),
+		DeviceSerial: [8]byte([]byte(testDeviceSerial)),
+	}
+	inverter := OutboundEnvelopeTS{
+		DeviceID:     [8]byte([]byte("53000DSC")),
+		DeviceSerial: [8]byte([]byte(testDeviceSerial)),
+	}
+	packets := []struct {
+		packetType PacketType
+		packet     encoding.BinaryMarshaler
+	}{
+		{meterMetrics0, &OutboundMeterMetricsPacket{OutboundEnvelopeTS: meter}},
+		{inverterMetrics0,
+			&OutboundInverterMetrics0Packet{OutboundEnvelopeTS: inverter}},
+		{inverterMetrics1,
+			&OutboundInverterMetrics1Packet{OutboundEnvelopeTS: inverter}},
+		{inverterTimeSync,
+			&OutboundInverterTimeSyncPacket{OutboundEnvelopeTS: inverter}},
+	}
+	var frames [][]byte
+	for _, p := range packets {
+		body, err := p.packet.MarshalBinary()
+		assert.NoError(tb, err)
+		header := OutboundHeader{
+			PostGW:     [6]byte(outboundPrefix),
+			Length:     uint32(len(body) + 1), // off-by-one
+			PacketType: p.packetType,
+		}
+		frame, err := header.MarshalBinary()
+		assert.NoError(tb, err)
+		frame = append(frame, body...)
+		frames = append(frames,
+			outboundCRCByteOrder.AppendUint16(frame, goodwe.CRC(frame)))
+	}
+	return frames
+}
+
+func FuzzHandleOutboundPacket(f *testing.F) {
+	for _, frame := range outboundSeeds(f) {
+		f.Add(frame)
+	}
+	observer, err := NewPrometheusObserver(MetricStyleBoth, 0, StaleActionDelete)
+	assert.NoError(f, err)
+	ph := NewOutboundPacketHandler(true, defaultRegistry(f), observer)
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = ph.HandlePacket(context.Background(), log, data)
+	})
+}
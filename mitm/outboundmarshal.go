@@ -24,8 +24,7 @@ func (h *OutboundHeader) MarshalBinary() ([]byte, error) {
 
 // UnmarshalBinary implements binary.Unmarshaler
 func (h *OutboundHeader) UnmarshalBinary(data []byte) error {
-	buf := bytes.NewBuffer(data)
-	return binary.Read(buf, binary.BigEndian, h)
+	return unmarshalFixed(data, h)
 }
 
 // OutboundEnvelopeTS is the plaintext wrapper, with a timestamp, around the
@@ -98,26 +97,11 @@ func (p *OutboundMeterMetricsPacket) MarshalBinary() ([]byte, error) {
 
 // UnmarshalBinary implements binary.Unmarshaler
 func (p *OutboundMeterMetricsPacket) UnmarshalBinary(data []byte) error {
-	envData, bodyData := data[:binary.Size(p.OutboundEnvelopeTS)],
-		data[binary.Size(p.OutboundEnvelopeTS):]
-	envBuf := bytes.NewBuffer(envData)
-	err := binary.Read(envBuf, binary.BigEndian, &p.OutboundEnvelopeTS)
+	ciphertext, err := unmarshalEnvelope(data, &p.OutboundEnvelopeTS)
 	if err != nil {
-		return fmt.Errorf("couldn't read unmarshal %T: %v", p.OutboundEnvelopeTS, err)
+		return err
 	}
-	cleartext, err := decryptCiphertext(p.IV[:], bodyData)
-	if err != nil {
-		return fmt.Errorf("couldn't decrypt ciphertext: %v", err)
-	}
-	if len(cleartext) != binary.Size(p.OutboundMeterMetrics) {
-		return fmt.Errorf("invalid cleartext length: %d", len(cleartext))
-	}
-	buf := bytes.NewBuffer(cleartext)
-	err = binary.Read(buf, binary.BigEndian, &p.OutboundMeterMetrics)
-	if err != nil {
-		return fmt.Errorf("couldn't read cleartext: %v", err)
-	}
-	return nil
+	return unmarshalCleartext(p.IV[:], ciphertext, &p.OutboundMeterMetrics)
 }
 
 // OutboundMeterTimeSync is the cleartext body of an outbound time sync packet.
@@ -139,25 +123,11 @@ type OutboundMeterTimeSyncPacket struct {
 
 // UnmarshalBinary implements binary.Unmarshaler
 func (p *OutboundMeterTimeSyncPacket) UnmarshalBinary(data []byte) error {
-	envData, bodyData := data[:binary.Size(p.OutboundEnvelopeTS)],
-		data[binary.Size(p.OutboundEnvelopeTS):]
-	envBuf := bytes.NewBuffer(envData)
-	err := binary.Read(envBuf, binary.BigEndian, &p.OutboundEnvelopeTS)
-	if err != nil {
-		return fmt.Errorf("couldn't read unmarshal %T: %v", p.OutboundEnvelopeTS, err)
-	}
-	cleartext, err := decryptCiphertext(p.IV[:], bodyData)
+	ciphertext, err := unmarshalEnvelope(data, &p.OutboundEnvelopeTS)
 	if err != nil {
-		return fmt.Errorf("couldn't decrypt ciphertext: %v", err)
-	}
-	if len(cleartext) != binary.Size(p.OutboundMeterTimeSync) {
-		return fmt.Errorf("invalid cleartext length: %d", len(cleartext))
+		return err
 	}
-	buf := bytes.NewBuffer(cleartext)
-	if err := binary.Read(buf, binary.BigEndian, &p.OutboundMeterTimeSync); err != nil {
-		return fmt.Errorf("couldn't read cleartext: %v", err)
-	}
-	return nil
+	return unmarshalCleartext(p.IV[:], ciphertext, &p.OutboundMeterTimeSync)
 }
 
 // OutboundEnvelope is the plaintext wrapper around the ciphertext.
@@ -182,26 +152,11 @@ type OutboundTimeSyncRespAckPacket struct {
 
 // UnmarshalBinary implements binary.Unmarshaler
 func (p *OutboundTimeSyncRespAckPacket) UnmarshalBinary(data []byte) error {
-	envData, bodyData := data[:binary.Size(p.OutboundEnvelope)],
-		data[binary.Size(p.OutboundEnvelope):]
-	envBuf := bytes.NewBuffer(envData)
-	err := binary.Read(envBuf, binary.BigEndian, &p.OutboundEnvelope)
-	if err != nil {
-		return fmt.Errorf("couldn't read unmarshal %T: %v", p.OutboundEnvelope, err)
-	}
-	cleartext, err := decryptCiphertext(p.IV[:], bodyData)
+	ciphertext, err := unmarshalEnvelope(data, &p.OutboundEnvelope)
 	if err != nil {
-		return fmt.Errorf("couldn't decrypt ciphertext: %v", err)
-	}
-	if len(cleartext) != binary.Size(p.OutboundTimeSyncRespAck) {
-		return fmt.Errorf("invalid cleartext length: %d", len(cleartext))
+		return err
 	}
-	buf := bytes.NewBuffer(cleartext)
-	err = binary.Read(buf, binary.BigEndian, &p.OutboundTimeSyncRespAck)
-	if err != nil {
-		return fmt.Errorf("couldn't read cleartext: %v", err)
-	}
-	return nil
+	return unmarshalCleartext(p.IV[:], ciphertext, &p.OutboundTimeSyncRespAck)
 }
 
 // outboundInverterMetricsCommon0 is the first common block of fields in
@@ -375,26 +330,11 @@ func (p *OutboundInverterMetrics0Packet) MarshalBinary() ([]byte, error) {
 
 // UnmarshalBinary implements binary.Unmarshaler
 func (p *OutboundInverterMetrics0Packet) UnmarshalBinary(data []byte) error {
-	envData, bodyData := data[:binary.Size(p.OutboundEnvelopeTS)],
-		data[binary.Size(p.OutboundEnvelopeTS):]
-	envBuf := bytes.NewBuffer(envData)
-	err := binary.Read(envBuf, binary.BigEndian, &p.OutboundEnvelopeTS)
+	ciphertext, err := unmarshalEnvelope(data, &p.OutboundEnvelopeTS)
 	if err != nil {
-		return fmt.Errorf("couldn't read unmarshal %T: %v", p.OutboundEnvelopeTS, err)
+		return err
 	}
-	cleartext, err := decryptCiphertext(p.IV[:], bodyData)
-	if err != nil {
-		return fmt.Errorf("couldn't decrypt ciphertext: %v", err)
-	}
-	if len(cleartext) != binary.Size(p.OutboundInverterMetrics0) {
-		return fmt.Errorf("invalid cleartext length: %d", len(cleartext))
-	}
-	buf := bytes.NewBuffer(cleartext)
-	err = binary.Read(buf, binary.BigEndian, &p.OutboundInverterMetrics0)
-	if err != nil {
-		return fmt.Errorf("couldn't read cleartext: %v", err)
-	}
-	return nil
+	return unmarshalCleartext(p.IV[:], ciphertext, &p.OutboundInverterMetrics0)
 }
 
 // OutboundInverterMetrics1 is the cleartext body of an outbound metrics packet.
@@ -477,26 +417,11 @@ func (p *OutboundInverterMetrics1Packet) MarshalBinary() ([]byte, error) {
 
 // UnmarshalBinary implements binary.Unmarshaler
 func (p *OutboundInverterMetrics1Packet) UnmarshalBinary(data []byte) error {
-	envData, bodyData := data[:binary.Size(p.OutboundEnvelopeTS)],
-		data[binary.Size(p.OutboundEnvelopeTS):]
-	envBuf := bytes.NewBuffer(envData)
-	err := binary.Read(envBuf, binary.BigEndian, &p.OutboundEnvelopeTS)
-	if err != nil {
-		return fmt.Errorf("couldn't read unmarshal %T: %v", p.OutboundEnvelopeTS, err)
-	}
-	cleartext, err := decryptCiphertext(p.IV[:], bodyData)
-	if err != nil {
-		return fmt.Errorf("couldn't decrypt ciphertext: %v", err)
-	}
-	if len(cleartext) != binary.Size(p.OutboundInverterMetrics1) {
-		return fmt.Errorf("invalid cleartext length: %d", len(cleartext))
-	}
-	buf := bytes.NewBuffer(cleartext)
-	err = binary.Read(buf, binary.BigEndian, &p.OutboundInverterMetrics1)
+	ciphertext, err := unmarshalEnvelope(data, &p.OutboundEnvelopeTS)
 	if err != nil {
-		return fmt.Errorf("couldn't read cleartext: %v", err)
+		return err
 	}
-	return nil
+	return unmarshalCleartext(p.IV[:], ciphertext, &p.OutboundInverterMetrics1)
 }
 
 // OutboundInverterTimeSync is the cleartext body of an outbound metrics packet.
@@ -730,24 +655,9 @@ func (p *OutboundInverterTimeSyncPacket) MarshalBinary() ([]byte, error) {
 
 // UnmarshalBinary implements binary.Unmarshaler
 func (p *OutboundInverterTimeSyncPacket) UnmarshalBinary(data []byte) error {
-	envData, bodyData := data[:binary.Size(p.OutboundEnvelopeTS)],
-		data[binary.Size(p.OutboundEnvelopeTS):]
-	envBuf := bytes.NewBuffer(envData)
-	err := binary.Read(envBuf, binary.BigEndian, &p.OutboundEnvelopeTS)
-	if err != nil {
-		return fmt.Errorf("couldn't read unmarshal %T: %v", p.OutboundEnvelopeTS, err)
-	}
-	cleartext, err := decryptCiphertext(p.IV[:], bodyData)
-	if err != nil {
-		return fmt.Errorf("couldn't decrypt ciphertext: %v", err)
-	}
-	if len(cleartext) != binary.Size(p.OutboundInverterTimeSync) {
-		return fmt.Errorf("invalid cleartext length: %d", len(cleartext))
-	}
-	buf := bytes.NewBuffer(cleartext)
-	err = binary.Read(buf, binary.BigEndian, &p.OutboundInverterTimeSync)
+	ciphertext, err := unmarshalEnvelope(data, &p.OutboundEnvelopeTS)
 	if err != nil {
-		return fmt.Errorf("couldn't read cleartext: %v", err)
+		return err
 	}
-	return nil
+	return unmarshalCleartext(p.IV[:], ciphertext, &p.OutboundInverterTimeSync)
 }
@@ -1,6 +1,7 @@
 package mitm
 
 import (
+	"encoding/binary"
 	"testing"
 
 	"github.com/alecthomas/assert/v2"
@@ -374,3 +375,21 @@ func TestUnmarshalInverterTimeSync(t *testing.T) {
 		})
 	}
 }
+
+func FuzzOutboundUnmarshalBinary(f *testing.F) {
+	for _, frame := range outboundSeeds(f) {
+		f.Add(frame[binary.Size(OutboundHeader{}) : len(frame)-2])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var header OutboundHeader
+		_ = header.UnmarshalBinary(data)
+		for _, newPacket := range outboundPackets {
+			_ = newPacket().UnmarshalBinary(data)
+		}
+		// metrics packets are decoded with packet layouts, but the structs are
+		// still used to re-marshal packets
+		_ = new(OutboundMeterMetricsPacket).UnmarshalBinary(data)
+		_ = new(OutboundInverterMetrics0Packet).UnmarshalBinary(data)
+		_ = new(OutboundInverterMetrics1Packet).UnmarshalBinary(data)
+	})
+}
@@ -0,0 +1,148 @@
+package mitm
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/smlx/goodwe/capture"
+)
+
+// PolicyAction is the action a Policy takes on a packet.
+type PolicyAction string
+
+// PolicyAction values.
+const (
+	// PolicyActionAllow forwards the packet.
+	PolicyActionAllow PolicyAction = "allow"
+	// PolicyActionDeny drops the packet.
+	PolicyActionDeny PolicyAction = "deny"
+)
+
+// invalidPacketType is the packet_type label value of blocked frames which
+// don't have a valid header and CRC.
+const invalidPacketType = "invalid"
+
+var (
+	// DefaultInboundPolicy only forwards packets from the SEMS portal which
+	// are understood by the Server. This blocks unknown commands such as
+	// firmware upgrades.
+	DefaultInboundPolicy = Policy{Default: PolicyActionDeny}
+	// DefaultOutboundPolicy forwards all packets from devices.
+	DefaultOutboundPolicy = Policy{Default: PolicyActionAllow}
+	// prometheus metrics
+	inboundBlockedPacketsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "inbound_blocked_packets_total",
+		Help: "Count of inbound packets blocked by the packet policy.",
+	}, []string{"packet_type"})
+	outboundBlockedPacketsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_blocked_packets_total",
+		Help: "Count of outbound packets blocked by the packet policy.",
+	}, []string{"packet_type"})
+)
+
+// Policy decides which packets are forwarded in one direction of a
+// connection. A packet is:
+//
+//  1. denied if its type is in Deny;
+//  2. otherwise allowed if its type is in Allow;
+//  3. otherwise allowed if it was handled successfully;
+//  4. otherwise subject to the Default action.
+//
+// Frames which don't have a valid header and CRC are always subject to the
+// Default action. If Learn is true, packets which would be denied are logged
+// and forwarded anyway.
+type Policy struct {
+	Allow   []PacketType
+	Deny    []PacketType
+	Default PolicyAction
+	Learn   bool
+}
+
+// Validate the policy.
+func (p Policy) Validate() error {
+	switch p.Default {
+	case PolicyActionAllow, PolicyActionDeny:
+	default:
+		return fmt.Errorf("invalid default action: %q", p.Default)
+	}
+	for _, pt := range p.Allow {
+		if slices.Contains(p.Deny, pt) {
+			return fmt.Errorf("packet type %v is both allowed and denied", pt)
+		}
+	}
+	return nil
+}
+
+// decide returns the action for a packet of the given type, and the reason
+// for it. If valid is false the packet type is unknown.
+func (p Policy) decide(
+	packetType PacketType,
+	valid bool,
+	handled bool,
+) (PolicyAction, string) {
+	switch {
+	case !valid:
+		return p.Default, "invalid frame"
+	case slices.Contains(p.Deny, packetType):
+		return PolicyActionDeny, "deny list"
+	case slices.Contains(p.Allow, packetType):
+		return PolicyActionAllow, "allow list"
+	case handled:
+		return PolicyActionAllow, "handled"
+	default:
+		return p.Default, "default action"
+	}
+}
+
+// forward returns true if the frame in data, read with the given prefix,
+// should be forwarded. Blocked frames are logged and counted.
+func (p Policy) forward(
+	log *slog.Logger,
+	packetPrefix []byte,
+	data []byte,
+	handled bool,
+) bool {
+	packetType, valid := framePacketType(data, packetPrefix)
+	action, reason := p.decide(packetType, valid, handled)
+	if action == PolicyActionAllow {
+		return true
+	}
+	label := invalidPacketType
+	if valid {
+		label = packetType.String()
+	}
+	log = log.With(
+		slog.String("packetType", label),
+		slog.String("reason", reason),
+		slog.String("frame", hex.EncodeToString(data)))
+	if p.Learn {
+		log.Info("packet would be blocked by policy")
+		return true
+	}
+	log.Warn("packet blocked by policy")
+	if direction(packetPrefix) == capture.DirectionOutbound {
+		outboundBlockedPacketsTotal.WithLabelValues(label).Inc()
+	} else {
+		inboundBlockedPacketsTotal.WithLabelValues(label).Inc()
+	}
+	return false
+}
+
+// framePacketType returns the packet type from the header of the frame in
+// data, read with the given prefix. It returns false if the frame is too
+// short or the CRC is invalid.
+func framePacketType(data, packetPrefix []byte) (PacketType, bool) {
+	// prefix + length + packet type
+	headerSize := len(packetPrefix) + 4 + 2
+	if len(data) < headerSize+2 {
+		return PacketType{}, false
+	}
+	if validateCRC(data, crcByteOrder(packetPrefix)) != nil {
+		return PacketType{}, false
+	}
+	return PacketType(data[headerSize-2 : headerSize]), true
+}
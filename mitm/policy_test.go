@@ -0,0 +1,199 @@
+package mitm
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/smlx/goodwe"
+)
+
+// testFrame returns a frame with an empty body and a valid CRC.
+func testFrame(
+	packetPrefix []byte,
+	packetType PacketType,
+	bo binary.AppendByteOrder,
+) []byte {
+	frame := append([]byte{}, packetPrefix...)
+	frame = append(frame, 0x00, 0x00, 0x00, 0x01)
+	frame = append(frame, packetType[:]...)
+	return bo.AppendUint16(frame, goodwe.CRC(frame))
+}
+
+// counterValue returns the value of the given counter.
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	assert.NoError(t, c.Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func TestPolicyForward(t *testing.T) {
+	firmware := PacketType{0x7f, 0x01}
+	benign := PacketType{0x7f, 0x02}
+	invalid := testFrame(inboundPrefix, firmware, inboundCRCByteOrder)
+	invalid[len(invalid)-1] ^= 0xff
+	var testCases = map[string]struct {
+		policy        Policy
+		packetPrefix  []byte
+		data          []byte
+		handled       bool
+		expectForward bool
+		expectBlocked string
+	}{
+		"inbound handled": {
+			policy:       DefaultInboundPolicy,
+			packetPrefix: inboundPrefix,
+			data: testFrame(inboundPrefix, meterTimeSyncResp,
+				inboundCRCByteOrder),
+			handled:       true,
+			expectForward: true,
+		},
+		"inbound unknown": {
+			policy:       DefaultInboundPolicy,
+			packetPrefix: inboundPrefix,
+			data: testFrame(inboundPrefix, firmware,
+				inboundCRCByteOrder),
+			expectBlocked: "0x7f01",
+		},
+		"inbound invalid": {
+			policy:        DefaultInboundPolicy,
+			packetPrefix:  inboundPrefix,
+			data:          invalid,
+			expectBlocked: invalidPacketType,
+		},
+		"inbound allow list": {
+			policy:       Policy{Allow: []PacketType{benign}, Default: PolicyActionDeny},
+			packetPrefix: inboundPrefix,
+			data: testFrame(inboundPrefix, benign,
+				inboundCRCByteOrder),
+			expectForward: true,
+		},
+		"inbound allow list invalid": {
+			policy:        Policy{Allow: []PacketType{firmware}, Default: PolicyActionDeny},
+			packetPrefix:  inboundPrefix,
+			data:          invalid,
+			expectBlocked: invalidPacketType,
+		},
+		"inbound deny list handled": {
+			policy: Policy{
+				Deny:    []PacketType{meterTimeSyncResp},
+				Default: PolicyActionDeny,
+			},
+			packetPrefix: inboundPrefix,
+			data: testFrame(inboundPrefix, meterTimeSyncResp,
+				inboundCRCByteOrder),
+			handled:       true,
+			expectBlocked: "0x0116",
+		},
+		"inbound learn": {
+			policy:       Policy{Default: PolicyActionDeny, Learn: true},
+			packetPrefix: inboundPrefix,
+			data: testFrame(inboundPrefix, firmware,
+				inboundCRCByteOrder),
+			expectForward: true,
+		},
+		"outbound unknown": {
+			policy:       DefaultOutboundPolicy,
+			packetPrefix: outboundPrefix,
+			data: testFrame(outboundPrefix, firmware,
+				outboundCRCByteOrder),
+			expectForward: true,
+		},
+		"outbound deny list": {
+			policy: Policy{
+				Deny:    []PacketType{firmware},
+				Default: PolicyActionAllow,
+			},
+			packetPrefix: outboundPrefix,
+			data: testFrame(outboundPrefix, firmware,
+				outboundCRCByteOrder),
+			expectBlocked: "0x7f01",
+		},
+	}
+	log := slog.New(slog.NewJSONHandler(os.Stderr,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			blocked := inboundBlockedPacketsTotal
+			if direction(tc.packetPrefix) == "outbound" {
+				blocked = outboundBlockedPacketsTotal
+			}
+			var before float64
+			if tc.expectBlocked != "" {
+				before = counterValue(tt,
+					blocked.WithLabelValues(tc.expectBlocked))
+			}
+			assert.Equal(tt, tc.expectForward,
+				tc.policy.forward(log, tc.packetPrefix, tc.data, tc.handled), name)
+			if tc.expectBlocked != "" {
+				assert.Equal(tt, before+1, counterValue(tt,
+					blocked.WithLabelValues(tc.expectBlocked)), name)
+			}
+		})
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	var testCases = map[string]struct {
+		policy      Policy
+		expectError bool
+	}{
+		"default inbound":  {policy: DefaultInboundPolicy},
+		"default outbound": {policy: DefaultOutboundPolicy},
+		"missing default":  {policy: Policy{}, expectError: true},
+		"invalid default": {
+			policy:      Policy{Default: "drop"},
+			expectError: true,
+		},
+		"allowed and denied": {
+			policy: Policy{
+				Allow:   []PacketType{meterMetricsAck0, meterTimeSyncResp},
+				Deny:    []PacketType{meterTimeSyncResp},
+				Default: PolicyActionDeny,
+			},
+			expectError: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			err := tc.policy.Validate()
+			if tc.expectError {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+		})
+	}
+}
+
+func TestPacketTypeUnmarshalText(t *testing.T) {
+	var testCases = map[string]struct {
+		input       string
+		expect      PacketType
+		expectError bool
+	}{
+		"prefixed":     {input: "0x0304", expect: meterMetricsAck0},
+		"upper case":   {input: "0X01A0", expect: PacketType{0x01, 0xa0}},
+		"bare":         {input: "0116", expect: meterTimeSyncResp},
+		"too short":    {input: "0x116", expectError: true},
+		"not hex":      {input: "0x01zz", expectError: true},
+		"empty string": {input: "", expectError: true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			var pt PacketType
+			err := pt.UnmarshalText([]byte(tc.input))
+			if tc.expectError {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+				assert.Equal(tt, tc.expect, pt, name)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package mitm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/smlx/goodwe/capture"
+)
+
+// MetricStyle selects the names and units of exported device metrics.
+type MetricStyle string
+
+// MetricStyle values.
+const (
+	// MetricStyleLegacy exports metrics in the scaled integer units reported
+	// by the device (e.g. decivolts), with cumulative totals as gauges.
+	MetricStyleLegacy MetricStyle = "legacy"
+	// MetricStyleSI exports metrics converted to base units (e.g. volts), with
+	// cumulative totals as counters.
+	MetricStyleSI MetricStyle = "si"
+	// MetricStyleBoth exports both legacy and SI metrics.
+	MetricStyleBoth MetricStyle = "both"
+)
+
+// legacy returns true if legacy metrics should be exported.
+func (s MetricStyle) legacy() bool {
+	return s == MetricStyleLegacy || s == MetricStyleBoth
+}
+
+// si returns true if SI metrics should be exported.
+func (s MetricStyle) si() bool {
+	return s == MetricStyleSI || s == MetricStyleBoth
+}
+
+// PrometheusObserver is an Observer which records events as Prometheus
+// metrics in the default registry.
+type PrometheusObserver struct {
+	style        MetricStyle
+	staleTimeout time.Duration
+	staleAction  StaleAction
+	now          func() time.Time
+
+	mu sync.Mutex
+	// lastSeen is keyed by labelKey.
+	lastSeen map[string]*lastSeen
+	// info is the last goodwe_device_info labels of each device, keyed by
+	// labelKey.
+	info map[string]prometheus.Labels
+}
+
+// NewPrometheusObserver constructs a PrometheusObserver which exports device
+// metrics in the given style. Metrics which are already in base units (e.g.
+// watts) are exported in all styles.
+//
+// If staleTimeout is not zero, the given action is taken on the metrics of
+// devices which are silent for longer than staleTimeout. This requires Run to
+// be called.
+func NewPrometheusObserver(
+	style MetricStyle,
+	staleTimeout time.Duration,
+	staleAction StaleAction,
+) (*PrometheusObserver, error) {
+	switch style {
+	case MetricStyleLegacy, MetricStyleSI, MetricStyleBoth:
+	default:
+		return nil, fmt.Errorf("invalid metric style %q", style)
+	}
+	switch staleAction {
+	case StaleActionDelete, StaleActionZero:
+	default:
+		return nil, fmt.Errorf("invalid stale action %q", staleAction)
+	}
+	if staleTimeout < 0 {
+		return nil, fmt.Errorf("invalid stale timeout %v", staleTimeout)
+	}
+	return &PrometheusObserver{
+		style:        style,
+		staleTimeout: staleTimeout,
+		staleAction:  staleAction,
+		now:          time.Now,
+		lastSeen:     map[string]*lastSeen{},
+		info:         map[string]prometheus.Labels{},
+	}, nil
+}
+
+// labels returns the Prometheus labels identifying the source.
+func (s Source) labels() prometheus.Labels {
+	return prometheus.Labels{
+		"device": s.Device.Type,
+		"model":  s.Device.Model,
+		"serial": s.Serial,
+	}
+}
+
+// Observe implements the Observer interface.
+func (o *PrometheusObserver) Observe(_ context.Context, e Event) {
+	// hold the lock while recording metrics so that they aren't concurrently
+	// expired
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch e := e.(type) {
+	case MetricsEvent:
+		o.touch(e.Source)
+		o.observeMetrics(e)
+	case TimeSyncEvent:
+		o.touch(e.Source)
+		o.observeDeviceInfo(e)
+		if e.PacketType == inverterTimeSync {
+			inverterTimeSyncPacketsTotal.With(e.labels()).Inc()
+		} else {
+			meterTimeSyncPacketsTotal.With(e.labels()).Inc()
+		}
+	case TimeSyncRespAckEvent:
+		o.touch(e.Source)
+		meterTimeSyncAckPacketsTotal.With(e.labels()).Inc()
+	case UnknownPacketEvent:
+		if e.Direction == capture.DirectionOutbound {
+			outboundUnknownPacketsTotal.Inc()
+		} else {
+			inboundUnknownPacketsTotal.Inc()
+		}
+	}
+}
+
+// labelValues returns the values of labels in the order of labelNames.
+func labelValues(labels prometheus.Labels) []string {
+	values := make([]string, len(labelNames))
+	for i, name := range labelNames {
+		values[i] = labels[name]
+	}
+	return values
+}
+
+// labelKey returns a map key identifying the given label values.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// totalVec is a vector of counters which are set directly from the cumulative
+// totals reported by devices, rather than incremented. It is registered in the
+// default registry.
+type totalVec struct {
+	desc *prometheus.Desc
+
+	mu     sync.Mutex
+	values map[string]labelledValue
+}
+
+// labelledValue is a single value of a totalVec.
+type labelledValue struct {
+	labelValues []string
+	value       float64
+}
+
+// newTotalVec constructs a totalVec. It must be registered to be exported.
+func newTotalVec(name, help string) *totalVec {
+	return &totalVec{
+		desc:   prometheus.NewDesc(name, help, labelNames, nil),
+		values: map[string]labelledValue{},
+	}
+}
+
+// Set the counter identified by labels to value.
+func (v *totalVec) Set(labels prometheus.Labels, value float64) {
+	labelValues := labelValues(labels)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[labelKey(labelValues)] = labelledValue{
+		labelValues: labelValues,
+		value:       value,
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (v *totalVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.desc
+}
+
+// Collect implements the prometheus.Collector interface.
+func (v *totalVec) Collect(ch chan<- prometheus.Metric) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, lv := range v.values {
+		ch <- prometheus.MustNewConstMetric(v.desc, prometheus.CounterValue,
+			lv.value, lv.labelValues...)
+	}
+}
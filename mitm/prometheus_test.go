@@ -0,0 +1,418 @@
+package mitm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatherSerial is a helper function which returns the value and type of each
+// metric in the default registry with the given serial label.
+func gatherSerial(
+	t *testing.T,
+	serial string,
+) (map[string]float64, map[string]dto.MetricType) {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	values := map[string]float64{}
+	types := map[string]dto.MetricType{}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() != "serial" || l.GetValue() != serial {
+					continue
+				}
+				switch family.GetType() {
+				case dto.MetricType_COUNTER:
+					values[family.GetName()] = m.GetCounter().GetValue()
+				case dto.MetricType_GAUGE:
+					values[family.GetName()] = m.GetGauge().GetValue()
+				}
+				types[family.GetName()] = family.GetType()
+			}
+		}
+	}
+	return values, types
+}
+
+func TestMetricStyle(t *testing.T) {
+	var testCases = map[string]struct {
+		style        MetricStyle
+		expectValues map[string]float64
+		expectAbsent []string
+		expectTypes  map[string]dto.MetricType
+	}{
+		"legacy": {
+			style: MetricStyleLegacy,
+			expectValues: map[string]float64{
+				"meter_power_export_watts":                          1557,
+				"meter_energy_export_decawatt_hours_total":          123456,
+				"inverter_output_voltage_ac_decivolts":              2403,
+				"inverter_output_frequency_ac_centihertz":           5002,
+				"inverter_internal_temperature_decidegrees_celsius": 456,
+				"inverter_energy_output_hectowatt_hours_total":      789,
+				"inverter_uptime_hours_total":                       12,
+			},
+			expectAbsent: []string{
+				"meter_energy_export_watt_hours_total",
+				"inverter_output_voltage_ac_volts",
+			},
+			expectTypes: map[string]dto.MetricType{
+				"meter_energy_export_decawatt_hours_total": dto.MetricType_GAUGE,
+			},
+		},
+		"si": {
+			style: MetricStyleSI,
+			expectValues: map[string]float64{
+				"meter_power_export_watts":                1557,
+				"meter_energy_export_watt_hours_total":    1234560,
+				"inverter_output_voltage_ac_volts":        240.3,
+				"inverter_output_frequency_ac_hertz":      50.02,
+				"inverter_internal_temperature_celsius":   45.6,
+				"inverter_energy_output_watt_hours_total": 78900,
+				"inverter_uptime_seconds_total":           43200,
+			},
+			expectAbsent: []string{
+				"meter_energy_export_decawatt_hours_total",
+				"inverter_output_voltage_ac_decivolts",
+			},
+			expectTypes: map[string]dto.MetricType{
+				"meter_energy_export_watt_hours_total":    dto.MetricType_COUNTER,
+				"inverter_energy_output_watt_hours_total": dto.MetricType_COUNTER,
+				"inverter_uptime_seconds_total":           dto.MetricType_COUNTER,
+			},
+		},
+		"both": {
+			style: MetricStyleBoth,
+			expectValues: map[string]float64{
+				"meter_power_export_watts":                 1557,
+				"meter_energy_export_decawatt_hours_total": 123456,
+				"meter_energy_export_watt_hours_total":     1234560,
+				"inverter_output_voltage_ac_decivolts":     2403,
+				"inverter_output_voltage_ac_volts":         240.3,
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			o, err := NewPrometheusObserver(tc.style, 0, StaleActionDelete)
+			assert.NoError(tt, err, name)
+			// use a unique serial per test case
+			source := Source{
+				Device: Device{Type: "test", Model: "test"},
+				Serial: "style-" + name,
+			}
+			o.Observe(context.Background(), MetricsEvent{
+				Source:     source,
+				PacketType: meterMetrics0,
+				Reading: testReading(tt, LayoutHomeKit1000, meterMetrics0,
+					map[string]int64{
+						"PowerExportWatts":               1557,
+						"EnergyExportDecawattHoursTotal": 123456,
+					}),
+			})
+			o.Observe(context.Background(), MetricsEvent{
+				Source:     source,
+				PacketType: inverterMetrics0,
+				Reading: testReading(tt, LayoutDNSG3, inverterMetrics0,
+					map[string]int64{
+						"VoltageOutputACDecivolts":              2403,
+						"FrequencyOutputACCentihertz":           5002,
+						"InternalTemperatureDecidegreesCelsius": 456,
+						"EnergyOutputHectowattHoursTotal":       789,
+						"UptimeHoursTotal":                      12,
+					}),
+			})
+			values, types := gatherSerial(tt, source.Serial)
+			for metric, expect := range tc.expectValues {
+				value, ok := values[metric]
+				assert.True(tt, ok, metric)
+				assert.Equal(tt, expect, value, metric)
+			}
+			for _, metric := range tc.expectAbsent {
+				_, ok := values[metric]
+				assert.False(tt, ok, metric)
+			}
+			for metric, expect := range tc.expectTypes {
+				assert.Equal(tt, expect, types[metric], metric)
+			}
+		})
+	}
+}
+
+func TestNewPrometheusObserver(t *testing.T) {
+	var testCases = map[string]struct {
+		style        MetricStyle
+		staleTimeout time.Duration
+		staleAction  StaleAction
+		expectError  bool
+	}{
+		"valid": {
+			style:        MetricStyleSI,
+			staleTimeout: time.Minute,
+			staleAction:  StaleActionZero,
+		},
+		"invalid style": {
+			style:       "metric",
+			staleAction: StaleActionDelete,
+			expectError: true,
+		},
+		"invalid action": {
+			style:       MetricStyleLegacy,
+			staleAction: "ignore",
+			expectError: true,
+		},
+		"negative timeout": {
+			style:        MetricStyleLegacy,
+			staleTimeout: -time.Minute,
+			staleAction:  StaleActionDelete,
+			expectError:  true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			_, err := NewPrometheusObserver(tc.style, tc.staleTimeout,
+				tc.staleAction)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+		})
+	}
+}
+
+func TestStaleSeries(t *testing.T) {
+	var testCases = map[string]struct {
+		action       StaleAction
+		expectValues map[string]float64
+		expectAbsent []string
+	}{
+		"delete": {
+			action: StaleActionDelete,
+			expectValues: map[string]float64{
+				"device_up":                                    0,
+				"device_last_seen_timestamp_seconds":           1695000567,
+				"inverter_energy_output_hectowatt_hours_total": 789,
+				"inverter_energy_output_watt_hours_total":      78900,
+				"inverter_uptime_hours_total":                  12,
+			},
+			expectAbsent: []string{
+				"inverter_power_output_watts",
+				"inverter_output_current_ac_deciamps",
+				"inverter_output_current_ac_amperes",
+				"inverter_output_voltage_ac_decivolts",
+				"inverter_unknown_int_0",
+			},
+		},
+		"zero": {
+			action: StaleActionZero,
+			expectValues: map[string]float64{
+				"device_up":                                    0,
+				"device_last_seen_timestamp_seconds":           1695000567,
+				"inverter_energy_output_hectowatt_hours_total": 789,
+				"inverter_energy_output_watt_hours_total":      78900,
+				"inverter_uptime_hours_total":                  12,
+				"inverter_power_output_watts":                  0,
+				"inverter_output_current_ac_deciamps":          0,
+				"inverter_output_current_ac_amperes":           0,
+				"inverter_output_voltage_ac_decivolts":         2403,
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			o, err := NewPrometheusObserver(MetricStyleBoth, time.Hour, tc.action)
+			assert.NoError(tt, err, name)
+			now := time.Unix(1695000567, 0)
+			o.now = func() time.Time { return now }
+			// use a unique serial per test case
+			source := Source{
+				Device: Device{Type: "test", Model: "test", Layout: LayoutDNSG3},
+				Serial: "stale-" + name,
+			}
+			event := MetricsEvent{
+				Source:     source,
+				PacketType: inverterMetrics0,
+				Reading: testReading(tt, LayoutDNSG3, inverterMetrics0,
+					map[string]int64{
+						"PowerOutputWatts":                2000,
+						"CurrentOutputACDeciamps":         83,
+						"VoltageOutputACDecivolts":        2403,
+						"EnergyOutputHectowattHoursTotal": 789,
+						"UptimeHoursTotal":                12,
+						"UnknownInt0":                     1,
+					}),
+			}
+			o.Observe(context.Background(), event)
+			values, _ := gatherSerial(tt, source.Serial)
+			assert.Equal(tt, 1.0, values["device_up"], name)
+			assert.Equal(tt, 2000.0, values["inverter_power_output_watts"], name)
+			// not yet stale
+			now = now.Add(59 * time.Minute)
+			o.expire()
+			values, _ = gatherSerial(tt, source.Serial)
+			assert.Equal(tt, 1.0, values["device_up"], name)
+			// stale
+			now = now.Add(time.Minute)
+			o.expire()
+			values, _ = gatherSerial(tt, source.Serial)
+			for metric, expect := range tc.expectValues {
+				value, ok := values[metric]
+				assert.True(tt, ok, metric)
+				assert.Equal(tt, expect, value, metric)
+			}
+			for _, metric := range tc.expectAbsent {
+				_, ok := values[metric]
+				assert.False(tt, ok, metric)
+			}
+			// back up again
+			o.Observe(context.Background(), event)
+			values, _ = gatherSerial(tt, source.Serial)
+			assert.Equal(tt, 1.0, values["device_up"], name)
+			assert.Equal(tt, 1695004167.0,
+				values["device_last_seen_timestamp_seconds"], name)
+			assert.Equal(tt, 2000.0, values["inverter_power_output_watts"], name)
+		})
+	}
+}
+
+func TestCachedPackets(t *testing.T) {
+	o, err := NewPrometheusObserver(MetricStyleBoth, 0, StaleActionDelete)
+	assert.NoError(t, err)
+	now := time.Unix(1695000567, 0)
+	o.now = func() time.Time { return now }
+	source := Source{
+		Device: Device{Type: "test", Model: "test"},
+		Serial: "cached",
+	}
+	// live readings
+	o.Observe(context.Background(), MetricsEvent{
+		Source:     source,
+		PacketType: meterMetrics0,
+		Timestamp:  now,
+		Reading: testReading(t, LayoutHomeKit1000, meterMetrics0,
+			map[string]int64{
+				"PowerExportWatts":               1557,
+				"EnergyExportDecawattHoursTotal": 123456,
+			}),
+	})
+	o.Observe(context.Background(), MetricsEvent{
+		Source:     source,
+		PacketType: inverterMetrics0,
+		Timestamp:  now,
+		Reading: testReading(t, LayoutDNSG3, inverterMetrics0,
+			map[string]int64{
+				"PowerOutputWatts":                2000,
+				"EnergyOutputHectowattHoursTotal": 789,
+			}),
+	})
+	// cached readings from an hour ago
+	o.Observe(context.Background(), MetricsEvent{
+		Source:     source,
+		PacketType: meterMetrics1,
+		Cached:     true,
+		Timestamp:  now.Add(-time.Hour),
+		Reading: testReading(t, LayoutHomeKit1000, meterMetrics1,
+			map[string]int64{
+				"PowerExportWatts":               42,
+				"EnergyExportDecawattHoursTotal": 123000,
+			}),
+	})
+	o.Observe(context.Background(), MetricsEvent{
+		Source:     source,
+		PacketType: inverterMetrics1,
+		Cached:     true,
+		Timestamp:  now.Add(-90 * time.Second),
+		Reading: testReading(t, LayoutDNSG3, inverterMetrics1,
+			map[string]int64{
+				"PowerOutputWatts":                42,
+				"EnergyOutputHectowattHoursTotal": 700,
+			}),
+	})
+	values, _ := gatherSerial(t, source.Serial)
+	for metric, expect := range map[string]float64{
+		"meter_power_export_watts":                     1557,
+		"meter_energy_export_decawatt_hours_total":     123456,
+		"meter_energy_export_watt_hours_total":         1234560,
+		"meter_metrics_packets_total":                  2,
+		"meter_cached_packets_total":                   1,
+		"meter_cache_lag_seconds":                      3600,
+		"inverter_power_output_watts":                  2000,
+		"inverter_energy_output_hectowatt_hours_total": 789,
+		"inverter_energy_output_watt_hours_total":      78900,
+		"inverter_metrics_packets_total":               2,
+		"inverter_cached_packets_total":                1,
+		"inverter_cache_lag_seconds":                   90,
+	} {
+		assert.Equal(t, expect, values[metric], metric)
+	}
+}
+
+// gatherInfo is a helper function which returns the labels of each
+// goodwe_device_info series in the default registry with the given serial
+// label.
+func gatherInfo(t *testing.T, serial string) []map[string]string {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	var infos []map[string]string
+	for _, family := range families {
+		if family.GetName() != "goodwe_device_info" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["serial"] == serial {
+				assert.Equal(t, 1.0, m.GetGauge().GetValue())
+				infos = append(infos, labels)
+			}
+		}
+	}
+	return infos
+}
+
+func TestDeviceInfo(t *testing.T) {
+	o, err := NewPrometheusObserver(MetricStyleLegacy, 0, StaleActionDelete)
+	assert.NoError(t, err)
+	source := Source{
+		Device: Device{Type: "meter", Model: "HomeKit 1000 Smart Meter"},
+		Serial: "info",
+	}
+	event := TimeSyncEvent{
+		Source:     source,
+		PacketType: meterTimeSync,
+		Firmware:   "V18 V4",
+		ServerAddr: "20001,tcp.goodwe-power.com",
+		LongSerial: "02053-05-000Me05",
+	}
+	expect := map[string]string{
+		"serial":      "info",
+		"model":       "HomeKit 1000 Smart Meter",
+		"firmware":    "V18 V4",
+		"long_serial": "02053-05-000Me05",
+		"server_addr": "20001,tcp.goodwe-power.com",
+	}
+	o.Observe(context.Background(), event)
+	o.Observe(context.Background(), event)
+	assert.Equal(t, []map[string]string{expect}, gatherInfo(t, source.Serial))
+	values, _ := gatherSerial(t, source.Serial)
+	changes, ok := values["goodwe_device_firmware_changes_total"]
+	assert.True(t, ok, "expected firmware changes counter")
+	assert.Equal(t, 0.0, changes)
+	// the device updates itself
+	event.Firmware = "V19 V4"
+	o.Observe(context.Background(), event)
+	expect["firmware"] = "V19 V4"
+	assert.Equal(t, []map[string]string{expect}, gatherInfo(t, source.Serial))
+	values, _ = gatherSerial(t, source.Serial)
+	assert.Equal(t, 1.0, values["goodwe_device_firmware_changes_total"])
+}
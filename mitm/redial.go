@@ -0,0 +1,333 @@
+package mitm
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/smlx/goodwe/queue"
+)
+
+const (
+	// redial backoff bounds
+	minRedialBackoff = time.Second
+	maxRedialBackoff = time.Minute
+	// maximum size of the frames buffered while redialling
+	maxRedialBuffer = 1024 * 1024
+)
+
+var (
+	upstreamReconnectsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "upstream_reconnects_total",
+		Help: "Count of upstream connections re-established after a failure mid-session.",
+	})
+	upstreamRedialDroppedFramesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "upstream_redial_dropped_frames_total",
+		Help: "Count of outbound frames dropped because the redial buffer was full.",
+	})
+)
+
+// redialConn is an upstream connection which redials with exponential backoff
+// when the connection fails, so that the device connection can stay open.
+// Frames written while redialling are buffered and sent once reconnected, and
+// reads time out until then. Once the buffer is full, frames are added to the
+// queue if there is one, and dropped otherwise.
+type redialConn struct {
+	ctx        context.Context
+	log        *slog.Logger
+	queue      *queue.Queue
+	dial       func(context.Context) (net.Conn, error)
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// sendTimeout is the write deadline for sending the buffered frames
+	sendTimeout time.Duration
+
+	// wmu serialises writes, so that buffered frames are sent in order
+	wmu sync.Mutex
+
+	mu            sync.Mutex
+	conn          net.Conn // nil while redialling
+	ready         chan struct{}
+	buf           [][]byte
+	bufSize       int
+	readDeadline  time.Time
+	writeDeadline time.Time
+	local         net.Addr
+	remote        net.Addr
+	closed        bool
+}
+
+// newRedialConn wraps the given upstream connection. dial is called to
+// reconnect when the connection fails, until ctx is cancelled. q may be nil.
+func newRedialConn(
+	ctx context.Context,
+	log *slog.Logger,
+	conn net.Conn,
+	q *queue.Queue,
+	dial func(context.Context) (net.Conn, error),
+) *redialConn {
+	return &redialConn{
+		ctx:         ctx,
+		log:         log,
+		queue:       q,
+		dial:        dial,
+		minBackoff:  minRedialBackoff,
+		maxBackoff:  maxRedialBackoff,
+		sendTimeout: connTimeout,
+		conn:        conn,
+		local:       conn.LocalAddr(),
+		remote:      conn.RemoteAddr(),
+	}
+}
+
+// broken closes conn and starts redialling, if conn is still current.
+func (c *redialConn) broken(conn net.Conn, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.conn != conn {
+		return
+	}
+	c.log.Warn("upstream connection lost, redialling", slog.Any("error", err))
+	_ = conn.Close()
+	c.conn = nil
+	c.ready = make(chan struct{})
+	go c.redial(c.ready)
+}
+
+// redial reconnects upstream with exponential backoff, sends the buffered
+// frames, and then closes ready.
+func (c *redialConn) redial(ready chan struct{}) {
+	var backoff time.Duration
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-timer.C:
+		}
+		backoff = min(max(2*backoff, c.minBackoff), c.maxBackoff)
+		conn, err := c.dial(c.ctx)
+		if err != nil {
+			c.log.Warn("couldn't redial upstream",
+				slog.Duration("retry", backoff),
+				slog.Any("error", err))
+			timer.Reset(backoff)
+			continue
+		}
+		if err = c.reconnected(conn, ready); err != nil {
+			_ = conn.Close()
+			c.log.Warn("couldn't send buffered frames upstream",
+				slog.Duration("retry", backoff),
+				slog.Any("error", err))
+			timer.Reset(backoff)
+			continue
+		}
+		upstreamReconnectsTotal.Inc()
+		c.log.Info("reconnected upstream")
+		return
+	}
+}
+
+// reconnected sends the buffered frames to conn, and then makes it the
+// current connection.
+func (c *redialConn) reconnected(conn net.Conn, ready chan struct{}) error {
+	// the buffer is only modified while holding wmu
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	// writes block while the buffer is sent, so don't wait on a stalled
+	// connection.
+	if err := conn.SetWriteDeadline(time.Now().Add(c.sendTimeout)); err != nil {
+		return err
+	}
+	for len(c.buf) > 0 {
+		if _, err := conn.Write(c.buf[0]); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.bufSize -= len(c.buf[0])
+		c.buf = c.buf[1:]
+		c.mu.Unlock()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if err := conn.SetReadDeadline(c.readDeadline); err != nil {
+		return err
+	}
+	if err := conn.SetWriteDeadline(c.writeDeadline); err != nil {
+		return err
+	}
+	c.conn = conn
+	c.local = conn.LocalAddr()
+	c.remote = conn.RemoteAddr()
+	close(ready)
+	return nil
+}
+
+// Read implements net.Conn. If the connection fails, Read waits for it to be
+// re-established until the read deadline.
+func (c *redialConn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		conn, ready, deadline, closed :=
+			c.conn, c.ready, c.readDeadline, c.closed
+		c.mu.Unlock()
+		if closed {
+			return 0, net.ErrClosed
+		}
+		if conn == nil {
+			if err := c.wait(ready, deadline); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		n, err := conn.Read(p)
+		if err != nil {
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				c.broken(conn, err)
+				if n > 0 {
+					return n, nil
+				}
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
+// wait for the connection to be re-established, until the deadline.
+func (c *redialConn) wait(ready chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-c.ctx.Done():
+		return net.ErrClosed
+	}
+}
+
+// Write implements net.Conn. If the connection has failed, p is buffered and
+// sent once it is re-established.
+func (c *redialConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.Lock()
+	conn, closed := c.conn, c.closed
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	if conn != nil {
+		_, err := conn.Write(p)
+		if err == nil {
+			return len(p), nil
+		}
+		c.broken(conn, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bufSize+len(p) > maxRedialBuffer {
+		c.overflow(p)
+		return len(p), nil
+	}
+	c.buf = append(c.buf, append([]byte{}, p...))
+	c.bufSize += len(p)
+	return len(p), nil
+}
+
+// overflow handles a frame which doesn't fit in the buffer. Valid frames are
+// added to the queue, if there is one, to be forwarded later. Otherwise the
+// frame is dropped.
+func (c *redialConn) overflow(p []byte) {
+	if c.queue != nil && validateCRC(p, outboundCRCByteOrder) == nil {
+		err := c.queue.Push(p)
+		if err == nil {
+			return
+		}
+		c.log.Warn("couldn't queue frame", slog.Any("error", err))
+	}
+	c.log.Warn("redial buffer full, dropping frame", slog.Any("data", p))
+	upstreamRedialDroppedFramesTotal.Inc()
+}
+
+// Close implements net.Conn.
+func (c *redialConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+// LocalAddr implements net.Conn.
+func (c *redialConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.local
+}
+
+// RemoteAddr implements net.Conn.
+func (c *redialConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+// SetDeadline implements net.Conn.
+func (c *redialConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn. The deadline also applies to waiting
+// for the connection to be re-established. Errors setting the deadline on a
+// failed connection are ignored, since it is redialled on the next read.
+func (c *redialConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.readDeadline = t
+	if c.conn != nil {
+		_ = c.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn. Errors setting the deadline on a
+// failed connection are ignored, since it is redialled on the next write.
+func (c *redialConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.writeDeadline = t
+	if c.conn != nil {
+		_ = c.conn.SetWriteDeadline(t)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package mitm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/smlx/goodwe/queue"
+)
+
+// readN reads n bytes from conn.
+func readN(t *testing.T, conn net.Conn, n int) []byte {
+	t.Helper()
+	buf := make([]byte, n)
+	_, err := io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	return buf
+}
+
+func TestRedialConn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	log := slog.New(slog.NewJSONHandler(os.Stderr,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	// upstream connections are pipes, and the first redial fails
+	servers := make(chan net.Conn, 2)
+	var dials int
+	dial := func(context.Context) (net.Conn, error) {
+		dials++
+		if dials == 1 {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		servers <- server
+		return client, nil
+	}
+	client, server := net.Pipe()
+	c := newRedialConn(ctx, log, client, nil, dial)
+	c.minBackoff = time.Millisecond
+	reconnects := counterValue(t, upstreamReconnectsTotal)
+	// write to the first connection
+	go func() {
+		_, _ = c.Write([]byte("a1"))
+	}()
+	assert.Equal(t, []byte("a1"), readN(t, server, 2))
+	// the connection fails, and writes are buffered until redialled
+	assert.NoError(t, server.Close())
+	n, err := c.Write([]byte("b2"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	server = <-servers
+	assert.Equal(t, []byte("b2"), readN(t, server, 2))
+	// reads come from the new connection
+	go func() {
+		_, _ = server.Write([]byte("c3"))
+	}()
+	assert.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second)))
+	assert.Equal(t, []byte("c3"), readN(t, c, 2))
+	// reads wait for the connection to be redialled
+	assert.NoError(t, server.Close())
+	go func() {
+		server := <-servers
+		_, _ = server.Write([]byte("d4"))
+	}()
+	assert.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second)))
+	assert.Equal(t, []byte("d4"), readN(t, c, 2))
+	assert.Equal(t, 3, dials)
+	assert.Equal(t, reconnects+2, counterValue(t, upstreamReconnectsTotal))
+	// reads time out while redialling
+	dial = func(context.Context) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	c.dial = dial
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	c.broken(conn, io.EOF)
+	assert.NoError(t, c.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = c.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded),
+		"expected deadline exceeded, got %v", err)
+	assert.NoError(t, c.Close())
+	_, err = c.Write([]byte("e5"))
+	assert.True(t, errors.Is(err, net.ErrClosed), "expected closed, got %v", err)
+}
+
+func TestRedialConnStalled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	client, _ := net.Pipe()
+	c := newRedialConn(ctx, log, client, nil, nil)
+	c.sendTimeout = 10 * time.Millisecond
+	c.buf = [][]byte{[]byte("a1")}
+	c.bufSize = 2
+	// a new connection which accepts but never reads times out
+	stalled, _ := net.Pipe()
+	err := c.reconnected(stalled, make(chan struct{}))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded),
+		"expected deadline exceeded, got %v", err)
+	assert.Equal(t, 1, len(c.buf))
+}
+
+func TestRedialConnOverflow(t *testing.T) {
+	frame := outboundSeeds(t)[0]
+	var testCases = map[string]struct {
+		queue         bool
+		expectDropped float64
+		expectQueued  int
+	}{
+		"no queue": {expectDropped: 1},
+		"queue":    {queue: true, expectQueued: 1},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+			var q *queue.Queue
+			if tc.queue {
+				var err error
+				q, err = queue.Open(tt.TempDir(), 0)
+				assert.NoError(tt, err, name)
+				defer q.Close()
+			}
+			client, _ := net.Pipe()
+			c := newRedialConn(ctx, log, client, q, nil)
+			// the connection is being redialled, and the buffer is full
+			c.conn = nil
+			c.bufSize = maxRedialBuffer
+			dropped := counterValue(tt, upstreamRedialDroppedFramesTotal)
+			n, err := c.Write(frame)
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, len(frame), n, name)
+			assert.Equal(tt, dropped+tc.expectDropped,
+				counterValue(tt, upstreamRedialDroppedFramesTotal), name)
+			if tc.queue {
+				assert.Equal(tt, tc.expectQueued, q.Len(), name)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package mitm
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	// LayoutHomeKit1000 is the packet layout used by the HomeKit 1000 smart
+	// meter. Packet types 0x03xx.
+	LayoutHomeKit1000 = "hk1000"
+	// LayoutDNSG3 is the packet layout used by the DNS G3 inverter. Packet
+	// types 0x01xx.
+	LayoutDNSG3 = "dns-g3"
+)
+
+var (
+	// builtinDevices are the devices known without a registry file.
+	builtinDevices = []Device{
+		{
+			ID:     DeviceID([]byte("91000HKU")),
+			Type:   "meter",
+			Model:  "HomeKit 1000 Smart Meter",
+			Layout: LayoutHomeKit1000,
+		},
+		{
+			ID:     DeviceID([]byte("53000DSC")),
+			Type:   "inverter",
+			Model:  "GW3000-DNS-30",
+			Layout: LayoutDNSG3,
+		},
+	}
+)
+
+// DeviceID is the 8 byte ASCII device ID sent in each packet envelope.
+// It identifies the device model, not an individual device.
+type DeviceID [8]byte
+
+// String implements fmt.Stringer.
+func (id DeviceID) String() string {
+	return string(id[:])
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (id DeviceID) MarshalText() ([]byte, error) {
+	return id[:], nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (id *DeviceID) UnmarshalText(text []byte) error {
+	if len(text) != len(id) {
+		return fmt.Errorf("device ID %q must be %d characters", text, len(id))
+	}
+	copy(id[:], text)
+	return nil
+}
+
+// Device describes a device model.
+type Device struct {
+	ID DeviceID `json:"id" yaml:"id"`
+	// Type is the device label value on metrics, e.g. meter or inverter.
+	Type  string `json:"type" yaml:"type"`
+	Model string `json:"model" yaml:"model"`
+	// Layout is the packet layout used to decode packets from the device.
+	Layout string `json:"layout" yaml:"layout"`
+}
+
+// validate the device fields.
+func (d *Device) validate() error {
+	if d.ID == (DeviceID{}) {
+		return fmt.Errorf("missing device ID")
+	}
+	if d.Type == "" {
+		return fmt.Errorf("device %s: missing type", d.ID)
+	}
+	if d.Model == "" {
+		return fmt.Errorf("device %s: missing model", d.ID)
+	}
+	if _, ok := packetLayouts[d.Layout]; ok {
+		return nil
+	}
+	return fmt.Errorf("device %s: unknown layout %q, expected one of: %s",
+		d.ID, d.Layout,
+		strings.Join(slices.Sorted(maps.Keys(packetLayouts)), ", "))
+}
+
+// Registry maps device IDs to device models.
+type Registry struct {
+	devices map[DeviceID]Device
+}
+
+// NewRegistry returns a Registry containing the built-in devices and the
+// given devices. The given devices override built-in devices with the same
+// ID.
+func NewRegistry(devices ...Device) (*Registry, error) {
+	r := Registry{devices: map[DeviceID]Device{}}
+	for _, d := range slices.Concat(builtinDevices, devices) {
+		if err := d.validate(); err != nil {
+			return nil, err
+		}
+		r.devices[d.ID] = d
+	}
+	return &r, nil
+}
+
+// registryFile is the format of a device registry file.
+type registryFile struct {
+	Devices []Device `json:"devices" yaml:"devices"`
+}
+
+// LoadRegistry returns a Registry containing the built-in devices and the
+// devices in the YAML or JSON file at the given path.
+func LoadRegistry(path string) (*Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read device registry: %v", err)
+	}
+	var rf registryFile
+	// JSON is valid YAML, so this handles both formats
+	if err = yaml.Unmarshal(data, &rf); err != nil {
+		return nil, fmt.Errorf("couldn't parse device registry: %v", err)
+	}
+	r, err := NewRegistry(rf.Devices...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device registry: %v", err)
+	}
+	return r, nil
+}
+
+// lookup returns the device with the given ID.
+func (r *Registry) lookup(id [8]byte) (Device, error) {
+	d, ok := r.devices[id]
+	if !ok {
+		return d, fmt.Errorf(
+			"unknown device ID %q: add it to the device registry", id[:])
+	}
+	return d, nil
+}
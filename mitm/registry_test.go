@@ -0,0 +1,138 @@
+package mitm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+// defaultRegistry is a helper function which returns a registry containing
+// only the built-in devices.
+func defaultRegistry(t testing.TB) *Registry {
+	t.Helper()
+	registry, err := NewRegistry()
+	assert.NoError(t, err)
+	return registry
+}
+
+func TestLoadRegistry(t *testing.T) {
+	var testCases = map[string]struct {
+		input        string
+		id           string
+		expectDevice Device
+		expectError  bool
+		expectLookup bool
+	}{
+		"yaml": {
+			input: `
+devices:
+- id: 10000ABC
+  type: inverter
+  model: GW5000-DNS-30
+  layout: dns-g3
+`,
+			id: "10000ABC",
+			expectDevice: Device{
+				ID:     DeviceID([]byte("10000ABC")),
+				Type:   "inverter",
+				Model:  "GW5000-DNS-30",
+				Layout: LayoutDNSG3,
+			},
+			expectLookup: true,
+		},
+		"json": {
+			input: `{"devices":[{"id":"10000ABC","type":"inverter",` +
+				`"model":"GW5000-DNS-30","layout":"dns-g3"}]}`,
+			id: "10000ABC",
+			expectDevice: Device{
+				ID:     DeviceID([]byte("10000ABC")),
+				Type:   "inverter",
+				Model:  "GW5000-DNS-30",
+				Layout: LayoutDNSG3,
+			},
+			expectLookup: true,
+		},
+		"builtin default": {
+			input: `devices: []`,
+			id:    "91000HKU",
+			expectDevice: Device{
+				ID:     DeviceID([]byte("91000HKU")),
+				Type:   "meter",
+				Model:  "HomeKit 1000 Smart Meter",
+				Layout: LayoutHomeKit1000,
+			},
+			expectLookup: true,
+		},
+		"builtin override": {
+			input: `
+devices:
+- id: 91000HKU
+  type: meter
+  model: My Meter
+  layout: hk1000
+`,
+			id: "91000HKU",
+			expectDevice: Device{
+				ID:     DeviceID([]byte("91000HKU")),
+				Type:   "meter",
+				Model:  "My Meter",
+				Layout: LayoutHomeKit1000,
+			},
+			expectLookup: true,
+		},
+		"unknown device": {
+			input: `devices: []`,
+			id:    "10000ABC",
+		},
+		"short id": {
+			input: `
+devices:
+- id: 1000ABC
+  type: inverter
+  model: GW5000-DNS-30
+  layout: dns-g3
+`,
+			expectError: true,
+		},
+		"unknown layout": {
+			input: `
+devices:
+- id: 10000ABC
+  type: inverter
+  model: GW5000-DNS-30
+  layout: et
+`,
+			expectError: true,
+		},
+		"missing model": {
+			input: `
+devices:
+- id: 10000ABC
+  type: inverter
+  layout: dns-g3
+`,
+			expectError: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			path := filepath.Join(tt.TempDir(), "devices.yaml")
+			assert.NoError(tt, os.WriteFile(path, []byte(tc.input), 0600), name)
+			registry, err := LoadRegistry(path)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			device, err := registry.lookup(DeviceID([]byte(tc.id)))
+			if !tc.expectLookup {
+				assert.Error(tt, err, name)
+				return
+			}
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, tc.expectDevice, device, name)
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package mitm
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// StaleAction is the action taken on the metrics of a device which has been
+// silent for longer than the stale timeout.
+type StaleAction string
+
+// StaleAction values.
+const (
+	// StaleActionDelete deletes the device series from all gauges, except
+	// cumulative totals.
+	StaleActionDelete StaleAction = "delete"
+	// StaleActionZero sets the device power and current gauges to zero.
+	StaleActionZero StaleAction = "zero"
+)
+
+var (
+	deviceLastSeenTimestampSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "device_last_seen_timestamp_seconds",
+		Help: "Unix time of the last packet received from the device.",
+	}, labelNames)
+	deviceUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "device_up",
+		Help: "Whether the device has sent a packet within the stale timeout.",
+	}, labelNames)
+)
+
+// staleGauges returns the gauges which are deleted when a device goes stale
+// with StaleActionDelete. Cumulative totals are not included.
+func staleGauges() []*prometheus.GaugeVec {
+	return append(
+		[]*prometheus.GaugeVec{meterCacheLagSeconds, inverterCacheLagSeconds},
+		layoutGauges(slices.Concat(slices.Collect(maps.Values(packetLayouts))...),
+			"", staleDelete, staleZero)...)
+}
+
+// zeroGauges returns the power and current gauges which are set to zero when
+// a device using the given layout goes stale with StaleActionZero.
+func (o *PrometheusObserver) zeroGauges(layout string) []*prometheus.GaugeVec {
+	return layoutGauges(packetLayouts[layout], o.style, staleZero)
+}
+
+// lastSeen tracks when a device last sent a packet.
+type lastSeen struct {
+	source Source
+	time   time.Time
+	stale  bool
+}
+
+// touch records that a packet was received from the given source. It must be
+// called with o.mu held.
+func (o *PrometheusObserver) touch(source Source) {
+	now := o.now()
+	labels := source.labels()
+	key := labelKey(labelValues(labels))
+	if seen, ok := o.lastSeen[key]; ok {
+		seen.time = now
+		seen.stale = false
+	} else {
+		o.lastSeen[key] = &lastSeen{source: source, time: now}
+	}
+	deviceLastSeenTimestampSeconds.With(labels).Set(float64(now.Unix()))
+	deviceUp.With(labels).Set(1)
+}
+
+// expire marks devices which have been silent for longer than the stale
+// timeout as down, and deletes or zeroes their gauges.
+func (o *PrometheusObserver) expire() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := o.now()
+	for _, seen := range o.lastSeen {
+		if seen.stale || now.Sub(seen.time) < o.staleTimeout {
+			continue
+		}
+		seen.stale = true
+		labels := seen.source.labels()
+		deviceUp.With(labels).Set(0)
+		switch o.staleAction {
+		case StaleActionDelete:
+			for _, g := range staleGauges() {
+				g.Delete(labels)
+			}
+		case StaleActionZero:
+			for _, g := range o.zeroGauges(seen.source.Device.Layout) {
+				g.With(labels).Set(0)
+			}
+		}
+	}
+}
+
+// Run periodically expires the metrics of stale devices until ctx is
+// cancelled. If the stale timeout is zero it returns immediately. It always
+// returns nil.
+func (o *PrometheusObserver) Run(ctx context.Context) error {
+	if o.staleTimeout == 0 {
+		return nil
+	}
+	ticker := time.NewTicker(min(max(o.staleTimeout/10, time.Second),
+		time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			o.expire()
+		}
+	}
+}
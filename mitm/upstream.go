@@ -0,0 +1,225 @@
+package mitm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DefaultResolveTTL is how long the resolved addresses of the upstream host
+// are cached.
+const DefaultResolveTTL = time.Minute
+
+var upstreamLoopsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "upstream_loops_total",
+	Help: "Count of upstream addresses refused because they are a listener address of the exporter.",
+})
+
+// LoopError is returned when an upstream address is one of the addresses the
+// Server listens on, which would cause the Server to proxy to itself.
+type LoopError struct {
+	Addr netip.AddrPort
+}
+
+// Error implements the error interface.
+func (e *LoopError) Error() string {
+	return fmt.Sprintf("upstream address %v is a listener address of the "+
+		"exporter: configure an upstream DNS server or static upstream addresses "+
+		"which bypass the DNS entry pointing at the exporter", e.Addr)
+}
+
+// upstreamDialer connects to the SEMS portal. It resolves the upstream host at
+// most once per TTL, and tries each of the IPv4 and IPv6 addresses returned in
+// turn.
+type upstreamDialer struct {
+	host string
+	port uint16
+	ttl  time.Duration
+	// lookup and dial are replaced in tests
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+	dial   func(ctx context.Context, network, address string) (net.Conn, error)
+	// local returns true if the address is one the Server listens on
+	local func(netip.AddrPort) bool
+
+	mu      sync.Mutex
+	addrs   []netip.AddrPort
+	expires time.Time
+}
+
+// newUpstreamDialer constructs an upstreamDialer for the given host:port
+// address. If ttl is zero the host is resolved on every dial.
+func newUpstreamDialer(hostport string, ttl time.Duration) (*upstreamDialer, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, fmt.Errorf(`invalid upstream host "%s": %v`, hostport, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf(`invalid upstream port "%s": %v`, portStr, err)
+	}
+	dialer := net.Dialer{Timeout: connTimeout}
+	return &upstreamDialer{
+		host:   host,
+		port:   uint16(port),
+		ttl:    ttl,
+		lookup: net.DefaultResolver.LookupIPAddr,
+		dial:   dialer.DialContext,
+	}, nil
+}
+
+// resolve returns the addresses of the upstream host, from the cache if they
+// haven't expired. If the lookup fails, any expired addresses are returned
+// instead.
+func (d *upstreamDialer) resolve(
+	ctx context.Context,
+	log *slog.Logger,
+) ([]netip.AddrPort, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.addrs) > 0 && time.Now().Before(d.expires) {
+		return d.addrs, nil
+	}
+	ips, err := d.lookup(ctx, d.host)
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("no addresses found")
+	}
+	if err != nil {
+		if len(d.addrs) > 0 {
+			log.Warn("couldn't resolve upstream host, using expired addresses",
+				slog.String("upstreamHost", d.host),
+				slog.Any("addrs", d.addrs),
+				slog.Any("error", err))
+			return d.addrs, nil
+		}
+		return nil, fmt.Errorf(`couldn't resolve "%s": %v`, d.host, err)
+	}
+	addrs := make([]netip.AddrPort, 0, len(ips))
+	for _, ip := range ips {
+		addr, err := netip.ParseAddr(ip.String())
+		if err != nil {
+			return nil, fmt.Errorf(`couldn't parse address of "%s": %v`, d.host, err)
+		}
+		addrs = append(addrs, netip.AddrPortFrom(addr.Unmap(), d.port))
+	}
+	log.Debug("resolved upstream host",
+		slog.String("upstreamHost", d.host),
+		slog.Any("addrs", addrs))
+	d.addrs = addrs
+	d.expires = time.Now().Add(d.ttl)
+	return addrs, nil
+}
+
+// expire clears the cached addresses so that the next dial resolves the
+// upstream host again.
+func (d *upstreamDialer) expire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expires = time.Time{}
+}
+
+// DialContext connects to the first upstream address which accepts a
+// connection, skipping addresses the Server listens on. If none do, the
+// cached addresses are expired.
+func (d *upstreamDialer) DialContext(
+	ctx context.Context,
+	log *slog.Logger,
+) (net.Conn, error) {
+	addrs, err := d.resolve(ctx, log)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, addr := range addrs {
+		if d.local != nil && d.local(addr) {
+			upstreamLoopsTotal.Inc()
+			err = &LoopError{Addr: addr}
+			log.Error("refusing to dial upstream", slog.Any("error", err))
+			errs = append(errs, err)
+			continue
+		}
+		conn, err := d.dial(ctx, "tcp", addr.String())
+		if err == nil {
+			return conn, nil
+		}
+		log.Debug("couldn't dial upstream address",
+			slog.String("upstreamAddr", addr.String()),
+			slog.Any("error", err))
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	d.expire()
+	return nil, errors.Join(errs...)
+}
+
+// staticLookup returns a lookup function which always returns addrs.
+func staticLookup(
+	addrs []netip.Addr,
+) func(context.Context, string) ([]net.IPAddr, error) {
+	ips := make([]net.IPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, net.IPAddr{IP: addr.AsSlice(), Zone: addr.Zone()})
+	}
+	return func(context.Context, string) ([]net.IPAddr, error) {
+		return ips, nil
+	}
+}
+
+// dnsServerLookup returns a lookup function which queries the DNS server at
+// the given host:port address instead of the system resolver.
+func dnsServerLookup(
+	server string,
+) func(context.Context, string) ([]net.IPAddr, error) {
+	dialer := net.Dialer{Timeout: connTimeout}
+	resolver := net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+	return resolver.LookupIPAddr
+}
+
+// listenerAddrs returns a function which returns true if an address is one
+// that the given listener accepts connections on. If the listener address is
+// unspecified, this includes loopback and all interface addresses.
+func listenerAddrs(listener net.Addr) func(netip.AddrPort) bool {
+	tcpAddr, ok := listener.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	listen := tcpAddr.AddrPort()
+	return func(addr netip.AddrPort) bool {
+		if addr.Port() != listen.Port() {
+			return false
+		}
+		ip := addr.Addr().Unmap()
+		if !listen.Addr().IsUnspecified() {
+			return ip == listen.Addr().Unmap()
+		}
+		if ip.IsLoopback() || ip.IsUnspecified() {
+			return true
+		}
+		ifAddrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return false
+		}
+		for _, ifAddr := range ifAddrs {
+			prefix, err := netip.ParsePrefix(ifAddr.String())
+			if err == nil && prefix.Addr().Unmap() == ip {
+				return true
+			}
+		}
+		return false
+	}
+}
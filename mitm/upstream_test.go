@@ -0,0 +1,253 @@
+package mitm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestUpstreamDialer(t *testing.T) {
+	v4 := net.IPAddr{IP: net.ParseIP("192.0.2.1")}
+	v6 := net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+	errLookup := errors.New("lookup failed")
+	var testCases = map[string]struct {
+		ttl       time.Duration
+		lookups   [][]net.IPAddr
+		reachable map[string]bool
+		local     map[string]bool
+		dials     int
+		// expected results of each dial
+		expectAddrs   []string
+		expectLookups int
+		expectLoops   int
+	}{
+		"fallback to ipv6": {
+			ttl:           time.Minute,
+			lookups:       [][]net.IPAddr{{v4, v6}},
+			reachable:     map[string]bool{"[2001:db8::1]:20001": true},
+			dials:         2,
+			expectAddrs:   []string{"[2001:db8::1]:20001", "[2001:db8::1]:20001"},
+			expectLookups: 1,
+		},
+		"resolve every dial": {
+			lookups:       [][]net.IPAddr{{v4}, {v6}},
+			reachable:     map[string]bool{"192.0.2.1:20001": true, "[2001:db8::1]:20001": true},
+			dials:         2,
+			expectAddrs:   []string{"192.0.2.1:20001", "[2001:db8::1]:20001"},
+			expectLookups: 2,
+		},
+		"resolve again after failure": {
+			ttl:           time.Minute,
+			lookups:       [][]net.IPAddr{{v4}, {v6}},
+			reachable:     map[string]bool{"[2001:db8::1]:20001": true},
+			dials:         2,
+			expectAddrs:   []string{"", "[2001:db8::1]:20001"},
+			expectLookups: 2,
+		},
+		"expired addresses on lookup failure": {
+			lookups:       [][]net.IPAddr{{v4}, nil},
+			reachable:     map[string]bool{"192.0.2.1:20001": true},
+			dials:         2,
+			expectAddrs:   []string{"192.0.2.1:20001", "192.0.2.1:20001"},
+			expectLookups: 2,
+		},
+		"skip listener address": {
+			ttl:     time.Minute,
+			lookups: [][]net.IPAddr{{v4, v6}},
+			reachable: map[string]bool{
+				"192.0.2.1:20001":     true,
+				"[2001:db8::1]:20001": true,
+			},
+			local:         map[string]bool{"192.0.2.1:20001": true},
+			dials:         1,
+			expectAddrs:   []string{"[2001:db8::1]:20001"},
+			expectLookups: 1,
+			expectLoops:   1,
+		},
+		"only listener addresses": {
+			ttl:           time.Minute,
+			lookups:       [][]net.IPAddr{{v4}},
+			reachable:     map[string]bool{"192.0.2.1:20001": true},
+			local:         map[string]bool{"192.0.2.1:20001": true},
+			dials:         1,
+			expectAddrs:   []string{""},
+			expectLookups: 1,
+			expectLoops:   1,
+		},
+		"lookup failure": {
+			lookups:       [][]net.IPAddr{nil},
+			dials:         1,
+			expectAddrs:   []string{""},
+			expectLookups: 1,
+		},
+	}
+	log := slog.New(slog.NewJSONHandler(os.Stderr,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			d, err := newUpstreamDialer("tcp.goodwe-power.com:20001", tc.ttl)
+			assert.NoError(tt, err, name)
+			var lookups int
+			d.lookup = func(_ context.Context, host string) ([]net.IPAddr, error) {
+				assert.Equal(tt, "tcp.goodwe-power.com", host, name)
+				ips := tc.lookups[lookups]
+				lookups++
+				if ips == nil {
+					return nil, errLookup
+				}
+				return ips, nil
+			}
+			d.dial = func(_ context.Context, _, address string) (net.Conn, error) {
+				if !tc.reachable[address] {
+					return nil, errors.New("connection refused")
+				}
+				conn, _ := net.Pipe()
+				return &addrConn{Conn: conn, remote: address}, nil
+			}
+			d.local = func(addr netip.AddrPort) bool {
+				return tc.local[addr.String()]
+			}
+			loops := counterValue(tt, upstreamLoopsTotal)
+			for i := range tc.dials {
+				conn, err := d.DialContext(context.Background(), log)
+				if tc.expectAddrs[i] == "" {
+					assert.Error(tt, err, name)
+					var loopErr *LoopError
+					assert.Equal(tt, tc.expectLoops > 0, errors.As(err, &loopErr), name)
+					continue
+				}
+				assert.NoError(tt, err, name)
+				assert.Equal(tt, tc.expectAddrs[i], conn.RemoteAddr().String(), name)
+				assert.NoError(tt, conn.Close(), name)
+			}
+			assert.Equal(tt, tc.expectLookups, lookups, name)
+			assert.Equal(tt, loops+float64(tc.expectLoops),
+				counterValue(tt, upstreamLoopsTotal), name)
+		})
+	}
+}
+
+func TestListenerAddrs(t *testing.T) {
+	var testCases = map[string]struct {
+		listen string
+		addr   string
+		expect bool
+	}{
+		"unspecified loopback":      {listen: "[::]:20001", addr: "127.0.0.1:20001", expect: true},
+		"unspecified loopback ipv6": {listen: "[::]:20001", addr: "[::1]:20001", expect: true},
+		"unspecified other port":    {listen: "[::]:20001", addr: "127.0.0.1:20002"},
+		"unspecified remote":        {listen: "0.0.0.0:20001", addr: "192.0.2.1:20001"},
+		"specified match":           {listen: "192.0.2.1:20001", addr: "192.0.2.1:20001", expect: true},
+		"specified mapped":          {listen: "[::ffff:192.0.2.1]:20001", addr: "192.0.2.1:20001", expect: true},
+		"specified loopback":        {listen: "192.0.2.1:20001", addr: "127.0.0.1:20001"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			listen := net.TCPAddrFromAddrPort(netip.MustParseAddrPort(tc.listen))
+			local := listenerAddrs(listen)
+			assert.Equal(tt, tc.expect, local(netip.MustParseAddrPort(tc.addr)), name)
+		})
+	}
+}
+
+func TestServeUpstreamLoop(t *testing.T) {
+	// find a free port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	assert.NoError(t, l.Close())
+	// upstream resolves to the server itself
+	s, err := NewServer(false, true, WithListenAddr(addr),
+		WithUpstreamHost(addr))
+	assert.NoError(t, err)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(ctx, log)
+	}()
+	loops := counterValue(t, upstreamLoopsTotal)
+	var conn net.Conn
+	for range 50 {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	// the server closes the connection instead of proxying to itself
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, io.EOF), "expected EOF, got %v", err)
+	cancel()
+	assert.NoError(t, <-done)
+	assert.Equal(t, loops+1, counterValue(t, upstreamLoopsTotal))
+}
+
+// addrConn is a net.Conn with the given remote address.
+type addrConn struct {
+	net.Conn
+	remote string
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return stringAddr(c.remote)
+}
+
+// stringAddr is a net.Addr with the given string representation.
+type stringAddr string
+
+func (a stringAddr) Network() string { return "tcp" }
+func (a stringAddr) String() string  { return string(a) }
+
+func TestServeDualStack(t *testing.T) {
+	// skip if IPv6 is unavailable
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 unavailable: %v", err)
+	}
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	assert.NoError(t, err)
+	assert.NoError(t, l.Close())
+	rec := recorder{}
+	s, err := NewServer(false, false, WithListenAddr(":"+port),
+		WithObserver(&rec))
+	assert.NoError(t, err)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(ctx, log)
+	}()
+	// connect over IPv4 and IPv6
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		var conn net.Conn
+		for range 50 {
+			if conn, err = net.Dial("tcp", net.JoinHostPort(host, port)); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.NoError(t, err, host)
+		assert.NoError(t, conn.Close(), host)
+	}
+	// wait for the server to exit
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	assert.NoError(t, <-done)
+	var opened int
+	for _, e := range rec.Events() {
+		if _, ok := e.(ConnOpenEvent); ok {
+			opened++
+		}
+	}
+	assert.Equal(t, 2, opened)
+}
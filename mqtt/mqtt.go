@@ -0,0 +1,355 @@
+// Package mqtt implements a mitm.Observer which publishes decoded device
+// readings to an MQTT broker, with Home Assistant MQTT discovery.
+//
+// Each reading is published as a JSON object to the state topic of the
+// device:
+//
+//	<prefix>/<serial>/state
+//
+// For example:
+//
+//	{"timestamp":"2023-09-18T09:09:27+08:00","power_generation":2601,"power_export":1557,...}
+//
+// There is a sensor for each metric of the packet layout with a unit known to
+// Home Assistant. The first time a device is seen, whenever its packet layout
+// changes, and whenever Home Assistant comes online, a retained discovery
+// config is published for each sensor:
+//
+//	<discovery prefix>/sensor/goodwe_<serial>/<sensor>/config
+//
+// Cached readings, which a device resends after it was unable to send them
+// at the time they were taken, are not published. Home Assistant records
+// state at the time it is received, so they would appear as current values.
+//
+// The availability of the exporter is published to <prefix>/status.
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/smlx/goodwe/mitm"
+)
+
+const (
+	// DefaultTopicPrefix is the default prefix of state topics.
+	DefaultTopicPrefix = "goodwe"
+	// DefaultDiscoveryPrefix is the default Home Assistant discovery prefix.
+	DefaultDiscoveryPrefix = "homeassistant"
+	// timeout for publishing a single message
+	publishTimeout = 10 * time.Second
+	// timeout for disconnecting from the broker
+	disconnectTimeoutMillis = 1000
+	// availability payloads
+	online  = "online"
+	offline = "offline"
+)
+
+// Publisher is a mitm.Observer which publishes meter and inverter readings
+// to an MQTT broker.
+type Publisher struct {
+	log             *slog.Logger
+	client          paho.Client
+	clientOpts      *paho.ClientOptions
+	topicPrefix     string
+	discoveryPrefix string
+	qos             byte
+	retain          bool
+
+	mu sync.Mutex
+	// discovered maps the state topics which discovery config has been
+	// published for to the packet layout of the published sensors.
+	discovered map[string]*mitm.PacketLayout
+}
+
+// NewPublisher constructs a Publisher and starts connecting to the given
+// broker URL (e.g. tcp://localhost:1883 or ssl://localhost:8883). If the
+// broker is unavailable the Publisher retries in the background, so this
+// function doesn't block.
+func NewPublisher(
+	log *slog.Logger,
+	broker string,
+	opts ...Option,
+) (*Publisher, error) {
+	p := Publisher{
+		log:             log,
+		clientOpts:      paho.NewClientOptions(),
+		topicPrefix:     DefaultTopicPrefix,
+		discoveryPrefix: DefaultDiscoveryPrefix,
+		discovered:      map[string]*mitm.PacketLayout{},
+	}
+	p.clientOpts.AddBroker(broker)
+	p.clientOpts.SetClientID("sems_mitm_exporter")
+	p.clientOpts.SetAutoReconnect(true)
+	p.clientOpts.SetConnectRetry(true)
+	for _, opt := range opts {
+		if err := opt(&p); err != nil {
+			return nil, err
+		}
+	}
+	p.clientOpts.SetWill(p.statusTopic(), offline, 1, true)
+	p.clientOpts.SetOnConnectHandler(p.onConnect)
+	p.clientOpts.SetConnectionLostHandler(func(_ paho.Client, err error) {
+		log.Warn("lost connection to MQTT broker", slog.Any("error", err))
+	})
+	p.client = paho.NewClient(p.clientOpts)
+	// with ConnectRetry this token only completes once connected, so don't
+	// wait for it
+	p.client.Connect()
+	return &p, nil
+}
+
+// Option is a Publisher configuration option.
+type Option func(*Publisher) error
+
+// WithClientID sets the MQTT client ID.
+func WithClientID(id string) Option {
+	return func(p *Publisher) error {
+		p.clientOpts.SetClientID(id)
+		return nil
+	}
+}
+
+// WithAuth sets the username and password used to connect to the broker.
+func WithAuth(username, password string) Option {
+	return func(p *Publisher) error {
+		p.clientOpts.SetUsername(username)
+		p.clientOpts.SetPassword(password)
+		return nil
+	}
+}
+
+// WithTLS sets the TLS configuration used for ssl:// broker URLs.
+func WithTLS(c *tls.Config) Option {
+	return func(p *Publisher) error {
+		p.clientOpts.SetTLSConfig(c)
+		return nil
+	}
+}
+
+// WithTopicPrefix sets the prefix of state topics. The default is
+// DefaultTopicPrefix.
+func WithTopicPrefix(prefix string) Option {
+	return func(p *Publisher) error {
+		if prefix == "" || strings.ContainsAny(prefix, "#+") {
+			return fmt.Errorf("invalid topic prefix %q", prefix)
+		}
+		p.topicPrefix = strings.TrimSuffix(prefix, "/")
+		return nil
+	}
+}
+
+// WithDiscoveryPrefix sets the Home Assistant discovery prefix. The default
+// is DefaultDiscoveryPrefix. An empty prefix disables discovery.
+func WithDiscoveryPrefix(prefix string) Option {
+	return func(p *Publisher) error {
+		if strings.ContainsAny(prefix, "#+") {
+			return fmt.Errorf("invalid discovery prefix %q", prefix)
+		}
+		p.discoveryPrefix = strings.TrimSuffix(prefix, "/")
+		return nil
+	}
+}
+
+// WithQoS sets the QoS of state messages. The default is 0.
+func WithQoS(qos byte) Option {
+	return func(p *Publisher) error {
+		if qos > 2 {
+			return fmt.Errorf("invalid QoS %d", qos)
+		}
+		p.qos = qos
+		return nil
+	}
+}
+
+// WithRetain sets the retain flag on state messages.
+func WithRetain(retain bool) Option {
+	return func(p *Publisher) error {
+		p.retain = retain
+		return nil
+	}
+}
+
+// Close publishes the offline status and disconnects from the broker.
+func (p *Publisher) Close() {
+	if p.client.IsConnectionOpen() {
+		p.client.Publish(p.statusTopic(), 1, true, offline).
+			WaitTimeout(publishTimeout)
+	}
+	p.client.Disconnect(disconnectTimeoutMillis)
+}
+
+// statusTopic returns the availability topic.
+func (p *Publisher) statusTopic() string {
+	return p.topicPrefix + "/status"
+}
+
+// onConnect publishes the online status and subscribes to the Home Assistant
+// status topic.
+func (p *Publisher) onConnect(c paho.Client) {
+	p.log.Info("connected to MQTT broker")
+	p.publish(p.statusTopic(), 1, true, []byte(online))
+	if p.discoveryPrefix == "" {
+		return
+	}
+	c.Subscribe(p.discoveryPrefix+"/status", 1,
+		func(_ paho.Client, msg paho.Message) {
+			if string(msg.Payload()) != online {
+				return
+			}
+			// Home Assistant has (re)started, so publish discovery config again
+			// with the next reading.
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			clear(p.discovered)
+		})
+}
+
+// publish the given message without blocking, and log any error.
+func (p *Publisher) publish(
+	topic string,
+	qos byte,
+	retain bool,
+	payload []byte,
+) {
+	token := p.client.Publish(topic, qos, retain, payload)
+	go func() {
+		if !token.WaitTimeout(publishTimeout) {
+			p.log.Warn("timeout publishing MQTT message",
+				slog.String("topic", topic))
+			return
+		}
+		if err := token.Error(); err != nil {
+			p.log.Warn("couldn't publish MQTT message",
+				slog.String("topic", topic),
+				slog.Any("error", err))
+		}
+	}()
+}
+
+// Observe implements the mitm.Observer interface.
+func (p *Publisher) Observe(_ context.Context, e mitm.Event) {
+	switch e := e.(type) {
+	case mitm.MetricsEvent:
+		if e.Cached {
+			return
+		}
+		p.publishReading(e.Source, e.Timestamp, e.Reading)
+	}
+}
+
+// publishReading publishes the sensor values of reading, and the discovery
+// config if required. Sensors missing from the reading are omitted.
+func (p *Publisher) publishReading(
+	source mitm.Source,
+	timestamp time.Time,
+	reading mitm.Reading,
+) {
+	sensors := sensors(source.Device.Type, reading.Layout)
+	stateTopic := fmt.Sprintf("%s/%s/state", p.topicPrefix,
+		topicLevel(source.Serial))
+	if p.discoveryPrefix != "" {
+		p.mu.Lock()
+		discovered := p.discovered[stateTopic] == reading.Layout
+		p.discovered[stateTopic] = reading.Layout
+		p.mu.Unlock()
+		if !discovered {
+			p.publishDiscovery(source, stateTopic, sensors)
+		}
+	}
+	state := map[string]any{
+		"timestamp": timestamp.Format(time.RFC3339),
+	}
+	for _, s := range sensors {
+		if raw, ok := reading.Values[s.Field.Name]; ok {
+			state[s.Key] = s.Field.Scaled(raw)
+		}
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		p.log.Warn("couldn't marshal MQTT state", slog.Any("error", err))
+		return
+	}
+	p.publish(stateTopic, p.qos, p.retain, payload)
+}
+
+// discoveryDevice is the device object in Home Assistant discovery config.
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	SerialNumber string   `json:"serial_number"`
+}
+
+// discoveryConfig is a Home Assistant MQTT sensor discovery config.
+type discoveryConfig struct {
+	Name              string          `json:"name"`
+	UniqueID          string          `json:"unique_id"`
+	StateTopic        string          `json:"state_topic"`
+	ValueTemplate     string          `json:"value_template"`
+	AvailabilityTopic string          `json:"availability_topic"`
+	DeviceClass       string          `json:"device_class,omitempty"`
+	UnitOfMeasurement string          `json:"unit_of_measurement,omitempty"`
+	StateClass        string          `json:"state_class,omitempty"`
+	Device            discoveryDevice `json:"device"`
+}
+
+// publishDiscovery publishes the Home Assistant discovery config for each of
+// the given sensors.
+func (p *Publisher) publishDiscovery(
+	source mitm.Source,
+	stateTopic string,
+	sensors []sensor,
+) {
+	serial := strings.TrimRight(source.Serial, "\x00")
+	nodeID := "goodwe_" + topicLevel(serial)
+	device := discoveryDevice{
+		Identifiers:  []string{nodeID},
+		Name:         fmt.Sprintf("GoodWe %s %s", source.Device.Type, serial),
+		Manufacturer: "GoodWe",
+		Model:        source.Device.Model,
+		SerialNumber: serial,
+	}
+	for _, s := range sensors {
+		payload, err := json.Marshal(discoveryConfig{
+			Name:              s.Name,
+			UniqueID:          nodeID + "_" + s.Key,
+			StateTopic:        stateTopic,
+			ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", s.Key),
+			AvailabilityTopic: p.statusTopic(),
+			DeviceClass:       s.DeviceClass,
+			UnitOfMeasurement: s.Unit,
+			StateClass:        s.StateClass,
+			Device:            device,
+		})
+		if err != nil {
+			p.log.Warn("couldn't marshal MQTT discovery config",
+				slog.Any("error", err))
+			continue
+		}
+		p.publish(fmt.Sprintf("%s/sensor/%s/%s/config", p.discoveryPrefix,
+			nodeID, s.Key), 1, true, payload)
+	}
+}
+
+// topicLevel returns s with any characters which are not valid in a single
+// topic level, or in a Home Assistant node ID, replaced by underscores.
+func topicLevel(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, strings.TrimRight(s, "\x00"))
+}
@@ -0,0 +1,513 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/smlx/goodwe/internal/eventtest"
+	"github.com/smlx/goodwe/mitm"
+)
+
+// MQTT 3.1.1 control packet types used by the test broker.
+const (
+	packetConnect    = 1
+	packetConnack    = 2
+	packetPublish    = 3
+	packetPuback     = 4
+	packetSubscribe  = 8
+	packetSuback     = 9
+	packetPingreq    = 12
+	packetPingresp   = 13
+	packetDisconnect = 14
+)
+
+// message is a message published to the test broker.
+type message struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// broker is a minimal in-process MQTT 3.1.1 broker. It supports just enough
+// of the protocol for the Publisher: QoS 0 and 1 publishing, exact-match
+// subscriptions, and username/password authentication.
+type broker struct {
+	listener net.Listener
+	username string
+	password string
+
+	mu       sync.Mutex
+	messages []message
+	rejected int
+	subs     map[string][]net.Conn
+}
+
+// newBroker starts a broker listening on a random local port. If tlsConfig
+// is not nil, the broker listens for TLS connections. If username is not
+// empty, clients must authenticate.
+func newBroker(
+	t *testing.T,
+	tlsConfig *tls.Config,
+	username,
+	password string,
+) *broker {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	b := broker{
+		listener: l,
+		username: username,
+		password: password,
+		subs:     map[string][]net.Conn{},
+	}
+	go b.serve()
+	t.Cleanup(func() { _ = l.Close() })
+	return &b
+}
+
+// serve accepts connections until the listener is closed.
+func (b *broker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_ = b.handle(conn)
+		}()
+	}
+}
+
+// readPacket reads a single control packet.
+func readPacket(r *bufio.Reader) (byte, byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return header >> 4, header & 0x0f, body, nil
+}
+
+// writePacket writes a single control packet.
+func writePacket(w io.Writer, packetType, flags byte, body []byte) error {
+	packet := binary.AppendUvarint([]byte{packetType<<4 | flags},
+		uint64(len(body)))
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+// readString reads a length-prefixed string from data, and returns the
+// remaining data.
+func readString(data []byte) (string, []byte) {
+	n := binary.BigEndian.Uint16(data)
+	return string(data[2 : 2+n]), data[2+n:]
+}
+
+// appendString appends a length-prefixed string to data.
+func appendString(data []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint16(data, uint16(len(s))), s...)
+}
+
+// handle a single client connection.
+func (b *broker) handle(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	// handle CONNECT
+	packetType, _, body, err := readPacket(r)
+	if err != nil {
+		return err
+	}
+	if packetType != packetConnect {
+		return fmt.Errorf("unexpected packet type %d", packetType)
+	}
+	_, body = readString(body) // protocol name
+	flags := body[1]
+	body = body[4:]            // level, flags, keepalive
+	_, body = readString(body) // client ID
+	if flags&0x04 != 0 {
+		_, body = readString(body) // will topic
+		_, body = readString(body) // will message
+	}
+	var username, password string
+	if flags&0x80 != 0 {
+		username, body = readString(body)
+	}
+	if flags&0x40 != 0 {
+		password, _ = readString(body)
+	}
+	if username != b.username || password != b.password {
+		b.mu.Lock()
+		b.rejected++
+		b.mu.Unlock()
+		// not authorized
+		return writePacket(conn, packetConnack, 0, []byte{0x00, 0x05})
+	}
+	if err = writePacket(conn, packetConnack, 0, []byte{0x00, 0x00}); err != nil {
+		return err
+	}
+	// handle other packets
+	for {
+		packetType, flags, body, err := readPacket(r)
+		if err != nil {
+			return err
+		}
+		switch packetType {
+		case packetPublish:
+			topic, payload := readString(body)
+			if qos := (flags >> 1) & 0x03; qos > 0 {
+				err = writePacket(conn, packetPuback, 0, payload[:2])
+				if err != nil {
+					return err
+				}
+				payload = payload[2:]
+			}
+			b.mu.Lock()
+			b.messages = append(b.messages, message{
+				topic:   topic,
+				payload: payload,
+				retain:  flags&0x01 != 0,
+			})
+			b.mu.Unlock()
+		case packetSubscribe:
+			packetID, filters := body[:2], body[2:]
+			granted := []byte{}
+			for len(filters) > 0 {
+				var filter string
+				filter, filters = readString(filters)
+				filters = filters[1:] // requested QoS
+				b.mu.Lock()
+				b.subs[filter] = append(b.subs[filter], conn)
+				b.mu.Unlock()
+				granted = append(granted, 0)
+			}
+			err = writePacket(conn, packetSuback, 0, append(packetID, granted...))
+			if err != nil {
+				return err
+			}
+		case packetPingreq:
+			if err = writePacket(conn, packetPingresp, 0, nil); err != nil {
+				return err
+			}
+		case packetDisconnect:
+			return nil
+		}
+	}
+}
+
+// send publishes a QoS 0 message to the clients subscribed to topic.
+func (b *broker) send(topic string, payload []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.subs[topic] {
+		_ = writePacket(conn, packetPublish, 0,
+			append(appendString(nil, topic), payload...))
+	}
+}
+
+// subscribed returns true if any client has subscribed to topic.
+func (b *broker) subscribed(topic string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs[topic]) > 0
+}
+
+// Messages returns the messages published to the given topic.
+func (b *broker) Messages(topic string) []message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var messages []message
+	for _, m := range b.messages {
+		if m.topic == topic {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+// Rejected returns the number of rejected connection attempts.
+func (b *broker) Rejected() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rejected
+}
+
+// testTLSConfig returns a self-signed server TLS config for 127.0.0.1, and a
+// client TLS config which trusts it.
+func testTLSConfig(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test broker"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		&key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}},
+	}, &tls.Config{
+		RootCAs: pool,
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfig(t)
+	var testCases = map[string]struct {
+		serverTLS      *tls.Config
+		brokerUsername string
+		brokerPassword string
+		scheme         string
+		opts           []Option
+		expectReject   bool
+	}{
+		"plain": {
+			scheme: "tcp",
+		},
+		"auth": {
+			brokerUsername: "goodwe",
+			brokerPassword: "secret",
+			scheme:         "tcp",
+			opts:           []Option{WithAuth("goodwe", "secret")},
+		},
+		"bad password": {
+			brokerUsername: "goodwe",
+			brokerPassword: "secret",
+			scheme:         "tcp",
+			opts:           []Option{WithAuth("goodwe", "wrong")},
+			expectReject:   true,
+		},
+		"tls": {
+			serverTLS: serverTLS,
+			scheme:    "ssl",
+			opts:      []Option{WithTLS(clientTLS)},
+		},
+	}
+	// device time is +08
+	event := eventtest.MeterEvent(1557, time.Date(2023, time.September, 18, 9,
+		9, 27, 0, time.FixedZone("+08", 8*60*60)))
+	stateTopic := "goodwe/01234567/state"
+	discoveryTopic := "homeassistant/sensor/goodwe_01234567/energy_export/config"
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			b := newBroker(tt, tc.serverTLS, tc.brokerUsername, tc.brokerPassword)
+			p, err := NewPublisher(log,
+				fmt.Sprintf("%s://%s", tc.scheme, b.listener.Addr()),
+				tc.opts...)
+			assert.NoError(tt, err, name)
+			defer p.Close()
+			if tc.expectReject {
+				eventtest.Eventually(tt, func() bool { return b.Rejected() > 0 },
+					"expected rejected connection")
+				assert.False(tt, p.client.IsConnectionOpen(), name)
+				return
+			}
+			eventtest.Eventually(tt, func() bool {
+				return b.subscribed("homeassistant/status")
+			}, "expected subscription to homeassistant/status")
+			// check availability
+			status := b.Messages("goodwe/status")
+			assert.Equal(tt, []message{{
+				topic:   "goodwe/status",
+				payload: []byte(online),
+				retain:  true,
+			}}, status, name)
+			// check state
+			p.Observe(context.Background(), event)
+			eventtest.Eventually(tt, func() bool { return len(b.Messages(stateTopic)) == 1 },
+				"expected state message")
+			var state map[string]any
+			err = json.Unmarshal(b.Messages(stateTopic)[0].payload, &state)
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, map[string]any{
+				"timestamp":         "2023-09-18T09:09:27+08:00",
+				"power_generation":  2601.0,
+				"power_export":      1557.0,
+				"energy_generation": 2345670.0,
+				"energy_export":     1234560.0,
+				"energy_import":     345670.0,
+			}, state, name)
+			// check discovery
+			eventtest.Eventually(tt, func() bool {
+				return len(b.Messages(discoveryTopic)) == 1
+			}, "expected discovery message")
+			discovery := b.Messages(discoveryTopic)[0]
+			assert.True(tt, discovery.retain, name)
+			var config discoveryConfig
+			assert.NoError(tt, json.Unmarshal(discovery.payload, &config), name)
+			assert.Equal(tt, discoveryConfig{
+				Name:              "Energy export",
+				UniqueID:          "goodwe_01234567_energy_export",
+				StateTopic:        stateTopic,
+				ValueTemplate:     "{{ value_json.energy_export }}",
+				AvailabilityTopic: "goodwe/status",
+				DeviceClass:       "energy",
+				UnitOfMeasurement: "Wh",
+				StateClass:        "total_increasing",
+				Device: discoveryDevice{
+					Identifiers:  []string{"goodwe_01234567"},
+					Name:         "GoodWe meter 01234567",
+					Manufacturer: "GoodWe",
+					Model:        "HomeKit 1000 Smart Meter",
+					SerialNumber: "01234567",
+				},
+			}, config, name)
+			// cached readings are not published
+			cached := event
+			cached.Cached = true
+			cached.Reading = mitm.Reading{Values: map[string]int64{
+				"PowerExportWatts": 0,
+			}}
+			p.Observe(context.Background(), cached)
+			// discovery is only published once
+			p.Observe(context.Background(), event)
+			eventtest.Eventually(tt, func() bool { return len(b.Messages(stateTopic)) == 2 },
+				"expected second state message")
+			assert.Equal(tt, 1, len(b.Messages(discoveryTopic)), name)
+			err = json.Unmarshal(b.Messages(stateTopic)[1].payload, &state)
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, 1557.0, state["power_export"], name)
+			// until Home Assistant restarts
+			b.send("homeassistant/status", []byte(online))
+			eventtest.Eventually(tt, func() bool {
+				p.mu.Lock()
+				defer p.mu.Unlock()
+				return len(p.discovered) == 0
+			}, "expected discovered set to be cleared")
+			p.Observe(context.Background(), event)
+			eventtest.Eventually(tt, func() bool {
+				return len(b.Messages(discoveryTopic)) == 2
+			}, "expected second discovery message")
+		})
+	}
+}
+
+func TestTopicLevel(t *testing.T) {
+	var testCases = map[string]struct {
+		input  string
+		expect string
+	}{
+		"serial":       {input: "01234567", expect: "01234567"},
+		"nul padding":  {input: "0123\x00\x00\x00\x00", expect: "0123"},
+		"wildcards":    {input: "01+3#5/7", expect: "01_3_5_7"},
+		"mixed case":   {input: "ab-CD_ef", expect: "ab-CD_ef"},
+		"non-ascii":    {input: "01é", expect: "01_"},
+		"empty string": {input: "", expect: ""},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			assert.Equal(tt, tc.expect, topicLevel(tc.input), name)
+		})
+	}
+}
+
+func TestSensors(t *testing.T) {
+	var testCases = map[string]struct {
+		layout string
+		key    string
+		expect sensor
+	}{
+		"gauge": {
+			layout: mitm.LayoutDNSG3,
+			key:    "output_voltage_ac",
+			expect: sensor{
+				Name:        "Output voltage ac",
+				DeviceClass: "voltage",
+				Unit:        "V",
+				StateClass:  "measurement",
+			},
+		},
+		"counter": {
+			layout: mitm.LayoutDNSG3,
+			key:    "uptime",
+			expect: sensor{
+				Name:        "Uptime",
+				DeviceClass: "duration",
+				Unit:        "s",
+				StateClass:  "total_increasing",
+			},
+		},
+		"energy gauge": {
+			layout: mitm.LayoutHomeKit1000,
+			key:    "sum_of_energy_import_less_generation",
+			expect: sensor{
+				Name:        "Sum of energy import less generation",
+				DeviceClass: "energy",
+				Unit:        "Wh",
+				StateClass:  "total",
+			},
+		},
+		"no device class": {
+			layout: mitm.LayoutDNSG3,
+			key:    "rssi",
+			expect: sensor{
+				Name:       "Rssi",
+				Unit:       "%",
+				StateClass: "measurement",
+			},
+		},
+	}
+	deviceTypes := map[string]string{
+		mitm.LayoutHomeKit1000: "meter",
+		mitm.LayoutDNSG3:       "inverter",
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			layout := mitm.PacketLayouts()[tc.layout][0]
+			var found []sensor
+			for _, s := range sensors(deviceTypes[tc.layout], layout) {
+				if s.Key == tc.key {
+					s.Key, s.Field = "", nil
+					found = append(found, s)
+				}
+			}
+			assert.Equal(tt, []sensor{tc.expect}, found, name)
+		})
+	}
+	// fields without a known unit, such as unknown values, are not published
+	for _, s := range sensors("meter",
+		mitm.PacketLayouts()[mitm.LayoutHomeKit1000][0]) {
+		assert.NotEqual(t, "", s.Field.Unit, s.Key)
+	}
+}
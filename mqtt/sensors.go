@@ -0,0 +1,82 @@
+package mqtt
+
+import (
+	"strings"
+
+	"github.com/smlx/goodwe/mitm"
+)
+
+// sensor describes a single value published in the state topic, and its Home
+// Assistant discovery config.
+type sensor struct {
+	// Key is the key in the state JSON object, and the sensor object ID.
+	Key string
+	// Field is the packet layout field.
+	Field *mitm.LayoutField
+	// Name is the Home Assistant entity name.
+	Name        string
+	DeviceClass string
+	Unit        string
+	StateClass  string
+}
+
+// units maps packet layout units to Home Assistant units and device classes.
+// Fields with other units are not published.
+var units = map[string]struct {
+	unit        string
+	deviceClass string
+}{
+	"amperes":    {unit: "A", deviceClass: "current"},
+	"celsius":    {unit: "°C", deviceClass: "temperature"},
+	"hertz":      {unit: "Hz", deviceClass: "frequency"},
+	"percent":    {unit: "%"},
+	"seconds":    {unit: "s", deviceClass: "duration"},
+	"volts":      {unit: "V", deviceClass: "voltage"},
+	"watt_hours": {unit: "Wh", deviceClass: "energy"},
+	"watts":      {unit: "W", deviceClass: "power"},
+}
+
+// sensors returns the sensors published for readings of the given layout by a
+// device of the given type: one for each field with a metric and a known
+// unit. The key is the name of the metric of the scaled value without the
+// device type prefix, and the unit and total suffixes. e.g. energy_export for
+// meter_energy_export_watt_hours_total.
+func sensors(deviceType string, layout *mitm.PacketLayout) []sensor {
+	if layout == nil {
+		return nil
+	}
+	var ss []sensor
+	for i := range layout.Fields {
+		f := &layout.Fields[i]
+		u, ok := units[f.Unit]
+		if !ok || f.Metric == "" {
+			continue
+		}
+		metric := f.SIMetric
+		if metric == "" {
+			metric = f.Metric
+		}
+		key := strings.TrimPrefix(metric, deviceType+"_")
+		key = strings.TrimSuffix(key, "_total")
+		key = strings.TrimSuffix(key, "_"+f.Unit)
+		name := strings.ReplaceAll(key, "_", " ")
+		s := sensor{
+			Key:         key,
+			Field:       f,
+			Name:        strings.ToUpper(name[:1]) + name[1:],
+			DeviceClass: u.deviceClass,
+			Unit:        u.unit,
+			StateClass:  "measurement",
+		}
+		switch {
+		case f.Counter:
+			s.StateClass = "total_increasing"
+		case s.DeviceClass == "energy":
+			// Home Assistant doesn't accept energy measurements, and totals
+			// which aren't counters may decrease.
+			s.StateClass = "total"
+		}
+		ss = append(ss, s)
+	}
+	return ss
+}
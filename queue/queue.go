@@ -0,0 +1,304 @@
+// Package queue implements a disk-backed FIFO queue of frames.
+//
+// The queue is stored in a directory containing two files:
+//
+//   - frames: each frame, prefixed with its length as a big-endian uint32.
+//     Frames are only ever appended, until the queue is empty and the file is
+//     truncated, or the dequeued frames at the start of the file are
+//     compacted away.
+//   - offset: the offset in the frames file of the next frame to dequeue, as
+//     a decimal integer.
+//
+// A frame partially written when the process exits is discarded when the
+// queue is next opened.
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// DefaultMaxSize is the default maximum size of the queued frames in bytes.
+	DefaultMaxSize = 100 * 1024 * 1024
+	// minimum size of the dequeued frames at the start of the frames file
+	// before it is compacted while frames are still queued.
+	compactSize = 1024 * 1024
+	// maximum size of a single frame. This is larger than any known frame.
+	maxFrameSize = 64 * 1024
+	// size of the length prefix of each frame
+	lengthSize = 4
+	// file names within the queue directory
+	framesFile = "frames"
+	offsetFile = "offset"
+)
+
+var (
+	queueFrames = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "queue_frames",
+		Help: "Number of frames in the disk-backed queue.",
+	})
+	queueDroppedFramesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "queue_dropped_frames_total",
+		Help: "Count of frames dropped because the disk-backed queue was full.",
+	})
+)
+
+// ErrFull is returned by Push when the queue has reached its maximum size.
+var ErrFull = errors.New("queue full")
+
+// Queue is a disk-backed FIFO queue of frames. It is safe for concurrent use.
+type Queue struct {
+	dir     string
+	maxSize int64
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	offset int64
+	frames int
+}
+
+// Open the queue in the given directory, creating it if it doesn't exist.
+// Push fails with ErrFull once the queued frames would exceed maxSize bytes. A
+// zero maxSize disables the limit.
+func Open(dir string, maxSize int64) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("couldn't create queue directory: %v", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, framesFile),
+		os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open queue file: %v", err)
+	}
+	q := Queue{
+		dir:     dir,
+		maxSize: maxSize,
+		file:    f,
+	}
+	if err = q.load(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	queueFrames.Set(float64(q.frames))
+	return &q, nil
+}
+
+// load the offset and count the frames in the queue, truncating any partial
+// frame at the end of the frames file.
+func (q *Queue) load() error {
+	info, err := q.file.Stat()
+	if err != nil {
+		return fmt.Errorf("couldn't stat queue file: %v", err)
+	}
+	size := info.Size()
+	data, err := os.ReadFile(filepath.Join(q.dir, offsetFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("couldn't read queue offset: %v", err)
+	}
+	if len(data) > 0 {
+		q.offset, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil || q.offset < 0 {
+			return fmt.Errorf("invalid queue offset %q", data)
+		}
+	}
+	// the frames file is truncated before the offset is reset when the queue
+	// empties, so the process may have exited in between.
+	if q.offset > size {
+		q.offset = 0
+	}
+	// walk the frames from the offset
+	q.size = q.offset
+	for q.size < size {
+		length, err := q.frameLength(q.size)
+		if err != nil || q.size+lengthSize+length > size {
+			break
+		}
+		q.size += lengthSize + length
+		q.frames++
+	}
+	if q.size < size {
+		if err = q.file.Truncate(q.size); err != nil {
+			return fmt.Errorf("couldn't truncate partial frame: %v", err)
+		}
+	}
+	return nil
+}
+
+// frameLength returns the length of the frame at the given offset.
+func (q *Queue) frameLength(offset int64) (int64, error) {
+	var buf [lengthSize]byte
+	if _, err := q.file.ReadAt(buf[:], offset); err != nil {
+		return 0, err
+	}
+	length := int64(binary.BigEndian.Uint32(buf[:]))
+	if length == 0 || length > maxFrameSize {
+		return 0, fmt.Errorf("invalid frame length %d", length)
+	}
+	return length, nil
+}
+
+// Push appends frame to the queue.
+func (q *Queue) Push(frame []byte) error {
+	if len(frame) == 0 || len(frame) > maxFrameSize {
+		return fmt.Errorf("invalid frame length %d", len(frame))
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		return fmt.Errorf("queue closed")
+	}
+	size := int64(lengthSize + len(frame))
+	if q.maxSize > 0 && q.size+size > q.maxSize {
+		if q.size-q.offset+size > q.maxSize {
+			queueDroppedFramesTotal.Inc()
+			return ErrFull
+		}
+		// there is room once the dequeued frames are removed
+		if err := q.compact(); err != nil {
+			return err
+		}
+	}
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(frame)))
+	buf = append(buf, frame...)
+	if _, err := q.file.WriteAt(buf, q.size); err != nil {
+		return fmt.Errorf("couldn't write frame: %v", err)
+	}
+	q.size += size
+	q.frames++
+	queueFrames.Set(float64(q.frames))
+	return nil
+}
+
+// Peek returns the frame at the head of the queue without removing it, or
+// nil if the queue is empty.
+func (q *Queue) Peek() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		return nil, fmt.Errorf("queue closed")
+	}
+	if q.frames == 0 {
+		return nil, nil
+	}
+	length, err := q.frameLength(q.offset)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read frame length: %v", err)
+	}
+	frame := make([]byte, length)
+	if _, err = q.file.ReadAt(frame, q.offset+lengthSize); err != nil {
+		return nil, fmt.Errorf("couldn't read frame: %v", err)
+	}
+	return frame, nil
+}
+
+// Pop removes the frame at the head of the queue. Once the queue is empty the
+// frames file is truncated.
+func (q *Queue) Pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		return fmt.Errorf("queue closed")
+	}
+	if q.frames == 0 {
+		return nil
+	}
+	length, err := q.frameLength(q.offset)
+	if err != nil {
+		return fmt.Errorf("couldn't read frame length: %v", err)
+	}
+	q.offset += lengthSize + length
+	q.frames--
+	queueFrames.Set(float64(q.frames))
+	switch {
+	case q.frames == 0:
+		if err = q.file.Truncate(0); err != nil {
+			return fmt.Errorf("couldn't truncate queue file: %v", err)
+		}
+		q.offset, q.size = 0, 0
+	case q.offset >= compactSize && q.offset >= q.size-q.offset:
+		// frames are being pushed while the queue drains, so it may never
+		// empty.
+		return q.compact()
+	}
+	return q.saveOffset()
+}
+
+// compact replaces the frames file with a copy of the frames after the
+// offset, and resets the offset.
+func (q *Queue) compact() error {
+	path := filepath.Join(q.dir, framesFile)
+	f, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't create compacted queue file: %v", err)
+	}
+	_, err = io.Copy(f,
+		io.NewSectionReader(q.file, q.offset, q.size-q.offset))
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("couldn't copy frames to compacted queue file: %v", err)
+	}
+	// reset the offset before replacing the frames file, so that if the
+	// process exits in between, dequeued frames are sent again rather than
+	// queued frames being skipped.
+	offset := q.offset
+	q.offset = 0
+	if err = q.saveOffset(); err != nil {
+		q.offset = offset
+		_ = f.Close()
+		return err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		_ = f.Close()
+		q.offset = offset
+		_ = q.saveOffset()
+		return fmt.Errorf("couldn't replace queue file: %v", err)
+	}
+	_ = q.file.Close()
+	q.file = f
+	q.size -= offset
+	return nil
+}
+
+// saveOffset atomically replaces the offset file.
+func (q *Queue) saveOffset() error {
+	path := filepath.Join(q.dir, offsetFile)
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, []byte(strconv.FormatInt(q.offset, 10)), 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't write queue offset: %v", err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("couldn't replace queue offset: %v", err)
+	}
+	return nil
+}
+
+// Len returns the number of frames in the queue.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.frames
+}
+
+// Close the queue.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
@@ -0,0 +1,138 @@
+package queue
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestQueue(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir, 0)
+	assert.NoError(t, err)
+	frames := [][]byte{{0x01}, {0x02, 0x02}, {0x03, 0x03, 0x03}}
+	for _, frame := range frames {
+		assert.NoError(t, q.Push(frame))
+	}
+	assert.Equal(t, 3, q.Len())
+	// pop the first frame and reopen
+	frame, err := q.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, frames[0], frame)
+	assert.NoError(t, q.Pop())
+	assert.NoError(t, q.Close())
+	q, err = Open(dir, 0)
+	assert.NoError(t, err)
+	defer q.Close()
+	assert.Equal(t, 2, q.Len())
+	for _, expect := range frames[1:] {
+		frame, err = q.Peek()
+		assert.NoError(t, err)
+		assert.Equal(t, expect, frame)
+		assert.NoError(t, q.Pop())
+	}
+	// empty queue is truncated
+	frame, err = q.Peek()
+	assert.NoError(t, err)
+	assert.Zero(t, frame)
+	info, err := os.Stat(filepath.Join(dir, framesFile))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+}
+
+func TestQueueFull(t *testing.T) {
+	q, err := Open(t.TempDir(), 2*(lengthSize+2))
+	assert.NoError(t, err)
+	defer q.Close()
+	assert.NoError(t, q.Push([]byte{0x01, 0x01}))
+	assert.NoError(t, q.Push([]byte{0x02, 0x02}))
+	assert.Equal(t, ErrFull, q.Push([]byte{0x03}))
+	assert.Equal(t, 2, q.Len())
+}
+
+func TestQueueRecover(t *testing.T) {
+	var testCases = map[string]struct {
+		frames []byte
+		offset string
+		expect [][]byte
+	}{
+		"partial frame": {
+			frames: []byte{
+				0x00, 0x00, 0x00, 0x01, 0x01,
+				0x00, 0x00, 0x00, 0x02, 0x02,
+			},
+			expect: [][]byte{{0x01}},
+		},
+		"partial length": {
+			frames: []byte{0x00, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00},
+			expect: [][]byte{{0x01}},
+		},
+		"offset": {
+			frames: []byte{
+				0x00, 0x00, 0x00, 0x01, 0x01,
+				0x00, 0x00, 0x00, 0x01, 0x02,
+			},
+			offset: "5",
+			expect: [][]byte{{0x02}},
+		},
+		"stale offset": {
+			frames: []byte{},
+			offset: "5",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			dir := tt.TempDir()
+			assert.NoError(tt, os.WriteFile(filepath.Join(dir, framesFile),
+				tc.frames, 0644), name)
+			if tc.offset != "" {
+				assert.NoError(tt, os.WriteFile(filepath.Join(dir, offsetFile),
+					[]byte(tc.offset), 0644), name)
+			}
+			q, err := Open(dir, 0)
+			assert.NoError(tt, err, name)
+			defer q.Close()
+			assert.Equal(tt, len(tc.expect), q.Len(), name)
+			for _, expect := range tc.expect {
+				frame, err := q.Peek()
+				assert.NoError(tt, err, name)
+				assert.Equal(tt, expect, frame, name)
+				assert.NoError(tt, q.Pop(), name)
+			}
+			// the queue is usable after recovery
+			assert.NoError(tt, q.Push([]byte{0x03}), name)
+			frame, err := q.Peek()
+			assert.NoError(tt, err, name)
+			assert.Equal(tt, []byte{0x03}, frame, name)
+		})
+	}
+}
+
+func TestQueueCompact(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir, 2*(lengthSize+1))
+	assert.NoError(t, err)
+	// the queue never empties, but dequeued frames make room
+	assert.NoError(t, q.Push([]byte{0x00}))
+	for i := range byte(10) {
+		assert.NoError(t, q.Push([]byte{i + 1}))
+		frame, err := q.Peek()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{i}, frame)
+		assert.NoError(t, q.Pop())
+	}
+	assert.Equal(t, 1, q.Len())
+	info, err := os.Stat(filepath.Join(dir, framesFile))
+	assert.NoError(t, err)
+	assert.True(t, info.Size() <= 2*(lengthSize+1))
+	// the compacted queue is reopened correctly
+	assert.NoError(t, q.Close())
+	q, err = Open(dir, 0)
+	assert.NoError(t, err)
+	defer q.Close()
+	frame, err := q.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{10}, frame)
+}
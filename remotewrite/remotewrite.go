@@ -0,0 +1,267 @@
+// Package remotewrite implements a mitm.Observer which pushes decoded device
+// readings to a Prometheus remote write endpoint, such as Prometheus itself
+// (with --web.enable-remote-write-receiver), Mimir, Thanos or
+// VictoriaMetrics.
+//
+// Unlike the scraped metrics, each sample is timestamped with the time
+// reported by the device rather than the time it was received. This means
+// that cached readings, which a device resends after it was unable to send
+// them at the time they were taken, fill the gaps left by network outages.
+//
+// Samples are written in batches as snappy compressed protobuf, as described
+// by the remote write 1.0 specification:
+// https://prometheus.io/docs/specs/remote_write_spec/
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/smlx/goodwe/internal/batch"
+	"github.com/smlx/goodwe/mitm"
+)
+
+const (
+	// DefaultBatchSize is the default maximum number of samples per write.
+	DefaultBatchSize = batch.DefaultBatchSize
+	// DefaultFlushInterval is the default interval between writes.
+	DefaultFlushInterval = batch.DefaultFlushInterval
+	// DefaultMaxBuffer is the default maximum number of buffered samples.
+	DefaultMaxBuffer = batch.DefaultMaxBuffer
+	// timeout for a single write request
+	writeTimeout = 10 * time.Second
+	// userAgent is sent with each write request, as required by the spec.
+	userAgent = "goodwe-exporters"
+)
+
+var (
+	samplesWrittenTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "remote_write_samples_written_total",
+		Help: "Count of samples written to the remote write endpoint.",
+	})
+	samplesDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "remote_write_samples_dropped_total",
+		Help: "Count of samples dropped due to a full buffer or a rejected write.",
+	})
+	writeErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "remote_write_errors_total",
+		Help: "Count of failed remote writes.",
+	})
+	// labelNameRegexp matches valid label names. Names starting with __ are
+	// reserved.
+	labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// Writer is a mitm.Observer which writes meter and inverter readings to a
+// Prometheus remote write endpoint. Samples are buffered by Observe and
+// written by Run.
+type Writer struct {
+	writeURL string
+	client   *http.Client
+	// batchOpts configure the buffer.
+	batchOpts []batch.Option
+	// buffer holds encoded time series. Each contains a single sample.
+	buffer      *batch.Buffer
+	labels      []label
+	username    string
+	password    string
+	bearerToken string
+}
+
+// NewWriter constructs a Writer for the remote write endpoint at the given
+// URL (e.g. http://localhost:9090/api/v1/write).
+func NewWriter(
+	log *slog.Logger,
+	writeURL string,
+	opts ...Option,
+) (*Writer, error) {
+	u, err := url.Parse(writeURL)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse remote write URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid remote write URL scheme %q", u.Scheme)
+	}
+	w := Writer{
+		writeURL: u.String(),
+		client:   &http.Client{Timeout: writeTimeout},
+	}
+	for _, opt := range opts {
+		if err := opt(&w); err != nil {
+			return nil, err
+		}
+	}
+	if w.username != "" && w.bearerToken != "" {
+		return nil, fmt.Errorf("basic auth and bearer token are exclusive")
+	}
+	w.buffer, err = batch.NewBuffer(log, "remote write endpoint", "samples",
+		w.write, batch.Counters{
+			Written: samplesWrittenTotal,
+			Dropped: samplesDroppedTotal,
+			Errors:  writeErrorsTotal,
+		}, w.batchOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// Option is a Writer configuration option.
+type Option func(*Writer) error
+
+// batchOption configures the buffer with opt.
+func batchOption(opt batch.Option) Option {
+	return func(w *Writer) error {
+		w.batchOpts = append(w.batchOpts, opt)
+		return nil
+	}
+}
+
+// WithLabels adds the given labels to every sample, in the same way as
+// Prometheus external labels. They can't override the device, model or
+// serial labels.
+func WithLabels(labels map[string]string) Option {
+	return func(w *Writer) error {
+		for name, value := range labels {
+			if !labelNameRegexp.MatchString(name) ||
+				strings.HasPrefix(name, "__") {
+				return fmt.Errorf("invalid label name %q", name)
+			}
+			switch name {
+			case "device", "model", "serial":
+				return fmt.Errorf("reserved label name %q", name)
+			}
+			w.labels = append(w.labels, label{name: name, value: value})
+		}
+		return nil
+	}
+}
+
+// WithBasicAuth sets the username and password used to authenticate.
+func WithBasicAuth(username, password string) Option {
+	return func(w *Writer) error {
+		w.username = username
+		w.password = password
+		return nil
+	}
+}
+
+// WithBearerToken sets the bearer token used to authenticate.
+func WithBearerToken(token string) Option {
+	return func(w *Writer) error {
+		w.bearerToken = token
+		return nil
+	}
+}
+
+// WithBatchSize sets the maximum number of samples per write. A write is
+// triggered early once this many samples are buffered. The default is
+// DefaultBatchSize.
+func WithBatchSize(n int) Option {
+	return batchOption(batch.WithBatchSize(n))
+}
+
+// WithFlushInterval sets the interval between writes. The default is
+// DefaultFlushInterval.
+func WithFlushInterval(d time.Duration) Option {
+	return batchOption(batch.WithFlushInterval(d))
+}
+
+// WithMaxBuffer sets the maximum number of samples buffered while the
+// endpoint is unavailable. Once full, the oldest samples are dropped. The
+// default is DefaultMaxBuffer.
+func WithMaxBuffer(n int) Option {
+	return batchOption(batch.WithMaxBuffer(n))
+}
+
+// WithTLS sets the TLS configuration used for https:// URLs.
+func WithTLS(c *tls.Config) Option {
+	return func(w *Writer) error {
+		w.client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: c,
+		}
+		return nil
+	}
+}
+
+// Observe implements the mitm.Observer interface.
+func (w *Writer) Observe(_ context.Context, e mitm.Event) {
+	switch e := e.(type) {
+	case mitm.MetricsEvent:
+		// Samples of cached readings are usually older than the latest samples
+		// already written, so a receiver may reject them as out of order.
+		// Write them in separate batches so that live samples aren't dropped
+		// with them.
+		group := "live"
+		if e.Cached {
+			group = "cached"
+		}
+		w.buffer.Add(group, appendSeries(nil, w.sourceLabels(e.Source),
+			e.Reading, e.Timestamp.UnixMilli())...)
+	}
+}
+
+// sourceLabels returns the labels identifying the source, and any labels
+// added by WithLabels.
+func (w *Writer) sourceLabels(s mitm.Source) []label {
+	return append([]label{
+		{name: "device", value: s.Device.Type},
+		{name: "model", value: s.Device.Model},
+		{name: "serial", value: s.Serial},
+	}, w.labels...)
+}
+
+// Run writes buffered samples until ctx is cancelled, and then makes a final
+// attempt to write any remaining samples. It always returns nil.
+func (w *Writer) Run(ctx context.Context) error {
+	return w.buffer.Run(ctx)
+}
+
+// write a batch of time series. If the write fails, retry indicates whether
+// it may succeed later.
+func (w *Writer) write(ctx context.Context, batch [][]byte) (bool, error) {
+	body := snappy.Encode(nil, bytes.Join(batch, nil))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.writeURL,
+		bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("couldn't construct request: %v", err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	switch {
+	case w.bearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+w.bearerToken)
+	case w.username != "":
+		req.SetBasicAuth(w.username, w.password)
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("couldn't send request: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, res.Body)
+		return false, nil
+	}
+	body, _ = io.ReadAll(io.LimitReader(res.Body, 1024))
+	err = fmt.Errorf("bad response status %s: %s", res.Status,
+		bytes.TrimSpace(body))
+	// the spec requires retrying server errors and rate limiting only
+	return res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests,
+		err
+}
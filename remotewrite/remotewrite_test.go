@@ -0,0 +1,453 @@
+package remotewrite
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/klauspost/compress/snappy"
+	"github.com/smlx/goodwe/internal/batch"
+	"github.com/smlx/goodwe/internal/eventtest"
+	"github.com/smlx/goodwe/mitm"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// sample is a decoded sample, formatted as a string for easy comparison:
+//
+//	name{label="value",...} value timestamp
+type sample string
+
+// request is a write request received by the test receiver.
+type request struct {
+	headers http.Header
+	samples []sample
+}
+
+// receiver is a stand-in remote write receiver which decodes and records
+// write requests. It responds to each request with the next status in
+// statuses, then with 204.
+type receiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []request
+	errors   []error
+}
+
+// newReceiver starts a remote write receiver.
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	t.Helper()
+	r := receiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			samples, err := decodeWriteRequest(req.Body)
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if err != nil {
+				r.errors = append(r.errors, err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			r.requests = append(r.requests, request{
+				headers: req.Header,
+				samples: samples,
+			})
+			status := http.StatusNoContent
+			if len(r.statuses) > 0 {
+				status, r.statuses = r.statuses[0], r.statuses[1:]
+			}
+			w.WriteHeader(status)
+		}))
+	t.Cleanup(r.Close)
+	return &r
+}
+
+// Requests returns the recorded requests, and any decoding errors.
+func (r *receiver) Requests() ([]request, []error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]request(nil), r.requests...), append([]error(nil), r.errors...)
+}
+
+// consumeFields calls fn on each field in data. fn returns the length of the
+// field value.
+func consumeFields(
+	data []byte,
+	fn func(num protowire.Number, typ protowire.Type, data []byte) (int, error),
+) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		n, err := fn(num, typ, data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// decodeWriteRequest decodes a snappy compressed WriteRequest.
+func decodeWriteRequest(body io.Reader) ([]sample, error) {
+	compressed, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+	var samples []sample
+	err = consumeFields(data, func(num protowire.Number, typ protowire.Type,
+		data []byte) (int, error) {
+		if num != writeRequestTimeseries || typ != protowire.BytesType {
+			return 0, fmt.Errorf("unexpected field %d", num)
+		}
+		series, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		s, err := decodeTimeSeries(series)
+		if err != nil {
+			return 0, err
+		}
+		samples = append(samples, s...)
+		return n, nil
+	})
+	return samples, err
+}
+
+// decodeTimeSeries decodes a TimeSeries.
+func decodeTimeSeries(data []byte) ([]sample, error) {
+	var name string
+	var labels []string
+	var samples []string
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type,
+		data []byte) (int, error) {
+		msg, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		switch num {
+		case timeSeriesLabels:
+			var l label
+			err := consumeFields(msg, func(num protowire.Number,
+				typ protowire.Type, data []byte) (int, error) {
+				v, n := protowire.ConsumeString(data)
+				if num == labelName {
+					l.name = v
+				} else {
+					l.value = v
+				}
+				return n, nil
+			})
+			if err != nil {
+				return 0, err
+			}
+			if l.name == "__name__" {
+				name = l.value
+			} else {
+				labels = append(labels, fmt.Sprintf("%s=%q", l.name, l.value))
+			}
+		case timeSeriesSamples:
+			var value float64
+			var timestamp int64
+			err := consumeFields(msg, func(num protowire.Number,
+				typ protowire.Type, data []byte) (int, error) {
+				if num == sampleValue {
+					v, n := protowire.ConsumeFixed64(data)
+					value = math.Float64frombits(v)
+					return n, nil
+				}
+				v, n := protowire.ConsumeVarint(data)
+				timestamp = int64(v)
+				return n, nil
+			})
+			if err != nil {
+				return 0, err
+			}
+			samples = append(samples, fmt.Sprintf("%v %d", value, timestamp))
+		default:
+			return 0, fmt.Errorf("unexpected field %d", num)
+		}
+		return n, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !sort.StringsAreSorted(labels) {
+		return nil, fmt.Errorf("labels not sorted: %v", labels)
+	}
+	var result []sample
+	for _, s := range samples {
+		result = append(result, sample(fmt.Sprintf("%s{%s} %s", name,
+			strings.Join(labels, ","), s)))
+	}
+	return result, nil
+}
+
+// meterSamples returns the samples for eventtest.MeterEvent(powerExport, _)
+// at the given unix time in milliseconds, with the given extra labels.
+func meterSamples(powerExport, unixMilli, extra string) []sample {
+	labels := `{device="meter",` + extra + `model="HomeKit 1000 Smart Meter",` +
+		`serial="01234567"} `
+	return []sample{
+		sample("meter_energy_export_decawatt_hours_total" + labels +
+			"123456 " + unixMilli),
+		sample("meter_energy_export_watt_hours_total" + labels +
+			"1.23456e+06 " + unixMilli),
+		sample("meter_energy_generation_decawatt_hours_total" + labels +
+			"234567 " + unixMilli),
+		sample("meter_energy_generation_watt_hours_total" + labels +
+			"2.34567e+06 " + unixMilli),
+		sample("meter_energy_import_decawatt_hours_total" + labels +
+			"34567 " + unixMilli),
+		sample("meter_energy_import_watt_hours_total" + labels +
+			"345670 " + unixMilli),
+		sample("meter_power_export_watts" + labels + powerExport + " " + unixMilli),
+		sample("meter_power_generation_watts" + labels + "2601 " + unixMilli),
+	}
+}
+
+func TestWriter(t *testing.T) {
+	t0 := time.Date(2023, time.September, 18, 1, 9, 27, 0, time.UTC)
+	var testCases = map[string]struct {
+		statuses      []int
+		opts          []Option
+		events        int
+		expectAuth    string
+		expectSamples [][]sample
+	}{
+		"basic auth": {
+			opts:       []Option{WithBasicAuth("goodwe", "secret")},
+			events:     2,
+			expectAuth: "Basic Z29vZHdlOnNlY3JldA==",
+			expectSamples: [][]sample{append(
+				meterSamples("0", "1694999367000", ""),
+				meterSamples("1", "1694999368000", "")...)},
+		},
+		"bearer token": {
+			opts:       []Option{WithBearerToken("s3cr3t")},
+			events:     1,
+			expectAuth: "Bearer s3cr3t",
+			expectSamples: [][]sample{
+				meterSamples("0", "1694999367000", ""),
+			},
+		},
+		"labels": {
+			opts: []Option{WithLabels(map[string]string{
+				"job":      "goodwe",
+				"instance": "home",
+			})},
+			events: 1,
+			expectSamples: [][]sample{
+				meterSamples("0", "1694999367000", `instance="home",job="goodwe",`),
+			},
+		},
+		"batches": {
+			opts:   []Option{WithBatchSize(8)},
+			events: 2,
+			expectSamples: [][]sample{
+				meterSamples("0", "1694999367000", ""),
+				meterSamples("1", "1694999368000", ""),
+			},
+		},
+		"retry": {
+			statuses: []int{
+				http.StatusServiceUnavailable,
+				http.StatusTooManyRequests,
+			},
+			events: 1,
+			expectSamples: [][]sample{
+				meterSamples("0", "1694999367000", ""),
+				meterSamples("0", "1694999367000", ""),
+				meterSamples("0", "1694999367000", ""),
+			},
+		},
+		"rejected": {
+			statuses: []int{http.StatusBadRequest},
+			opts:     []Option{WithBatchSize(8)},
+			events:   2,
+			expectSamples: [][]sample{
+				meterSamples("0", "1694999367000", ""),
+				meterSamples("1", "1694999368000", ""),
+			},
+		},
+	}
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			r := newReceiver(tt, tc.statuses...)
+			w, err := NewWriter(log, r.URL+"/api/v1/write", append(tc.opts,
+				WithFlushInterval(50*time.Millisecond),
+				batchOption(batch.WithMinBackoff(10*time.Millisecond)))...)
+			assert.NoError(tt, err, name)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error)
+			go func() {
+				done <- w.Run(ctx)
+			}()
+			for i := range tc.events {
+				w.Observe(ctx, eventtest.MeterEvent(int32(i), t0.Add(time.Duration(i)*time.Second)))
+			}
+			eventtest.Eventually(tt, func() bool {
+				requests, _ := r.Requests()
+				return len(requests) >= len(tc.expectSamples)
+			}, "expected requests")
+			cancel()
+			assert.NoError(tt, <-done, name)
+			requests, errs := r.Requests()
+			assert.Equal(tt, 0, len(errs), name)
+			var samples [][]sample
+			for _, req := range requests {
+				assert.Equal(tt, "snappy", req.headers.Get("Content-Encoding"), name)
+				assert.Equal(tt, "application/x-protobuf",
+					req.headers.Get("Content-Type"), name)
+				assert.Equal(tt, "0.1.0",
+					req.headers.Get("X-Prometheus-Remote-Write-Version"), name)
+				assert.Equal(tt, tc.expectAuth, req.headers.Get("Authorization"), name)
+				samples = append(samples, req.samples)
+			}
+			assert.Equal(tt, tc.expectSamples, samples, name)
+			assert.Equal(tt, 0, w.buffer.Len(), name)
+		})
+	}
+}
+
+func TestWriterBufferOverflow(t *testing.T) {
+	t0 := time.Date(2023, time.September, 18, 1, 9, 27, 0, time.UTC)
+	r := newReceiver(t)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	w, err := NewWriter(log, r.URL, WithMaxBuffer(8), WithBatchSize(8))
+	assert.NoError(t, err)
+	ctx := context.Background()
+	w.Observe(ctx, eventtest.MeterEvent(0, t0))
+	// the oldest samples are dropped
+	w.Observe(ctx, eventtest.MeterEvent(1, t0.Add(time.Second)))
+	assert.Equal(t, 8, w.buffer.Len())
+	assert.NoError(t, w.buffer.Flush(ctx))
+	requests, _ := r.Requests()
+	assert.Equal(t, 1, len(requests))
+	assert.Equal(t, meterSamples("1", "1694999368000", ""), requests[0].samples)
+}
+
+func TestWriterCachedRejected(t *testing.T) {
+	t0 := time.Date(2023, time.September, 18, 1, 9, 27, 0, time.UTC)
+	// accept the live samples and reject the cached samples as out of order
+	r := newReceiver(t, http.StatusNoContent, http.StatusBadRequest)
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	w, err := NewWriter(log, r.URL)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	w.Observe(ctx, eventtest.MeterEvent(0, t0))
+	cached := eventtest.MeterEvent(1, t0.Add(-time.Hour))
+	cached.Cached = true
+	w.Observe(ctx, cached)
+	w.Observe(ctx, eventtest.MeterEvent(2, t0.Add(time.Second)))
+	assert.NoError(t, w.buffer.Flush(ctx))
+	assert.Equal(t, 0, w.buffer.Len())
+	requests, errs := r.Requests()
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, 2, len(requests))
+	// the live samples are written in a separate batch from the cached samples
+	assert.Equal(t, append(
+		meterSamples("0", "1694999367000", ""),
+		meterSamples("2", "1694999368000", "")...), requests[0].samples)
+	assert.Equal(t, meterSamples("1", "1694995767000", ""), requests[1].samples)
+}
+
+func TestWriterFullReading(t *testing.T) {
+	t0 := time.Date(2023, time.September, 18, 1, 9, 27, 0, time.UTC)
+	var testCases = map[string]struct {
+		layout     string
+		deviceType string
+	}{
+		"meter":    {layout: mitm.LayoutHomeKit1000, deviceType: "meter"},
+		"inverter": {layout: mitm.LayoutDNSG3, deviceType: "inverter"},
+	}
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			layout := mitm.PacketLayouts()[tc.layout][0]
+			// every field of the reading has a distinct value
+			reading := mitm.Reading{Layout: layout, Values: map[string]int64{}}
+			labels := fmt.Sprintf(`{device=%q,model="test",serial="01234567"} `,
+				tc.deviceType)
+			var expect []sample
+			for i, f := range layout.Fields {
+				raw := int64(i+1) * 1001
+				reading.Values[f.Name] = raw
+				if f.Metric == "" {
+					continue
+				}
+				expect = append(expect, sample(fmt.Sprintf("%s%s%v 1694999367000",
+					f.Metric, labels, float64(raw))))
+				if f.SIMetric != "" {
+					expect = append(expect, sample(fmt.Sprintf("%s%s%v 1694999367000",
+						f.SIMetric, labels, f.Scaled(raw))))
+				}
+			}
+			r := newReceiver(tt)
+			w, err := NewWriter(log, r.URL, WithBatchSize(len(expect)))
+			assert.NoError(tt, err, name)
+			ctx := context.Background()
+			w.Observe(ctx, mitm.MetricsEvent{
+				Source: mitm.Source{
+					Device: mitm.Device{Type: tc.deviceType, Model: "test"},
+					Serial: "01234567",
+				},
+				Timestamp: t0,
+				Reading:   reading,
+			})
+			assert.NoError(tt, w.buffer.Flush(ctx), name)
+			requests, errs := r.Requests()
+			assert.Equal(tt, 0, len(errs), name)
+			assert.Equal(tt, 1, len(requests), name)
+			assert.Equal(tt, expect, requests[0].samples, name)
+		})
+	}
+}
+
+func TestNewWriter(t *testing.T) {
+	var testCases = map[string]struct {
+		url         string
+		opts        []Option
+		expectError bool
+	}{
+		"valid":          {url: "http://localhost:9090/api/v1/write"},
+		"labels":         {url: "https://localhost/push", opts: []Option{WithLabels(map[string]string{"job": "goodwe"})}},
+		"scheme":         {url: "localhost:9090", expectError: true},
+		"batch":          {url: "http://localhost:9090", opts: []Option{WithBatchSize(10), WithMaxBuffer(5)}, expectError: true},
+		"both auth":      {url: "http://localhost:9090", opts: []Option{WithBasicAuth("a", "b"), WithBearerToken("c")}, expectError: true},
+		"invalid label":  {url: "http://localhost:9090", opts: []Option{WithLabels(map[string]string{"a-b": "c"})}, expectError: true},
+		"reserved label": {url: "http://localhost:9090", opts: []Option{WithLabels(map[string]string{"__name__": "c"})}, expectError: true},
+		"source label":   {url: "http://localhost:9090", opts: []Option{WithLabels(map[string]string{"serial": "c"})}, expectError: true},
+	}
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			_, err := NewWriter(log, tc.url, tc.opts...)
+			if tc.expectError {
+				assert.Error(tt, err, name)
+			} else {
+				assert.NoError(tt, err, name)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package remotewrite
+
+import (
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/smlx/goodwe/mitm"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// label is a Prometheus label.
+type label struct {
+	name  string
+	value string
+}
+
+// Field numbers of the prometheus.WriteRequest protobuf message and the
+// messages it contains. See
+// https://github.com/prometheus/prometheus/blob/main/prompb/types.proto
+const (
+	writeRequestTimeseries = 1
+	timeSeriesLabels       = 1
+	timeSeriesSamples      = 2
+	labelName              = 1
+	labelValue             = 2
+	sampleValue            = 1
+	sampleTimestamp        = 2
+)
+
+// appendSeries appends a TimeSeries for the metric of each layout field of
+// reading to buf, and one for the SI metric of the scaled value if it has one,
+// and returns the extended buffer. Fields missing from the reading are
+// omitted. Each TimeSeries is encoded as a timeseries field of a
+// WriteRequest, so a WriteRequest is simply the concatenation of TimeSeries
+// returned by this function. Labels with empty values are omitted. The
+// timestamp is in milliseconds.
+func appendSeries(
+	buf [][]byte,
+	labels []label,
+	reading mitm.Reading,
+	timestamp int64,
+) [][]byte {
+	if reading.Layout == nil {
+		return buf
+	}
+	// trim NUL padding and drop empty labels
+	var base []label
+	for _, l := range labels {
+		l.value = strings.TrimRight(l.value, "\x00")
+		if l.value != "" {
+			base = append(base, l)
+		}
+	}
+	for _, f := range reading.Layout.Fields {
+		v, ok := reading.Values[f.Name]
+		if !ok || f.Metric == "" {
+			continue
+		}
+		buf = append(buf, appendTimeSeries(nil, metricLabels(base, f.Metric),
+			float64(v), timestamp))
+		if f.SIMetric != "" {
+			buf = append(buf, appendTimeSeries(nil,
+				metricLabels(base, f.SIMetric), f.Scaled(v), timestamp))
+		}
+	}
+	return buf
+}
+
+// metricLabels returns the base labels with the metric name, sorted by name.
+func metricLabels(base []label, name string) []label {
+	ls := append(slices.Clip(base), label{name: "__name__", value: name})
+	// labels must be sorted by name
+	slices.SortFunc(ls, func(a, b label) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return ls
+}
+
+// appendTimeSeries appends a WriteRequest timeseries field containing a
+// single sample to b, and returns the extended buffer.
+func appendTimeSeries(
+	b []byte,
+	labels []label,
+	value float64,
+	timestamp int64,
+) []byte {
+	var series []byte
+	for _, l := range labels {
+		var lb []byte
+		lb = protowire.AppendTag(lb, labelName, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.name)
+		lb = protowire.AppendTag(lb, labelValue, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.value)
+		series = protowire.AppendTag(series, timeSeriesLabels,
+			protowire.BytesType)
+		series = protowire.AppendBytes(series, lb)
+	}
+	var sample []byte
+	sample = protowire.AppendTag(sample, sampleValue, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, sampleTimestamp, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(timestamp))
+	series = protowire.AppendTag(series, timeSeriesSamples, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+	b = protowire.AppendTag(b, writeRequestTimeseries, protowire.BytesType)
+	return protowire.AppendBytes(b, series)
+}
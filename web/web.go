@@ -0,0 +1,288 @@
+// Package web serves HTTP with TLS and basic authentication configured by a
+// file in the Prometheus exporter-toolkit web configuration format:
+//
+//	tls_server_config:
+//	  cert_file: server.crt
+//	  key_file: server.key
+//	  # NoClientCert (default), RequestClientCert, RequireAnyClientCert,
+//	  # VerifyClientCertIfGiven or RequireAndVerifyClientCert
+//	  client_auth_type: RequireAndVerifyClientCert
+//	  client_ca_file: ca.crt
+//	  # TLS10, TLS11, TLS12 (default) or TLS13
+//	  min_version: TLS12
+//	  max_version: TLS13
+//	basic_auth_users:
+//	  # username: bcrypt hash
+//	  alice: $2y$10$...
+//
+// Relative paths are relative to the directory of the configuration file.
+// Unsupported fields are rejected rather than ignored.
+//
+// The configuration file and certificates are reloaded for every TLS
+// handshake, and the configuration file for every request, so that they can
+// be replaced without a restart.
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.yaml.in/yaml/v3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maximum number of successful basic auth checks cached, to avoid the cost
+// of bcrypt for every request
+const authCacheSize = 100
+
+// Config is a web configuration file.
+type Config struct {
+	TLSServerConfig *TLSConfig        `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"`
+}
+
+// TLSConfig is the TLS configuration of the server.
+type TLSConfig struct {
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientAuthType string `yaml:"client_auth_type"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+	MinVersion     string `yaml:"min_version"`
+	MaxVersion     string `yaml:"max_version"`
+}
+
+var (
+	clientAuthTypes = map[string]tls.ClientAuthType{
+		"":                           tls.NoClientCert,
+		"NoClientCert":               tls.NoClientCert,
+		"RequestClientCert":          tls.RequestClientCert,
+		"RequireAnyClientCert":       tls.RequireAnyClientCert,
+		"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+		"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+	}
+	tlsVersions = map[string]uint16{
+		"TLS10": tls.VersionTLS10,
+		"TLS11": tls.VersionTLS11,
+		"TLS12": tls.VersionTLS12,
+		"TLS13": tls.VersionTLS13,
+	}
+)
+
+// LoadConfig loads and validates the web configuration file at path,
+// including any certificates it refers to.
+func LoadConfig(path string) (*Config, error) {
+	c, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if c.TLSServerConfig != nil {
+		if _, err = c.TLSServerConfig.tlsConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// readConfig reads the web configuration file at path, without loading the
+// certificates it refers to.
+func readConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read web configuration: %v", err)
+	}
+	var c Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("couldn't parse web configuration: %v", err)
+	}
+	for user, hash := range c.BasicAuthUsers {
+		if _, err = bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash for user %s: %v", user, err)
+		}
+	}
+	if c.TLSServerConfig != nil {
+		dir := filepath.Dir(path)
+		c.TLSServerConfig.CertFile = resolvePath(dir, c.TLSServerConfig.CertFile)
+		c.TLSServerConfig.KeyFile = resolvePath(dir, c.TLSServerConfig.KeyFile)
+		c.TLSServerConfig.ClientCAFile =
+			resolvePath(dir, c.TLSServerConfig.ClientCAFile)
+	}
+	return &c, nil
+}
+
+// resolvePath returns path relative to dir, unless it is empty or absolute.
+func resolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// tlsConfig loads the certificates and returns the server TLS configuration.
+func (c *TLSConfig) tlsConfig() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("tls_server_config requires cert_file and key_file")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load server certificate: %v", err)
+	}
+	clientAuth, ok := clientAuthTypes[c.ClientAuthType]
+	if !ok {
+		return nil, fmt.Errorf("invalid client_auth_type %s", c.ClientAuthType)
+	}
+	config := tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuth,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read client CA file: %v", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("couldn't parse client CA file %s",
+				c.ClientCAFile)
+		}
+	} else if clientAuth == tls.VerifyClientCertIfGiven ||
+		clientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("client_auth_type %s requires client_ca_file",
+			c.ClientAuthType)
+	}
+	if c.MinVersion != "" {
+		if config.MinVersion, ok = tlsVersions[c.MinVersion]; !ok {
+			return nil, fmt.Errorf("invalid min_version %s", c.MinVersion)
+		}
+	}
+	if c.MaxVersion != "" {
+		if config.MaxVersion, ok = tlsVersions[c.MaxVersion]; !ok {
+			return nil, fmt.Errorf("invalid max_version %s", c.MaxVersion)
+		}
+		if config.MaxVersion < config.MinVersion {
+			return nil, fmt.Errorf("max_version %s is less than min_version",
+				c.MaxVersion)
+		}
+	}
+	return &config, nil
+}
+
+// Serve serves HTTP on l using srv, configured by the web configuration file
+// at path. If path is empty, plain HTTP is served without authentication.
+// Like http.Server.Serve, it always returns a non-nil error.
+func Serve(l net.Listener, srv *http.Server, path string, log *slog.Logger) error {
+	if path == "" {
+		return srv.Serve(l)
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	srv.Handler = &authHandler{
+		path:  path,
+		log:   log,
+		next:  srv.Handler,
+		cache: map[[sha256.Size]byte]bool{},
+	}
+	if c.TLSServerConfig == nil {
+		return srv.Serve(l)
+	}
+	srv.TLSConfig, err = c.TLSServerConfig.tlsConfig()
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig.GetConfigForClient =
+		func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := readConfig(path)
+			if err != nil {
+				log.Error("couldn't reload web configuration", slog.Any("error", err))
+				return nil, err
+			}
+			if c.TLSServerConfig == nil {
+				return nil, fmt.Errorf("TLS can't be disabled without a restart")
+			}
+			return c.TLSServerConfig.tlsConfig()
+		}
+	return srv.ServeTLS(l, "", "")
+}
+
+// authHandler requires basic authentication by the users in the web
+// configuration file, if any.
+type authHandler struct {
+	path string
+	log  *slog.Logger
+	next http.Handler
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]bool
+}
+
+// ServeHTTP implements http.Handler.
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, err := readConfig(h.path)
+	if err != nil {
+		h.log.Error("couldn't reload web configuration", slog.Any("error", err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	if len(c.BasicAuthUsers) == 0 {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	user, password, ok := r.BasicAuth()
+	if ok && h.authenticate(c.BasicAuthUsers, user, password) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="goodwe"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized),
+		http.StatusUnauthorized)
+}
+
+// authenticate returns true if password matches the bcrypt hash of user.
+func (h *authHandler) authenticate(users map[string]string, user, password string) bool {
+	hash, ok := users[user]
+	if !ok {
+		// compare anyway, so that unknown users can't be detected by timing
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+	// the cache key includes the hash so that changed passwords take effect
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+	h.mu.Lock()
+	cached := h.cache[key]
+	h.mu.Unlock()
+	if cached {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.cache) >= authCacheSize {
+		clear(h.cache)
+	}
+	h.cache[key] = true
+	return true
+}
+
+// dummyHash is compared against the passwords of unknown users.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	return hash
+})
@@ -0,0 +1,235 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeCert writes a certificate and key for localhost to dir, signed by
+// parent, or self-signed if parent is nil. It returns the certificate.
+func writeCert(
+	t *testing.T,
+	dir,
+	name string,
+	parent *tls.Certificate,
+) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := &template, any(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, &template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	assert.NoError(t, os.WriteFile(
+		filepath.Join(dir, name+".crt"), certPEM, 0600))
+	assert.NoError(t, os.WriteFile(
+		filepath.Join(dir, name+".key"), keyPEM, 0600))
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.NoError(t, err)
+	return cert
+}
+
+// hash returns the bcrypt hash of password.
+func hash(t *testing.T, password string) string {
+	t.Helper()
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	assert.NoError(t, err)
+	return string(h)
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "server", nil)
+	var testCases = map[string]struct {
+		config    string
+		expectErr bool
+	}{
+		"empty": {
+			config: "",
+		},
+		"tls": {
+			config: "tls_server_config:\n" +
+				"  cert_file: server.crt\n" +
+				"  key_file: server.key\n" +
+				"  client_auth_type: RequireAndVerifyClientCert\n" +
+				"  client_ca_file: server.crt\n" +
+				"  min_version: TLS13\n",
+		},
+		"basic auth": {
+			config: fmt.Sprintf("basic_auth_users:\n  alice: %s\n",
+				hash(t, "secret")),
+		},
+		"unknown field": {
+			config:    "http_server_config:\n  http2: false\n",
+			expectErr: true,
+		},
+		"invalid hash": {
+			config:    "basic_auth_users:\n  alice: secret\n",
+			expectErr: true,
+		},
+		"missing key": {
+			config:    "tls_server_config:\n  cert_file: server.crt\n",
+			expectErr: true,
+		},
+		"missing cert": {
+			config: "tls_server_config:\n" +
+				"  cert_file: missing.crt\n" +
+				"  key_file: server.key\n",
+			expectErr: true,
+		},
+		"verify without CA": {
+			config: "tls_server_config:\n" +
+				"  cert_file: server.crt\n" +
+				"  key_file: server.key\n" +
+				"  client_auth_type: RequireAndVerifyClientCert\n",
+			expectErr: true,
+		},
+		"invalid client auth type": {
+			config: "tls_server_config:\n" +
+				"  cert_file: server.crt\n" +
+				"  key_file: server.key\n" +
+				"  client_auth_type: Sometimes\n",
+			expectErr: true,
+		},
+		"invalid version": {
+			config: "tls_server_config:\n" +
+				"  cert_file: server.crt\n" +
+				"  key_file: server.key\n" +
+				"  min_version: SSL3\n",
+			expectErr: true,
+		},
+		"max less than min": {
+			config: "tls_server_config:\n" +
+				"  cert_file: server.crt\n" +
+				"  key_file: server.key\n" +
+				"  min_version: TLS13\n" +
+				"  max_version: TLS12\n",
+			expectErr: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(tt *testing.T) {
+			path := filepath.Join(dir, "web-config.yml")
+			assert.NoError(tt, os.WriteFile(path, []byte(tc.config), 0600))
+			_, err := LoadConfig(path)
+			if tc.expectErr {
+				assert.Error(tt, err)
+			} else {
+				assert.NoError(tt, err)
+			}
+		})
+	}
+}
+
+func TestServe(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeCert(t, dir, "ca", nil)
+	writeCert(t, dir, "server", &ca)
+	client := writeCert(t, dir, "client", &ca)
+	path := filepath.Join(dir, "web-config.yml")
+	writeConfig := func(clientAuth, password string) {
+		config := fmt.Sprintf("tls_server_config:\n"+
+			"  cert_file: server.crt\n"+
+			"  key_file: server.key\n"+
+			"  client_auth_type: %s\n"+
+			"  client_ca_file: ca.crt\n"+
+			"basic_auth_users:\n"+
+			"  alice: %s\n", clientAuth, hash(t, password))
+		assert.NoError(t, os.WriteFile(path, []byte(config), 0600))
+	}
+	writeConfig("NoClientCert", "secret")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	srv := http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		}),
+	}
+	log := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	done := make(chan error)
+	go func() {
+		done <- Serve(l, &srv, path, log)
+	}()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	url := "https://" + l.Addr().String()
+	// get returns the response status, or an error
+	get := func(user, password string, certs ...tls.Certificate) (int, error) {
+		c := http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		assert.NoError(t, err)
+		req.SetBasicAuth(user, password)
+		resp, err := c.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	status, err := get("alice", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	// the cached result is used for the second request
+	status, err = get("alice", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	status, err = get("alice", "wrong")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, err = get("bob", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	// the configuration is reloaded, requiring client certificates and
+	// changing the password
+	writeConfig("RequireAndVerifyClientCert", "changed")
+	_, err = get("alice", "changed")
+	assert.Error(t, err)
+	status, err = get("alice", "secret", client)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, err = get("alice", "changed", client)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NoError(t, srv.Close())
+	assert.Equal(t, http.ErrServerClosed, <-done)
+}